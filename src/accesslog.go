@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	squidAccessLogFormat    = "squid"
+	combinedAccessLogFormat = "combined"
+	jsonlAccessLogFormat    = "jsonl"
+
+	defaultAccessLogMaxSize    = 100
+	defaultAccessLogMaxBackups = 5
+
+	// exitIPHeader is how the end proxy reports the address a request left it from
+	exitIPHeader = "X-Luminati-Ip"
+)
+
+// accessEntry describes a proxied request or CONNECT tunnel, for the access log and request history
+type accessEntry struct {
+	Time      time.Time `json:"time"`
+	Duration  float64   `json:"duration"`
+	ClientIP  string    `json:"client_ip"`
+	Session   int       `json:"session"`
+	Key       string    `json:"key,omitempty"`
+	Type      string    `json:"type"`
+	Method    string    `json:"method"`
+	Host      string    `json:"host"`
+	URL       string    `json:"url"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Upstream  string    `json:"upstream"`
+	ExitIP    string    `json:"exit_ip,omitempty"`
+	RequestID string    `json:"request_id"`
+	// UpstreamError is why the end proxy failed the request, or why it could not be reached
+	UpstreamError string `json:"upstream_error,omitempty"`
+
+	contentType string
+	userAgent   string
+	referer     string
+	proto       string
+	denied      bool
+	started     time.Time
+}
+
+// newAccessEntry starts the entry for a proxied request, it is finished once the transfer is done.
+// The client ip is taken from X-Forwarded-For when the request came through `trustedProxies`
+func newAccessEntry(req *http.Request, requestType string, session int, upstream string, trustedProxies []*net.IPNet) *accessEntry {
+	entry := &accessEntry{
+		Session:   session,
+		Type:      requestType,
+		Method:    req.Method,
+		Host:      req.URL.Host,
+		URL:       req.URL.String(),
+		Upstream:  upstream,
+		RequestID: requestIDFromRequest(req),
+		userAgent: req.UserAgent(),
+		referer:   req.Referer(),
+		proto:     req.Proto,
+		started:   time.Now(),
+	}
+	if entry.Host == "" {
+		entry.Host = req.Host
+	}
+	// CONNECTs are logged with their host:port, as Squid does
+	if requestType == connectRequest {
+		entry.URL = entry.Host
+	}
+	if ip := clientIP(req, trustedProxies); ip != nil {
+		entry.ClientIP = ip.String()
+	}
+	return entry
+}
+
+// orDash stands in for empty values in the text formats
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// squid writes the entry in Squid's native format, without any other fields so it can be read by
+// anything parsing Squid's logs. The session, exit ip and request id are left to the other formats
+func (e *accessEntry) squid() string {
+	action := "TCP_MISS"
+	switch {
+	case e.denied:
+		action = "TCP_DENIED"
+	case e.Type == connectRequest:
+		action = "TCP_TUNNEL"
+	}
+	return fmt.Sprintf("%d.%03d %6d %s %s/%03d %d %s %s %s FIRSTUP_PARENT/%s %s",
+		e.Time.Unix(), e.Time.Nanosecond()/int(time.Millisecond), int64(e.Duration*1000), orDash(e.ClientIP),
+		action, e.Status, e.Bytes, e.Method, e.URL, orDash(e.Key), orDash(e.Upstream), orDash(e.contentType))
+}
+
+// combined writes the entry in the Combined Log Format, followed by the session, upstream,
+// exit ip, duration and request id
+func (e *accessEntry) combined() string {
+	quote := func(value string) string {
+		return strings.Replace(orDash(value), `"`, `\"`, -1)
+	}
+	return fmt.Sprintf(`%s - %s [%s] "%s %s %s" %d %d "%s" "%s" session=%d upstream=%s exit_ip=%s duration=%.3f request_id=%s`,
+		orDash(e.ClientIP), orDash(e.Key), e.Time.Format("02/Jan/2006:15:04:05 -0700"), e.Method, quote(e.URL), orDash(e.proto),
+		e.Status, e.Bytes, quote(e.referer), quote(e.userAgent),
+		e.Session, orDash(e.Upstream), orDash(e.ExitIP), e.Duration, e.RequestID)
+}
+
+// AccessLog writes a line for every proxied request and CONNECT tunnel to a rotated file
+type AccessLog struct {
+	format string
+	file   *rotatingFile
+	mutex  sync.Mutex
+}
+
+// Configure opens the access log described by `config`, closing the previous file. The same file
+// is reopened when it has not changed, so it can be moved away by logrotate then sent SIGHUP
+func (a *AccessLog) Configure(config AccessLogConfig) error {
+	var file *rotatingFile
+	if config.Path != "" {
+		maxSize, maxBackups := config.MaxSize, config.MaxBackups
+		if maxSize == 0 {
+			maxSize = defaultAccessLogMaxSize
+		}
+		if maxBackups == 0 {
+			maxBackups = defaultAccessLogMaxBackups
+		}
+		opened, err := openRotatingFile(config.Path, int64(maxSize)*1024*1024, maxBackups)
+		if err != nil {
+			return err
+		}
+		file = opened
+	}
+	format := config.Format
+	if format == "" {
+		format = squidAccessLogFormat
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.file != nil {
+		a.file.Close()
+	}
+	a.file = file
+	a.format = format
+	return nil
+}
+
+// Log writes a finished entry, when the access log is enabled
+func (a *AccessLog) Log(entry *accessEntry) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.file == nil {
+		return
+	}
+
+	var line string
+	switch a.format {
+	case jsonlAccessLogFormat:
+		data, err := json.Marshal(entry)
+		if err != nil {
+			proxyLog.Errorf("Error occured encoding an access log entry : %+v", err)
+			return
+		}
+		line = string(data)
+	case combinedAccessLogFormat:
+		line = entry.combined()
+	default:
+		line = entry.squid()
+	}
+	if _, err := a.file.Write([]byte(line + "\n")); err != nil {
+		proxyLog.Errorf("Error occured writing the access log : %+v", err)
+	}
+}
+
+// accessCounter finishes the access entry of a proxied request once its counters are closed.
+// Only the bytes delivered to the client are logged, as Squid does, which are counted through
+// delivered rather than along with everything else the request transfers
+type accessCounter struct {
+	entry  *accessEntry
+	finish func(entry *accessEntry)
+	bytes  int64
+	once   sync.Once
+}
+
+// Add ignores the bytes sent to the target, see delivered
+func (c *accessCounter) Add(n int64) error {
+	return nil
+}
+
+// delivered counts the bytes sent back to the client
+func (c *accessCounter) delivered() ByteCounter {
+	return deliveredCounter{access: c}
+}
+
+func (c *accessCounter) Close() {
+	c.once.Do(func() {
+		c.entry.Bytes = atomic.LoadInt64(&c.bytes)
+		c.finish(c.entry)
+	})
+}
+
+type deliveredCounter struct {
+	access *accessCounter
+}
+
+func (d deliveredCounter) Add(n int64) error {
+	atomic.AddInt64(&d.access.bytes, n)
+	return nil
+}
+
+func (d deliveredCounter) Close() {}
+
+// rotatingFile appends to a file, moving it to <path>.1 once it would grow past maxSize and
+// keeping maxBackups of the older files, the oldest at <path>.<maxBackups>
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	file *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// Write is not safe for concurrent use, the access log serializes lines itself
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	var rotateErr error
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		rotateErr = f.rotate()
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+// rotate shifts every backup along by one, dropping the oldest. The file is reopened even
+// when that fails, so lines keep being written to it
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	var renameErr error
+	for i := f.maxBackups; i > 0 && renameErr == nil; i-- {
+		older := fmt.Sprintf("%s.%d", f.path, i)
+		newer := f.path
+		if i > 1 {
+			newer = fmt.Sprintf("%s.%d", f.path, i-1)
+		}
+		if err := os.Rename(newer, older); err != nil && !os.IsNotExist(err) {
+			renameErr = err
+		}
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	return renameErr
+}
+
+func (f *rotatingFile) Close() error {
+	return f.file.Close()
+}
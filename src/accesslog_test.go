@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogFormats(t *testing.T) {
+	entry := &accessEntry{
+		Time:        time.Date(2019, 3, 4, 10, 30, 15, 250*int(time.Millisecond), time.UTC),
+		Duration:    0.18,
+		ClientIP:    "10.0.0.7",
+		Session:     3001,
+		Key:         "crawler",
+		Type:        plainRequest,
+		Method:      http.MethodGet,
+		Host:        "example.com",
+		URL:         "http://example.com/a",
+		Status:      200,
+		Bytes:       411,
+		Upstream:    "zproxy.lum-superproxy.io:22225",
+		ExitIP:      "203.0.113.9",
+		RequestID:   "abc",
+		contentType: "text/html",
+		userAgent:   `crawler "v2"`,
+		proto:       "HTTP/1.1",
+	}
+
+	squid := "1551695415.250    180 10.0.0.7 TCP_MISS/200 411 GET http://example.com/a crawler FIRSTUP_PARENT/zproxy.lum-superproxy.io:22225 text/html"
+	if entry.squid() != squid {
+		t.Errorf("Expected squid line\n%s\nbut got\n%s", squid, entry.squid())
+	}
+	combined := `10.0.0.7 - crawler [04/Mar/2019:10:30:15 +0000] "GET http://example.com/a HTTP/1.1" 200 411 "-" "crawler \"v2\"" session=3001 upstream=zproxy.lum-superproxy.io:22225 exit_ip=203.0.113.9 duration=0.180 request_id=abc`
+	if entry.combined() != combined {
+		t.Errorf("Expected combined line\n%s\nbut got\n%s", combined, entry.combined())
+	}
+
+	entry.Type, entry.Method, entry.URL, entry.Key, entry.ExitIP, entry.contentType = connectRequest, http.MethodConnect, "example.com:443", "", "", ""
+	if !strings.HasSuffix(entry.squid(), " TCP_TUNNEL/200 411 CONNECT example.com:443 - FIRSTUP_PARENT/zproxy.lum-superproxy.io:22225 -") || len(strings.Fields(entry.squid())) != 10 {
+		t.Errorf("Unexpected squid line for a CONNECT %s", entry.squid())
+	}
+	entry.denied, entry.Status = true, 403
+	if !strings.Contains(entry.squid(), " TCP_DENIED/403 ") {
+		t.Errorf("Unexpected squid line for a denied CONNECT %s", entry.squid())
+	}
+}
+
+func TestAccessEntryClientIP(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.RemoteAddr = "10.0.0.2:51234"
+	req.Header.Set(forwardedForHeader, "203.0.113.7")
+
+	if entry := newAccessEntry(req, plainRequest, 3001, "zproxy", nil); entry.ClientIP != "10.0.0.2" {
+		t.Fatalf("Expected the forwarded ip to be ignored without trusted proxies but got %s", entry.ClientIP)
+	}
+	trusted, _ := parseCIDRs([]string{"10.0.0.0/8"})
+	if entry := newAccessEntry(req, plainRequest, 3001, "zproxy", trusted); entry.ClientIP != "203.0.113.7" {
+		t.Fatalf("Expected the client ip forwarded by a trusted proxy but got %s", entry.ClientIP)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "praxis-access")
+	if err != nil {
+		t.Fatalf("Unable to create directory : %+v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	file, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("Unable to open file : %+v", err)
+	}
+	for i := 1; i <= 4; i++ {
+		if _, err := file.Write([]byte(fmt.Sprintf("line %d\n", i))); err != nil {
+			t.Fatalf("Unable to write : %+v", err)
+		}
+	}
+	file.Close()
+
+	expected := map[string]string{path: "line 4\n", path + ".1": "line 3\n", path + ".2": "line 2\n"}
+	for name, contents := range expected {
+		data, _ := ioutil.ReadFile(name)
+		if string(data) != contents {
+			t.Errorf("Expected %s to hold %q but got %q", name, contents, data)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected only 2 backups to be kept")
+	}
+}
+
+func TestProxyAccessLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "praxis-access")
+	if err != nil {
+		t.Fatalf("Unable to create directory : %+v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	endProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(exitIPHeader, "203.0.113.9")
+		w.Write([]byte("through the end proxy"))
+	}))
+	defer endProxy.Close()
+
+	accessLog := &AccessLog{}
+	if err := accessLog.Configure(AccessLogConfig{Path: path, Format: jsonlAccessLogFormat}); err != nil {
+		t.Fatalf("Unable to open the access log : %+v", err)
+	}
+	underTest := Proxy{
+		URL:        endProxy.URL,
+		upperBound: 8088,
+		lowerBound: 8088,
+		freePorts:  makeRange(8088, 8088),
+	}
+	underTest.Record(accessLog.Log)
+	underTest.Identify(func(req *http.Request) string { return "crawler" })
+	underTest.Use(func(req *http.Request) error {
+		if req.URL.Path == "/denied" {
+			return fmt.Errorf("denied")
+		}
+		return nil
+	})
+	id, proxy, err := underTest.Create(8088)
+	if err != nil {
+		t.Fatalf("Error encountered creating proxy : %+v", err)
+	}
+	defer proxy.Close()
+
+	time.Sleep(1 * time.Second)
+
+	client := &http.Client{Transport: &http.Transport{
+		Proxy: func(req *http.Request) (*url.URL, error) {
+			return url.Parse("http://localhost:8088")
+		},
+	}}
+	// Only the bytes delivered to the client are logged, not those uploaded
+	for _, target := range []string{"/allowed", "/denied"} {
+		resp, err := client.Post("http://praxis.invalid"+target, "text/plain", strings.NewReader("sent to the target"))
+		if err != nil {
+			t.Fatalf("Unexpected error proxying : %+v", err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	data, _ := ioutil.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected a line per request but got :\n%s", data)
+	}
+	allowed, denied := accessEntry{}, accessEntry{}
+	json.Unmarshal([]byte(lines[0]), &allowed)
+	json.Unmarshal([]byte(lines[1]), &denied)
+
+	if allowed.Session != id || allowed.Key != "crawler" || allowed.Method != http.MethodPost || allowed.Host != "praxis.invalid" ||
+		allowed.URL != "http://praxis.invalid/allowed" || allowed.Status != http.StatusOK || allowed.Bytes != int64(len("through the end proxy")) ||
+		allowed.Upstream != upstreamLabel(endProxy.URL) || allowed.ExitIP != "203.0.113.9" || allowed.ClientIP != "127.0.0.1" ||
+		allowed.Type != plainRequest || allowed.RequestID == "" || allowed.Time.IsZero() {
+		t.Errorf("Unexpected access log line %s", lines[0])
+	}
+	if denied.URL != "http://praxis.invalid/denied" || denied.Status != http.StatusForbidden || denied.Key != "" || denied.Bytes != 0 {
+		t.Errorf("Unexpected access log line for a denied request %s", lines[1])
+	}
+}
+
+func TestLoadConfigAccessLog(t *testing.T) {
+	path := writeTestConfig(t, testConfig)
+	defer os.Remove(path)
+
+	defer setTestEnv(map[string]string{"ACCESS_LOG": "/var/log/praxis/access.log", "ACCESS_LOG_FORMAT": "combined", "ACCESS_LOG_MAX_SIZE": "50"})()
+	config, err := loadConfig(path)
+	if err != nil || config.AccessLog != (AccessLogConfig{Path: "/var/log/praxis/access.log", Format: combinedAccessLogFormat, MaxSize: 50}) {
+		t.Fatalf("Expected the access log settings from the environment but got %+v : %+v", config, err)
+	}
+
+	defer setTestEnv(map[string]string{"ACCESS_LOG_FORMAT": "w3c", "ACCESS_LOG_MAX_BACKUPS": "-1"})()
+	_, err = loadConfig(path)
+	if err == nil || !strings.Contains(err.Error(), "access_log.format (ACCESS_LOG_FORMAT)") || !strings.Contains(err.Error(), "access_log.max_backups (ACCESS_LOG_MAX_BACKUPS)") {
+		t.Fatalf("Expected bad access log settings to be reported but got %+v", err)
+	}
+}
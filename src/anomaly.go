@@ -0,0 +1,397 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	anomalyDetectionVar = "ANOMALY_DETECTION"
+
+	// WebhookAnomaly is sent when a session is throttled or suspended for runaway traffic
+	WebhookAnomaly = "anomaly"
+
+	// baselineMinutes is how many minutes of a keys traffic are seen before spikes are detected
+	baselineMinutes = 10
+	// baselineWeight is how much each minute moves a keys baseline
+	baselineWeight = 0.1
+	// anomalyIdle is how long a sessions traffic is kept without any requests
+	anomalyIdle = time.Hour
+)
+
+// AnomalyAction is what happens to a session once its traffic is considered runaway
+type AnomalyAction string
+
+// The available actions taken against runaway sessions
+const (
+	ThrottleAction AnomalyAction = "throttle"
+	SuspendAction  AnomalyAction = "suspend"
+)
+
+// AnomalyPolicy decides when a sessions traffic is runaway and what is done about it,
+// unset fields use the defaults
+type AnomalyPolicy struct {
+	// RepeatedURL is how many times a session may request the same url in a minute
+	RepeatedURL int `json:",omitempty" yaml:"repeated_url"`
+	// SpikeFactor is how many times its baseline a keys requests per minute may reach,
+	// ignored until the key makes SpikeMinimum requests in a minute
+	SpikeFactor  float64 `json:",omitempty" yaml:"spike_factor"`
+	SpikeMinimum int64   `json:",omitempty" yaml:"spike_minimum"`
+	// ErrorRate is the fraction of a sessions responses in a minute which may be errors,
+	// ignored until the session has ErrorMinimum responses in the minute
+	ErrorRate    float64 `json:",omitempty" yaml:"error_rate"`
+	ErrorMinimum int     `json:",omitempty" yaml:"error_minimum"`
+
+	// Action is taken for Duration, throttled sessions are allowed ThrottleRate requests per second
+	Action       AnomalyAction `json:",omitempty" yaml:"action"`
+	Duration     string        `json:",omitempty" yaml:"duration"`
+	ThrottleRate float64       `json:",omitempty" yaml:"throttle_rate"`
+
+	// Disabled turns detection off for the key when it is enabled for every key
+	Disabled bool `json:",omitempty" yaml:"disabled"`
+}
+
+var defaultAnomalyPolicy = AnomalyPolicy{
+	RepeatedURL:  120,
+	SpikeFactor:  10,
+	SpikeMinimum: 600,
+	ErrorRate:    0.5,
+	ErrorMinimum: 50,
+	Action:       ThrottleAction,
+	Duration:     "10m",
+	ThrottleRate: 1,
+}
+
+// withDefaults fills in the unset fields of the policy
+func (p AnomalyPolicy) withDefaults() AnomalyPolicy {
+	if p.RepeatedURL <= 0 {
+		p.RepeatedURL = defaultAnomalyPolicy.RepeatedURL
+	}
+	if p.SpikeFactor <= 0 {
+		p.SpikeFactor = defaultAnomalyPolicy.SpikeFactor
+	}
+	if p.SpikeMinimum <= 0 {
+		p.SpikeMinimum = defaultAnomalyPolicy.SpikeMinimum
+	}
+	if p.ErrorRate <= 0 {
+		p.ErrorRate = defaultAnomalyPolicy.ErrorRate
+	}
+	if p.ErrorMinimum <= 0 {
+		p.ErrorMinimum = defaultAnomalyPolicy.ErrorMinimum
+	}
+	if p.Action == "" {
+		p.Action = defaultAnomalyPolicy.Action
+	}
+	if p.Duration == "" {
+		p.Duration = defaultAnomalyPolicy.Duration
+	}
+	if p.ThrottleRate <= 0 {
+		p.ThrottleRate = defaultAnomalyPolicy.ThrottleRate
+	}
+	return p
+}
+
+func (p *AnomalyPolicy) validate() error {
+	if p.Action != "" && p.Action != ThrottleAction && p.Action != SuspendAction {
+		return fmt.Errorf("Unknown anomaly action %s, expected %s or %s", p.Action, ThrottleAction, SuspendAction)
+	}
+	if p.Duration != "" {
+		if _, err := time.ParseDuration(p.Duration); err != nil {
+			return fmt.Errorf("Unable to parse anomaly duration %s : %+v", p.Duration, err)
+		}
+	}
+	if p.ErrorRate > 1 {
+		return fmt.Errorf("Anomaly error rate %v must be a fraction of responses", p.ErrorRate)
+	}
+	return nil
+}
+
+func (p *AnomalyPolicy) duration() time.Duration {
+	duration, err := time.ParseDuration(p.Duration)
+	if err != nil {
+		duration, _ = time.ParseDuration(defaultAnomalyPolicy.Duration)
+	}
+	return duration
+}
+
+// keyTraffic tracks a keys requests per minute against its baseline
+type keyTraffic struct {
+	minute   int64
+	requests int64
+	baseline float64
+	minutes  int
+}
+
+// roll moves the traffic on to `minute`, folding each elapsed minute into the baseline
+func (k *keyTraffic) roll(minute int64) {
+	if k.minute == 0 {
+		k.minute = minute
+		return
+	}
+	elapsed := minute - k.minute
+	if elapsed <= 0 {
+		return
+	}
+	k.baseline += baselineWeight * (float64(k.requests) - k.baseline)
+	// Any other elapsed minutes had no requests
+	if idle := elapsed - 1; idle > 0 {
+		k.baseline *= math.Pow(1-baselineWeight, float64(idle))
+	}
+	k.minutes += int(elapsed)
+	k.requests = 0
+	k.minute = minute
+}
+
+// sessionTraffic tracks a sessions requests and errors in the current minute, along with
+// any action taken against it
+type sessionTraffic struct {
+	keyConfig *AuthWithLimit
+	policy    AnomalyPolicy
+
+	minute    int64
+	urls      map[string]int
+	responses int
+	errors    int
+	seen      time.Time
+
+	action AnomalyAction
+	reason string
+	until  time.Time
+	last   time.Time
+}
+
+func (s *sessionTraffic) roll(minute int64) {
+	if s.minute != minute {
+		s.minute = minute
+		s.urls = make(map[string]int)
+		s.responses = 0
+		s.errors = 0
+	}
+}
+
+// AnomalyDetector watches the traffic of each session for runaway clients, throttling or
+// suspending them. Sessions are only served by the instance which created them, so
+// traffic is tracked in process
+type AnomalyDetector struct {
+	// Enabled checks every key, otherwise only keys with their own policy are checked
+	Enabled bool
+
+	config   *AuthConfig
+	keys     map[string]*keyTraffic
+	sessions map[int]*sessionTraffic
+	swept    time.Time
+	mutex    sync.Mutex
+}
+
+// NewAnomalyDetector creates a detector notifying through the webhooks of `config`
+func NewAnomalyDetector(config *AuthConfig, enabled bool) *AnomalyDetector {
+	return &AnomalyDetector{
+		Enabled:  enabled,
+		config:   config,
+		keys:     make(map[string]*keyTraffic),
+		sessions: make(map[int]*sessionTraffic),
+	}
+}
+
+// parseAnomalyDetection reads whether ANOMALY_DETECTION enables detection for every key
+func parseAnomalyDetection() (bool, error) {
+	value := os.Getenv(anomalyDetectionVar)
+	if value == "" {
+		return false, nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("%s must be true or false, got %q", anomalyDetectionVar, value)
+	}
+	return enabled, nil
+}
+
+// loadAnomalyDetector enables detection for every key when ANOMALY_DETECTION is true
+func loadAnomalyDetector(config *AuthConfig) *AnomalyDetector {
+	enabled, err := parseAnomalyDetection()
+	if err != nil {
+		panic(fmt.Sprintf("Failed to parse anomaly detection : %+v", err))
+	}
+	return NewAnomalyDetector(config, enabled)
+}
+
+func (d *AnomalyDetector) policy(keyConfig *AuthWithLimit) (AnomalyPolicy, bool) {
+	if keyConfig.Anomaly != nil {
+		return keyConfig.Anomaly.withDefaults(), !keyConfig.Anomaly.Disabled
+	}
+	return defaultAnomalyPolicy, d.Enabled
+}
+
+// check rejects requests from throttled or suspended sessions, otherwise counting the request
+// and acting against the session if it is now runaway
+func (d *AnomalyDetector) check(keyConfig *AuthWithLimit, req *http.Request) error {
+	if d == nil {
+		return nil
+	}
+	policy, enabled := d.policy(keyConfig)
+	sessionID, ok := sessionFromRequest(req)
+	if !enabled || !ok {
+		return nil
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := time.Now()
+	minute := now.Unix() / 60
+	d.sweep(now)
+
+	traffic, ok := d.sessions[sessionID]
+	if !ok {
+		traffic = &sessionTraffic{}
+		d.sessions[sessionID] = traffic
+	}
+	traffic.keyConfig = keyConfig
+	traffic.policy = policy
+	traffic.seen = now
+	traffic.roll(minute)
+
+	if now.Before(traffic.until) {
+		if traffic.action == SuspendAction {
+			return &authError{Status: http.StatusTooManyRequests, RetryAfter: traffic.until.Sub(now), Message: "Session suspended for runaway traffic"}
+		}
+		interval := time.Duration(float64(time.Second) / policy.ThrottleRate)
+		if wait := traffic.last.Add(interval).Sub(now); wait > 0 {
+			return &authError{Status: http.StatusTooManyRequests, RetryAfter: wait, Message: "Session throttled for runaway traffic"}
+		}
+		traffic.last = now
+	}
+
+	key, ok := d.keys[keyConfig.ID]
+	if !ok {
+		key = &keyTraffic{}
+		d.keys[keyConfig.ID] = key
+	}
+	key.roll(minute)
+	key.requests++
+
+	url := req.Host
+	if req.Method != http.MethodConnect {
+		url = req.URL.String()
+	}
+	traffic.urls[url]++
+
+	if now.Before(traffic.until) {
+		return nil
+	}
+	switch {
+	case traffic.urls[url] > policy.RepeatedURL:
+		d.act(sessionID, traffic, now, fmt.Sprintf("requested %s %d times in a minute", url, traffic.urls[url]))
+	case key.minutes >= baselineMinutes && key.requests >= policy.SpikeMinimum && float64(key.requests) > policy.SpikeFactor*key.baseline:
+		d.act(sessionID, traffic, now, fmt.Sprintf("key made %d requests in a minute against a baseline of %.1f", key.requests, key.baseline))
+	default:
+		return nil
+	}
+	if traffic.action == SuspendAction {
+		return &authError{Status: http.StatusTooManyRequests, RetryAfter: traffic.until.Sub(now), Message: "Session suspended for runaway traffic"}
+	}
+	traffic.last = now
+	return nil
+}
+
+// observe counts the responses of a session, acting against it if too many of them are errors
+func (d *AnomalyDetector) observe(req *http.Request, resp *http.Response) {
+	if d == nil {
+		return
+	}
+	sessionID, ok := sessionFromRequest(req)
+	if !ok {
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	traffic, ok := d.sessions[sessionID]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	traffic.roll(now.Unix() / 60)
+	traffic.responses++
+	if resp == nil || resp.StatusCode >= http.StatusBadRequest {
+		traffic.errors++
+	}
+
+	policy := traffic.policy
+	if now.Before(traffic.until) || traffic.responses < policy.ErrorMinimum {
+		return
+	}
+	if rate := float64(traffic.errors) / float64(traffic.responses); rate > policy.ErrorRate {
+		d.act(sessionID, traffic, now, fmt.Sprintf("%d of %d responses in a minute were errors", traffic.errors, traffic.responses))
+	}
+}
+
+// act throttles or suspends the session as its policy says, notifying about it
+func (d *AnomalyDetector) act(sessionID int, traffic *sessionTraffic, now time.Time, reason string) {
+	traffic.action = traffic.policy.Action
+	traffic.reason = reason
+	traffic.until = now.Add(traffic.policy.duration())
+	anomalyLog.With(Fields{"session": sessionID, "key": traffic.keyConfig.ID}).Warnf("%s until %s : %s", traffic.action, traffic.until.Format(time.RFC3339), reason)
+
+	if d.config != nil && d.config.Webhooks != nil {
+		d.config.Webhooks.send(traffic.keyConfig, WebhookEvent{
+			Event:   WebhookAnomaly,
+			Session: sessionID,
+			Action:  traffic.action,
+			Reason:  reason,
+			Until:   traffic.until.UTC().Format(time.RFC3339),
+		})
+	}
+}
+
+// AnomalyStatus describes the action currently taken against a session
+type AnomalyStatus struct {
+	Action AnomalyAction `json:"action"`
+	Reason string        `json:"reason"`
+	Until  time.Time     `json:"until"`
+}
+
+// status returns the action currently taken against the session, if any
+func (d *AnomalyDetector) status(sessionID int) *AnomalyStatus {
+	if d == nil {
+		return nil
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	traffic, ok := d.sessions[sessionID]
+	if !ok || !time.Now().Before(traffic.until) {
+		return nil
+	}
+	return &AnomalyStatus{Action: traffic.action, Reason: traffic.reason, Until: traffic.until}
+}
+
+// forget drops the traffic of a closed session
+func (d *AnomalyDetector) forget(sessionID int) {
+	if d == nil {
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	delete(d.sessions, sessionID)
+}
+
+// sweep drops the traffic of sessions which have gone idle, at most once a minute
+func (d *AnomalyDetector) sweep(now time.Time) {
+	if now.Sub(d.swept) < time.Minute {
+		return
+	}
+	d.swept = now
+	for id, traffic := range d.sessions {
+		if now.Sub(traffic.seen) > anomalyIdle && !now.Before(traffic.until) {
+			delete(d.sessions, id)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func anomalyRequest(session int, url string) *http.Request {
+	return withSession(httptest.NewRequest(http.MethodGet, url, nil), session)
+}
+
+func TestAnomalyRepeatedURL(t *testing.T) {
+	detector := NewAnomalyDetector(nil, false)
+	keyConfig := &AuthWithLimit{ID: "crawler", Anomaly: &AnomalyPolicy{RepeatedURL: 3, Action: SuspendAction}}
+
+	for i := 0; i < 3; i++ {
+		if err := detector.check(keyConfig, anomalyRequest(1, "http://example.com/loop")); err != nil {
+			t.Fatalf("Unexpected error on request %d : %+v", i, err)
+		}
+	}
+	// Other sessions of the key are unaffected
+	if err := detector.check(keyConfig, anomalyRequest(2, "http://example.com/loop")); err != nil {
+		t.Fatalf("Unexpected error for another session : %+v", err)
+	}
+
+	err, ok := detector.check(keyConfig, anomalyRequest(1, "http://example.com/loop")).(*authError)
+	if !ok || err.Status != http.StatusTooManyRequests || err.RetryAfter <= 0 {
+		t.Fatalf("Expected session to be suspended but got %+v", err)
+	}
+	if err := detector.check(keyConfig, anomalyRequest(1, "http://example.com/other")); err == nil {
+		t.Fatalf("Expected suspended session to reject every url")
+	}
+	if status := detector.status(1); status == nil || status.Action != SuspendAction {
+		t.Fatalf("Expected suspended status but got %+v", status)
+	}
+
+	detector.forget(1)
+	if err := detector.check(keyConfig, anomalyRequest(1, "http://example.com/loop")); err != nil {
+		t.Fatalf("Expected forgotten session to be allowed but got %+v", err)
+	}
+}
+
+func TestAnomalyThrottle(t *testing.T) {
+	detector := NewAnomalyDetector(nil, true)
+	keyConfig := &AuthWithLimit{ID: "crawler"}
+	detector.sessions[1] = &sessionTraffic{
+		keyConfig: keyConfig,
+		policy:    defaultAnomalyPolicy,
+		action:    ThrottleAction,
+		until:     time.Now().Add(time.Minute),
+	}
+
+	if err := detector.check(keyConfig, anomalyRequest(1, "http://example.com/")); err != nil {
+		t.Fatalf("Expected first throttled request to be allowed but got %+v", err)
+	}
+	err, ok := detector.check(keyConfig, anomalyRequest(1, "http://example.com/")).(*authError)
+	if !ok || err.Status != http.StatusTooManyRequests || err.retryAfterSeconds() != "1" {
+		t.Fatalf("Expected throttled request to wait a second but got %+v", err)
+	}
+
+	// Keys can opt out when detection is enabled for every key
+	optedOut := &AuthWithLimit{ID: "trusted", Anomaly: &AnomalyPolicy{Disabled: true}}
+	if err := detector.check(optedOut, anomalyRequest(1, "http://example.com/")); err != nil {
+		t.Fatalf("Expected key with detection disabled to be allowed but got %+v", err)
+	}
+}
+
+func TestAnomalyErrorRate(t *testing.T) {
+	detector := NewAnomalyDetector(nil, false)
+	keyConfig := &AuthWithLimit{ID: "crawler", Anomaly: &AnomalyPolicy{ErrorRate: 0.5, ErrorMinimum: 4}}
+
+	statuses := []int{http.StatusOK, http.StatusNotFound, http.StatusInternalServerError, 0}
+	for _, status := range statuses {
+		req := anomalyRequest(1, "http://example.com/")
+		if err := detector.check(keyConfig, req); err != nil {
+			t.Fatalf("Unexpected error : %+v", err)
+		}
+		if status == 0 {
+			detector.observe(req, nil)
+		} else {
+			detector.observe(req, &http.Response{StatusCode: status})
+		}
+	}
+	if status := detector.status(1); status == nil || status.Action != ThrottleAction {
+		t.Fatalf("Expected session to be throttled for errors but got %+v", status)
+	}
+}
+
+func TestAnomalySpike(t *testing.T) {
+	detector := NewAnomalyDetector(nil, false)
+	keyConfig := &AuthWithLimit{ID: "crawler", Anomaly: &AnomalyPolicy{SpikeFactor: 2, SpikeMinimum: 5}}
+	detector.keys["crawler"] = &keyTraffic{minute: time.Now().Unix() / 60, baseline: 2, minutes: baselineMinutes}
+
+	for i := 0; i < 5; i++ {
+		detector.check(keyConfig, anomalyRequest(1, "http://example.com/"+string(rune('a'+i))))
+	}
+	if status := detector.status(1); status == nil {
+		t.Fatalf("Expected session to be throttled for a spike")
+	}
+}
+
+func TestKeyTrafficRoll(t *testing.T) {
+	key := &keyTraffic{}
+	key.roll(100)
+	key.requests = 100
+	key.roll(101)
+	if key.baseline != 10 || key.requests != 0 || key.minutes != 1 {
+		t.Fatalf("Expected baseline of 10 after a minute but got %+v", key)
+	}
+	key.roll(103)
+	if key.baseline < 8.09 || key.baseline > 8.11 || key.minutes != 3 {
+		t.Fatalf("Expected baseline to decay over idle minutes but got %+v", key)
+	}
+}
+
+func TestAnomalyPolicyValidate(t *testing.T) {
+	for _, invalid := range []AnomalyPolicy{{Action: "ban"}, {Duration: "soon"}, {ErrorRate: 2}} {
+		if err := invalid.validate(); err == nil {
+			t.Errorf("Expected %+v to be invalid", invalid)
+		}
+	}
+	valid := AnomalyPolicy{Action: SuspendAction, Duration: "1h", ErrorRate: 0.9}
+	if err := valid.validate(); err != nil {
+		t.Errorf("Expected %+v to be valid but got %+v", valid, err)
+	}
+}
@@ -2,100 +2,506 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"math"
+	"net"
 	"net/http"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 const (
-	authKeyHeader = "Auth-Key"
+	authKeyHeader    = "Auth-Key"
+	authKeyContext   = "praxis-auth-key"
+	retryAfterHeader = "Retry-After"
+
+	bandwidthFlushBytes = 256 * 1024
 )
 
 // AuthConfig is a simple struct to cpature AuthKeys for counting usages and restricting access
 type AuthConfig struct {
 	AuthKeys    []AuthWithLimit
 	ServiceName string
+
+	// Keys replaces AuthKeys when set, so the configured keys can be swapped on reload
+	Keys *KeySet
+
+	// TokenSecret signs the session tokens handed out for proxy authentication
+	TokenSecret []byte
+
+	// ClientCertificates maps verified client certificate subjects or common names to key ids
+	ClientCertificates map[string]string
+
+	// TrustedProxies are the reverse proxies whose X-Forwarded-For header is believed
+	TrustedProxies []*net.IPNet
+
+	// Webhooks are notified as keys approach their quotas, nil disables notifications
+	Webhooks *Webhooks
+
+	// Anomalies throttles or suspends sessions with runaway traffic, nil disables detection
+	Anomalies *AnomalyDetector
+
+	// SessionOwner names the key owning a live session, so tokens are refused once their session
+	// id is reused by another key. Tokens are only checked against their session id when unset
+	SessionOwner func(sessionID int) (string, bool)
 }
 
-// AuthWithLimit allows you to provide a key and daily limit of usage
+// AuthWithLimit allows you to provide a key and limit of usage per window, along with
+// an optional per second rate limit and burst size and daily/monthly bandwidth quotas
 type AuthWithLimit struct {
-	AuthKey string
-	Limit   int64
+	// ID is the public part of the key, used for lookups, counters and logging
+	ID string `yaml:"id"`
+	// KeyHash is the salted hash of the keys secret, the secret itself is never stored
+	KeyHash string `json:",omitempty" yaml:"key_hash"`
+	Limit   int64  `yaml:"limit"`
+
+	// Window is the period Limit applies to, defaulting to daily
+	Window QuotaWindow `yaml:"window"`
+	// TimeZone is the IANA time zone windows reset in, defaulting to UTC
+	TimeZone string `yaml:"time_zone"`
+
+	// RateLimit is the sustained number of requests per second allowed, zero disables rate limiting
+	RateLimit float64 `yaml:"rate_limit"`
+	// Burst is the number of requests allowed at once, defaulting to the rate limit when unset
+	Burst int64 `yaml:"burst"`
+
+	// DailyBytes and MonthlyBytes cap the bytes sent and received, zero is unlimited
+	DailyBytes   int64 `yaml:"daily_bytes"`
+	MonthlyBytes int64 `yaml:"monthly_bytes"`
+
+	// Role and Scopes grant access to api routes, keys with neither are clients
+	Role   Role    `yaml:"role"`
+	Scopes []Scope `yaml:"scopes"`
+
+	// AllowedCIDRs restricts the addresses the key can be used from, empty allows any
+	AllowedCIDRs []string `json:",omitempty" yaml:"allowed_cidrs"`
+	// Destinations restricts what the key can reach through the proxy, nil allows anything
+	Destinations *DestinationPolicy `json:",omitempty" yaml:"destinations"`
+	// WebhookURL is notified of the keys quota events as well as any global webhook
+	WebhookURL string `json:",omitempty" yaml:"webhook_url"`
+	// Anomaly overrides when the keys sessions are considered runaway and what is done about them
+	Anomaly *AnomalyPolicy `json:",omitempty" yaml:"anomaly"`
+}
+
+// authError is returned when a request fails authorization, carrying the status
+// code to respond with for both the api and proxied requests
+type authError struct {
+	Status     int
+	RetryAfter time.Duration
+	Message    string
+}
+
+func (e *authError) Error() string {
+	return e.Message
+}
+
+// retryAfterSeconds rounds the retry duration up to whole seconds as required by the Retry-After header
+func (e *authError) retryAfterSeconds() string {
+	return strconv.FormatInt(int64(math.Ceil(e.RetryAfter.Seconds())), 10)
 }
 
-func (c *AuthConfig) statKey(key string) string {
+func (c *AuthConfig) statKey(key string, bucket usageWindow) string {
 	return fmt.Sprintf("usage:%s:%s:%s", c.ServiceName,
 		key,
-		time.Now().Add(time.Hour*13).Format("2006-01-02"))
+		bucket.Label)
+}
+
+func (c *AuthConfig) bytesKey(key string, bucket usageWindow) string {
+	return c.statKey(key, bucket) + ":bytes"
+}
+
+func (c *AuthConfig) rateKey(key string) string {
+	return fmt.Sprintf("ratelimit:%s:%s", c.ServiceName, key)
+}
+
+func (k *AuthWithLimit) burst() int64 {
+	if k.Burst > 0 {
+		return k.Burst
+	}
+	return int64(math.Max(1, math.Ceil(k.RateLimit)))
+}
+
+func (k *AuthWithLimit) window() QuotaWindow {
+	if k.Window == "" {
+		return DailyWindow
+	}
+	return k.Window
+}
+
+func (k *AuthWithLimit) location() (*time.Location, error) {
+	if k.TimeZone == "" {
+		return time.UTC, nil
+	}
+	return loadLocation(k.TimeZone)
+}
+
+// storeUnavailable refuses a request which needs the store while it can't be reached, asking
+// the client to retry once the store may have returned
+func storeUnavailable(message string) *authError {
+	return &authError{Status: http.StatusServiceUnavailable, RetryAfter: storeRecoveryInterval, Message: message}
+}
+
+// authorize checks the requests key is valid, allowed from where the request came from and within its limits
+func (c *AuthConfig) authorize(store Store, req *http.Request) (*AuthWithLimit, error) {
+	keyConfig, err := c.keyConfig(store, req.Header.Get(authKeyHeader))
+	if err != nil {
+		return nil, storeUnavailable("Error occured looking up key")
+	}
+	if keyConfig == nil {
+		return nil, &authError{Status: http.StatusForbidden, Message: "Bad Authentication Key"}
+	}
+	return keyConfig, c.checkAccess(store, keyConfig, req)
 }
 
-func (c *AuthConfig) keyConfig(key string) *AuthWithLimit {
-	for _, i := range c.AuthKeys {
-		if strings.Compare(i.AuthKey, key) == 0 {
-			return &i
+// authorizeCertificate authorizes an api request by its verified client certificate
+func (c *AuthConfig) authorizeCertificate(store Store, req *http.Request) (*AuthWithLimit, error) {
+	id := c.certificateKeyID(req.TLS)
+	if id == "" {
+		return nil, &authError{Status: http.StatusForbidden, Message: "Client certificate is not mapped to a key"}
+	}
+	keyConfig, err := c.keyByID(store, id)
+	if err != nil {
+		return nil, storeUnavailable("Error occured looking up key")
+	}
+	if keyConfig == nil {
+		return nil, &authError{Status: http.StatusForbidden, Message: "Bad Authentication Key"}
+	}
+	return keyConfig, c.checkAccess(store, keyConfig, req)
+}
+
+// checkAccess checks the request source before its limits, so refused sources don't use up the keys quota
+func (c *AuthConfig) checkAccess(store Store, keyConfig *AuthWithLimit, req *http.Request) error {
+	if err := c.checkSource(keyConfig, req); err != nil {
+		return err
+	}
+	return c.checkLimits(store, keyConfig)
+}
+
+// proxyKeyConfig finds the key for a proxied request, either from a session token in the
+// Proxy-Authorization header or from the Auth-Key header
+func (c *AuthConfig) proxyKeyConfig(store Store, req *http.Request) (*AuthWithLimit, error) {
+	token := proxyToken(req)
+	if token == "" {
+		keyConfig, err := c.keyConfig(store, req.Header.Get(authKeyHeader))
+		if err != nil {
+			return nil, storeUnavailable("Error occured looking up key")
 		}
+		if keyConfig == nil {
+			return nil, &authError{Status: http.StatusForbidden, Message: "Bad Authentication Key"}
+		}
+		return keyConfig, nil
 	}
-	return nil
+
+	sessionID, ok := sessionFromRequest(req)
+	if !ok {
+		return nil, &authError{Status: http.StatusForbidden, Message: "Session tokens can only be used on their session"}
+	}
+	verified, err := c.verifyToken(token, sessionID, time.Now())
+	if err != nil {
+		return nil, &authError{Status: http.StatusForbidden, Message: err.Error()}
+	}
+	if !c.ownsSession(verified) {
+		return nil, &authError{Status: http.StatusForbidden, Message: "Session token is for another session"}
+	}
+
+	// The key may have been revoked since the token was issued
+	keyConfig, err := c.keyByID(store, verified.KeyID)
+	if err != nil {
+		return nil, storeUnavailable("Error occured looking up key")
+	}
+	if keyConfig == nil {
+		return nil, &authError{Status: http.StatusForbidden, Message: "Bad Authentication Key"}
+	}
+	return keyConfig, nil
 }
 
-// AuthLimit is a middleware function to provide simplistic authorization with daily limits
-func AuthLimit(config AuthConfig, redis *Redis) (gin.HandlerFunc, func(req *http.Request) error) {
-	return func(c *gin.Context) {
-			authKey := c.GetHeader(authKeyHeader)
-			keyConfig := config.keyConfig(authKey)
-			if keyConfig == nil {
-				log.Printf("[AUTH-API] Bad Authentication Key")
-				c.AbortWithError(http.StatusForbidden, fmt.Errorf("Bad Authentication Key"))
-				return
+// checkLimits ensures the key is within its usage limit, bandwidth quotas and rate
+// limit, counting the request against the windows usage if it is allowed
+func (c *AuthConfig) checkLimits(store Store, keyConfig *AuthWithLimit) error {
+	loc, err := keyConfig.location()
+	if err != nil {
+		return &authError{Status: http.StatusInternalServerError, Message: "Error occured loading key time zone"}
+	}
+
+	now := time.Now()
+	window := keyConfig.window()
+	buckets := window.buckets(now, loc)
+	currentKey, ttl := c.statKey(keyConfig.ID, buckets[0]), window.ttl(buckets[0], now)
+
+	// TODO : Should we only consider 200's as counting against usage?
+	// The request is counted before the limit is checked so concurrent requests can't all find
+	// room under it, the count is taken back if the request is refused
+	current, err := store.IncrBy(currentKey, 1, ttl)
+	counted := err == nil
+	if err != nil {
+		// Errors are only returned once the stores failure policy has chosen to reject requests
+		if keyConfig.Limit > 0 {
+			return storeUnavailable("Error occured counting key usage")
+		}
+		authLog.Errorf("Error occured counting key usage : %+v", err)
+	}
+	refuse := func(err error) error {
+		if counted {
+			if _, incrErr := store.IncrBy(currentKey, -1, ttl); incrErr != nil {
+				authLog.Errorf("Error occured uncounting refused request : %+v", incrErr)
+			}
+		}
+		return err
+	}
+
+	var usage int64
+	if keyConfig.Limit > 0 {
+		counts := []int64{current}
+		// Only the current bucket is still counted in, the rest of a rolling window can be read
+		if len(buckets) > 1 {
+			keys := make([]string, len(buckets)-1)
+			for i, bucket := range buckets[1:] {
+				keys[i] = c.statKey(keyConfig.ID, bucket)
 			}
+			previous, err := store.GetCounters(keys...)
+			if err != nil {
+				return refuse(storeUnavailable("Error occured reading key usage"))
+			}
+			counts = append(counts, previous...)
+		}
+		if len(counts) == len(buckets) {
+			var resetIn time.Duration
+			usage, resetIn = window.usage(buckets, counts, now)
+			if usage > keyConfig.Limit {
+				return refuse(&authError{Status: http.StatusTooManyRequests, RetryAfter: resetIn, Message: "Usage exceeded"})
+			}
+		}
+	}
+
+	if err := c.checkBandwidth(store, keyConfig, loc, now); err != nil {
+		return refuse(err)
+	}
+
+	if keyConfig.RateLimit > 0 {
+		allowed, retryAfter, err := store.TakeToken(c.rateKey(keyConfig.ID), keyConfig.RateLimit, keyConfig.burst())
+		if err != nil {
+			return refuse(storeUnavailable("Error occured checking key rate limit"))
+		}
+		if !allowed {
+			c.notifyRateLimited(store, keyConfig, retryAfter)
+			return refuse(&authError{Status: http.StatusTooManyRequests, RetryAfter: retryAfter, Message: "Rate limit exceeded"})
+		}
+	}
+
+	if counted && usage > 0 {
+		c.notifyUsage(store, keyConfig, "requests", window, buckets[0], usage-1, usage, keyConfig.Limit)
+	}
+
+	// Every other window is also counted per day so there is history to report on and roll up,
+	// hourly counters expire long before the day they belong to is over
+	if window != DailyWindow {
+		day := DailyWindow.current(now, loc)
+		if _, err := store.IncrBy(c.statKey(keyConfig.ID, day), 1, DailyWindow.ttl(day, now)); err != nil {
+			authLog.Errorf("Error occured counting key usage : %+v", err)
+		}
+	}
+	return nil
+}
+
+// checkBandwidth refuses new requests once either of the keys bandwidth quotas have been used up
+func (c *AuthConfig) checkBandwidth(store Store, keyConfig *AuthWithLimit, loc *time.Location, now time.Time) error {
+	quotas := map[QuotaWindow]int64{
+		DailyWindow:   keyConfig.DailyBytes,
+		MonthlyWindow: keyConfig.MonthlyBytes,
+	}
+	for window, quota := range quotas {
+		if quota <= 0 {
+			continue
+		}
+
+		bucket := window.current(now, loc)
+		counts, err := store.GetCounters(c.bytesKey(keyConfig.ID, bucket))
+		if err != nil {
+			return storeUnavailable("Error occured reading key bandwidth")
+		}
+		if len(counts) == 1 && counts[0] >= quota {
+			return &authError{Status: http.StatusTooManyRequests, RetryAfter: bucket.End.Sub(now), Message: "Bandwidth quota exceeded"}
+		}
+	}
+	return nil
+}
+
+// bandwidthCounter batches up bytes transferred by a request before adding them to the keys
+// daily and monthly counters, asking for the transfer to be aborted once a quota is exceeded
+type bandwidthCounter struct {
+	config    *AuthConfig
+	store     Store
+	keyConfig *AuthWithLimit
+	loc       *time.Location
+
+	pending int64
+	mutex   sync.Mutex
+}
+
+func (b *bandwidthCounter) Add(n int64) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.pending += n
+	if b.pending < bandwidthFlushBytes {
+		return nil
+	}
+	return b.flush()
+}
+
+func (b *bandwidthCounter) Close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.flush()
+}
+
+func (b *bandwidthCounter) flush() error {
+	if b.pending == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	day := DailyWindow.current(now, b.loc)
+	daily, err := b.store.IncrBy(b.config.bytesKey(b.keyConfig.ID, day), b.pending, DailyWindow.ttl(day, now))
+	if err != nil {
+		authProxyLog.Errorf("Error occured counting key bandwidth : %+v", err)
+	}
+	month := MonthlyWindow.current(now, b.loc)
+	monthly, err := b.store.IncrBy(b.config.bytesKey(b.keyConfig.ID, month), b.pending, MonthlyWindow.ttl(month, now))
+	if err != nil {
+		authProxyLog.Errorf("Error occured counting key bandwidth : %+v", err)
+	}
+	b.config.notifyUsage(b.store, b.keyConfig, "daily_bytes", DailyWindow, day, daily-b.pending, daily, b.keyConfig.DailyBytes)
+	b.config.notifyUsage(b.store, b.keyConfig, "monthly_bytes", MonthlyWindow, month, monthly-b.pending, monthly, b.keyConfig.MonthlyBytes)
+	b.pending = 0
+
+	if (b.keyConfig.DailyBytes > 0 && daily > b.keyConfig.DailyBytes) ||
+		(b.keyConfig.MonthlyBytes > 0 && monthly > b.keyConfig.MonthlyBytes) {
+		return &authError{Status: http.StatusTooManyRequests, Message: "Bandwidth quota exceeded"}
+	}
+	return nil
+}
+
+// BandwidthLimit provides a proxy meter counting bytes transferred against each keys bandwidth quotas
+func BandwidthLimit(config AuthConfig, store Store) func(req *http.Request) ByteCounter {
+	return func(req *http.Request) ByteCounter {
+		keyConfig, err := config.proxyKeyConfig(store, req)
+		if err != nil {
+			return nil
+		}
+		loc, err := keyConfig.location()
+		if err != nil {
+			return nil
+		}
+
+		return &bandwidthCounter{
+			config:    &config,
+			store:     store,
+			keyConfig: keyConfig,
+			loc:       loc,
+		}
+	}
+}
 
-			usageBytes, _ := redis.Get(config.statKey(authKey))
-			if len(string(usageBytes)) > 0 {
-				usage, err := strconv.ParseInt(string(usageBytes), 10, 64)
+// AuthLimit is a middleware function to provide simplistic authorization with daily limits,
+// the api handler stores the authorized key in the context for later handlers
+func AuthLimit(config AuthConfig, store Store) (gin.HandlerFunc, func(req *http.Request) error) {
+	return func(c *gin.Context) {
+			if c.GetHeader(forwardedKeyHeader) != "" {
+				keyConfig, err := config.forwardedKey(store, c.Request)
 				if err != nil {
-					log.Printf("[AUTH-API] Error occured getting proper key usage data")
-					c.AbortWithError(http.StatusInternalServerError, fmt.Errorf("Error occured getting proper key usage data"))
+					contextLogger(authAPILog, c).With(Fields{"forwarded_key": c.GetHeader(forwardedKeyHeader)}).Warnf("%s", err)
+					metrics.authRejected("api", err)
+					abortWithAuthError(c, err)
 					return
 				}
+				c.Set(authKeyContext, keyConfig)
+				return
+			}
 
-				// TODO : Should we only consider 200's as counting against usage?
-				if usage >= keyConfig.Limit {
-					redis.Incr(config.statKey(keyConfig.AuthKey))
-				} else {
-					log.Printf("[AUTH-API] Usage exceeded : %s", authKey)
-					c.AbortWithError(http.StatusInternalServerError, fmt.Errorf("Usage exceeded"))
-					return
-				}
+			authKey := c.GetHeader(authKeyHeader)
+			var keyConfig *AuthWithLimit
+			var err error
+			if authKey == "" && config.certificateKeyID(c.Request.TLS) != "" {
+				keyConfig, err = config.authorizeCertificate(store, c.Request)
+				authKey = config.certificateKeyID(c.Request.TLS) + ".<certificate>"
+			} else {
+				keyConfig, err = config.authorize(store, c.Request)
 			}
+			if err != nil {
+				contextLogger(authAPILog, c).With(Fields{"key": authKeyID(authKey)}).Warnf("%s", err)
+				metrics.authRejected("api", err)
+				abortWithAuthError(c, err)
+				return
+			}
+			c.Set(authKeyContext, keyConfig)
 		}, func(req *http.Request) error {
-			authKey := req.Header.Get(authKeyHeader)
-			keyConfig := config.keyConfig(authKey)
-			if keyConfig == nil {
-				// log.Printf("[AUTH-PROXY] Bad Authentication Key : %+v %+v", req, req.Header)
-				return fmt.Errorf("Bad Authentication Key")
+			err := config.checkProxyRequest(store, req)
+			if err != nil {
+				metrics.authRejected("proxy", err)
 			}
+			return err
+		}
+}
 
-			usageBytes, _ := redis.Get(config.statKey(authKey))
-			if len(string(usageBytes)) > 0 {
-				usage, err := strconv.ParseInt(string(usageBytes), 10, 64)
-				if err != nil {
-					// log.Printf("[AUTH-PROXY] Error occured getting proper key usage data")
-					return fmt.Errorf("Error occured getting proper key usage data")
-				}
+// checkProxyRequest authorizes a proxied request, counting it against the keys limits if it is allowed
+func (c *AuthConfig) checkProxyRequest(store Store, req *http.Request) error {
+	keyConfig, err := c.proxyKeyConfig(store, req)
+	if err != nil {
+		return err
+	}
+	if err := c.checkSource(keyConfig, req); err != nil {
+		return err
+	}
+	// Denied destinations are counted separately rather than against the keys limits
+	if err := c.checkDestination(store, keyConfig, req); err != nil {
+		return err
+	}
+	// Requests refused for runaway traffic are not counted against the keys limits
+	if err := c.Anomalies.check(keyConfig, req); err != nil {
+		return err
+	}
+	return c.checkLimits(store, keyConfig)
+}
 
-				// TODO : Should we only consider 200's as counting against usage?
-				if usage >= keyConfig.Limit {
-					redis.Incr(config.statKey(keyConfig.AuthKey))
-				} else {
-					// log.Printf("[AUTH-PROXY] Usage exceeded : %s", authKey)
-					return fmt.Errorf("Usage exceeded")
-				}
-			}
-			return nil
-		}
+// proxyKeyID names the key of a proxied request which has already been authorized, without
+// checking the key again
+func (c *AuthConfig) proxyKeyID(req *http.Request) string {
+	token := proxyToken(req)
+	if token == "" {
+		id, _ := splitAuthKey(req.Header.Get(authKeyHeader))
+		return id
+	}
+	sessionID, _ := sessionFromRequest(req)
+	verified, err := c.verifyToken(token, sessionID, time.Now())
+	if err != nil || !c.ownsSession(verified) {
+		return ""
+	}
+	return verified.KeyID
+}
 
+// authorizedKey returns the key authorized by the AuthLimit middleware, if any
+func authorizedKey(c *gin.Context) *AuthWithLimit {
+	value, ok := c.Get(authKeyContext)
+	if !ok {
+		return nil
+	}
+	keyConfig, _ := value.(*AuthWithLimit)
+	return keyConfig
+}
+
+func abortWithAuthError(c *gin.Context, err error) {
+	authErr, ok := err.(*authError)
+	if !ok {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	if authErr.RetryAfter > 0 {
+		c.Header(retryAfterHeader, authErr.retryAfterSeconds())
+	}
+	c.AbortWithError(authErr.Status, authErr)
 }
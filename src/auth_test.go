@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBurst(t *testing.T) {
+	key := AuthWithLimit{RateLimit: 2.5}
+	if key.burst() != 3 {
+		t.Fatalf("Expected burst to default to %d but got %d", 3, key.burst())
+	}
+
+	key = AuthWithLimit{RateLimit: 0.1}
+	if key.burst() != 1 {
+		t.Fatalf("Expected burst to be at least %d but got %d", 1, key.burst())
+	}
+
+	key = AuthWithLimit{RateLimit: 5, Burst: 20}
+	if key.burst() != 20 {
+		t.Fatalf("Expected burst of %d but got %d", 20, key.burst())
+	}
+}
+
+func TestRetryAfterSeconds(t *testing.T) {
+	err := &authError{RetryAfter: 10 * time.Millisecond}
+	if err.retryAfterSeconds() != "1" {
+		t.Fatalf("Expected Retry-After to round up to 1 but got %s", err.retryAfterSeconds())
+	}
+}
+
+func TestCheckLimits(t *testing.T) {
+	store, _ := NewMemoryStore("")
+	config := AuthConfig{ServiceName: "praxis"}
+
+	keyConfig := &AuthWithLimit{ID: "limited", Limit: 2}
+	for i := 0; i < 2; i++ {
+		if err := config.checkLimits(store, keyConfig); err != nil {
+			t.Fatalf("Unexpected error on request %d : %+v", i, err)
+		}
+	}
+	err, ok := config.checkLimits(store, keyConfig).(*authError)
+	if !ok || err.Status != http.StatusTooManyRequests || err.RetryAfter <= 0 {
+		t.Fatalf("Expected usage to be exceeded with a retry but got %+v", err)
+	}
+
+	// Hourly counters expire within hours, so the day is counted as well for history and rollups
+	keyConfig = &AuthWithLimit{ID: "hourly", Limit: 10, Window: HourlyWindow}
+	config.checkLimits(store, keyConfig)
+	day := DailyWindow.current(time.Now(), time.UTC)
+	if counts, _ := store.GetCounters(config.statKey("hourly", day)); counts[0] != 1 {
+		t.Fatalf("Expected the hourly keys request counted for the day but got %d", counts[0])
+	}
+
+	keyConfig = &AuthWithLimit{ID: "rated", RateLimit: 0.5, Burst: 1}
+	if err := config.checkLimits(store, keyConfig); err != nil {
+		t.Fatalf("Unexpected error on first request : %+v", err)
+	}
+	err, ok = config.checkLimits(store, keyConfig).(*authError)
+	if !ok || err.Status != http.StatusTooManyRequests || err.retryAfterSeconds() != "2" {
+		t.Fatalf("Expected rate limit to be exceeded for 2 seconds but got %+v", err)
+	}
+}
+
+func TestCheckLimitsConcurrent(t *testing.T) {
+	store, _ := NewMemoryStore("")
+	config := AuthConfig{ServiceName: "praxis"}
+	keyConfig := &AuthWithLimit{ID: "limited", Limit: 5}
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	allowed := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := config.checkLimits(store, keyConfig); err == nil {
+				mutex.Lock()
+				allowed++
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Refused requests are taken back out of the count
+	day := DailyWindow.current(time.Now(), time.UTC)
+	counts, _ := store.GetCounters(config.statKey("limited", day))
+	if allowed != 5 || counts[0] != 5 {
+		t.Fatalf("Expected exactly 5 requests allowed and counted but got %d and %d", allowed, counts[0])
+	}
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	apiURLVar = "PRAXIS_API"
+	apiKeyVar = "PRAXIS_KEY"
+
+	defaultCheckURL = "https://api.ipify.org?format=json"
+)
+
+const cliUsage = `Usage: praxis-srv <command> [arguments]
+
+Commands:
+  serve                             run the api and proxies, the default without a command
+  sessions ls                       list the sessions the key can see
+  sessions create [-token] [-token-ttl 30m]
+                                    create a session, optionally with a proxy token
+  sessions rm <id>                  close a session
+  keys add [-limit 1000] [-window daily] [-role client] [-scopes a,b] ...
+                                    create a key, printing its secret once
+  keys ls                           list keys
+  keys revoke <id>                  revoke a key
+  usage [-all] [-csv]               show the usage of the key, or of every key
+  check-upstream [-url url]         check the upstream proxy works using the configuration
+  credentials key|encrypt|decrypt   manage the encrypted credentials file
+
+Commands talking to the api find it through PRAXIS_API (default http://localhost:$SERVE_PORT)
+and authenticate with PRAXIS_KEY (or PRAXIS_KEY_FILE), or the -api and -key flags.
+Listing commands accept -json to print what the api returned.
+`
+
+// cli runs the subcommands of the binary, reading and writing through the given streams
+type cli struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// runCLI runs the command named by `args`, serving when there is none, returning the exit code
+func runCLI(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	c := &cli{stdin: stdin, stdout: stdout, stderr: stderr}
+	if len(args) == 0 {
+		serve()
+		return 0
+	}
+
+	var err error
+	switch args[0] {
+	case "serve":
+		serve()
+	case "sessions":
+		err = c.sessions(args[1:])
+	case "keys":
+		err = c.keys(args[1:])
+	case "usage":
+		err = c.usage(args[1:])
+	case "check-upstream":
+		err = c.checkUpstream(args[1:])
+	case "credentials":
+		err = credentialsCommand(args[1:], stdin, stdout)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, cliUsage)
+	default:
+		fmt.Fprintf(stderr, "Unknown command %s\n\n%s", args[0], cliUsage)
+		return 2
+	}
+
+	if err == flag.ErrHelp {
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "%+v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// apiClient makes authenticated requests to the management api
+type apiClient struct {
+	URL string
+	Key string
+
+	client *http.Client
+}
+
+// flags creates a flag set for a subcommand which talks to the api, defaulting the
+// address and key from the environment
+func (c *cli) flags(name string) (*flag.FlagSet, *apiClient) {
+	api := &apiClient{client: &http.Client{Timeout: 30 * time.Second}}
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(c.stderr)
+
+	defaultURL := os.Getenv(apiURLVar)
+	if defaultURL == "" {
+		port := os.Getenv("SERVE_PORT")
+		if port == "" {
+			port = "3000"
+		}
+		defaultURL = "http://localhost:" + port
+	}
+	// A missing key file is reported by the api refusing the request
+	defaultKey, _ := secretEnv(apiKeyVar)
+
+	flags.StringVar(&api.URL, "api", defaultURL, "address of the management api")
+	flags.StringVar(&api.Key, "key", defaultKey, "key to authenticate with")
+	return flags, api
+}
+
+// do sends a request to the api, returning the body of a successful response
+func (a *apiClient) do(method, path string, body interface{}) ([]byte, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, strings.TrimSuffix(a.URL, "/")+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if a.Key != "" {
+		req.Header.Set(authKeyHeader, a.Key)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to reach the api : %+v", err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		message := strings.TrimSpace(string(data))
+		if message == "" {
+			message = http.StatusText(resp.StatusCode)
+		}
+		return nil, fmt.Errorf("%s %s failed with %d : %s", method, path, resp.StatusCode, message)
+	}
+	return data, nil
+}
+
+// call sends a request to the api, decoding the response into `out`
+func (a *apiClient) call(method, path string, body, out interface{}) error {
+	data, err := a.do(method, path, body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("Unable to parse response from %s : %+v", path, err)
+	}
+	return nil
+}
+
+// print writes the raw response as indented json, or a table of `rows` under `header`
+func (c *cli) print(asJSON bool, data interface{}, header string, rows [][]string) error {
+	if asJSON {
+		encoder := json.NewEncoder(c.stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(data)
+	}
+
+	writer := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, header)
+	for _, row := range rows {
+		fmt.Fprintln(writer, strings.Join(row, "\t"))
+	}
+	return writer.Flush()
+}
+
+func subcommand(args []string, usage string) (string, []string, error) {
+	if len(args) == 0 {
+		return "", nil, fmt.Errorf("Usage : %s", usage)
+	}
+	return args[0], args[1:], nil
+}
+
+// listedSession is a session as listed by GET /sessions
+type listedSession struct {
+	Session  int    `json:"session"`
+	Status   string `json:"status"`
+	Owner    string `json:"owner"`
+	Instance string `json:"instance,omitempty"`
+	Host     string `json:"host,omitempty"`
+}
+
+// createdSession is the response of POST /create
+type createdSession struct {
+	Session      int        `json:"session"`
+	Port         int        `json:"port"`
+	Instance     string     `json:"instance,omitempty"`
+	Host         string     `json:"host,omitempty"`
+	Token        string     `json:"token,omitempty"`
+	TokenExpires *time.Time `json:"token_expires,omitempty"`
+}
+
+func (c *cli) sessions(args []string) error {
+	command, args, err := subcommand(args, "sessions ls|create|rm")
+	if err != nil {
+		return err
+	}
+	flags, api := c.flags("sessions " + command)
+	asJSON := flags.Bool("json", false, "print the api response as json")
+
+	switch command {
+	case "ls":
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		sessions := []listedSession{}
+		if err := api.call(http.MethodGet, "/sessions", nil, &sessions); err != nil {
+			return err
+		}
+		rows := [][]string{}
+		for _, session := range sessions {
+			rows = append(rows, []string{strconv.Itoa(session.Session), session.Status, session.Owner, session.Instance, session.Host})
+		}
+		return c.print(*asJSON, sessions, "SESSION\tADDRESS\tOWNER\tINSTANCE\tHOST", rows)
+
+	case "create":
+		token := flags.Bool("token", false, "also create a proxy token for the session")
+		tokenTTL := flags.String("token-ttl", "", "how long the token lasts, such as 30m")
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		query := url.Values{}
+		if *token {
+			query.Set("token", "true")
+		}
+		if *tokenTTL != "" {
+			query.Set("token_ttl", *tokenTTL)
+		}
+		path := "/create"
+		if len(query) > 0 {
+			path += "?" + query.Encode()
+		}
+
+		created := createdSession{}
+		if err := api.call(http.MethodPost, path, nil, &created); err != nil {
+			return err
+		}
+		row := []string{strconv.Itoa(created.Session), strconv.Itoa(created.Port), created.Host, created.Token}
+		return c.print(*asJSON, created, "SESSION\tPORT\tHOST\tTOKEN", [][]string{row})
+
+	case "rm":
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		if flags.NArg() != 1 {
+			return fmt.Errorf("Usage : sessions rm <id>")
+		}
+		id, err := strconv.Atoi(flags.Arg(0))
+		if err != nil {
+			return fmt.Errorf("Session id must be a number, got %s", flags.Arg(0))
+		}
+		result := map[string]interface{}{}
+		if err := api.call(http.MethodDelete, fmt.Sprintf("/session/%d", id), nil, &result); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.stdout, "session %d %v\n", id, result["status"])
+		return nil
+	}
+	return fmt.Errorf("Unknown sessions command %s, expected ls, create or rm", command)
+}
+
+func (c *cli) keys(args []string) error {
+	command, args, err := subcommand(args, "keys add|ls|revoke")
+	if err != nil {
+		return err
+	}
+	flags, api := c.flags("keys " + command)
+	asJSON := flags.Bool("json", false, "print the api response as json")
+
+	switch command {
+	case "add":
+		keyConfig := AuthWithLimit{}
+		window := flags.String("window", "", "window the limit applies to, hourly, daily, weekly, monthly or rolling24h")
+		role := flags.String("role", "", "role of the key, client, operator or admin")
+		scopes := flags.String("scopes", "", "comma separated scopes granted to the key")
+		cidrs := flags.String("allowed-cidrs", "", "comma separated networks the key can be used from")
+		flags.Int64Var(&keyConfig.Limit, "limit", 0, "requests allowed per window, zero is unlimited")
+		flags.StringVar(&keyConfig.TimeZone, "time-zone", "", "time zone the windows reset in")
+		flags.Float64Var(&keyConfig.RateLimit, "rate-limit", 0, "requests allowed per second")
+		flags.Int64Var(&keyConfig.Burst, "burst", 0, "requests allowed at once")
+		flags.Int64Var(&keyConfig.DailyBytes, "daily-bytes", 0, "bytes allowed per day")
+		flags.Int64Var(&keyConfig.MonthlyBytes, "monthly-bytes", 0, "bytes allowed per month")
+		flags.StringVar(&keyConfig.WebhookURL, "webhook-url", "", "url notified of the keys quota events")
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		keyConfig.Window = QuotaWindow(*window)
+		keyConfig.Role = Role(*role)
+		for _, scope := range splitList(*scopes) {
+			keyConfig.Scopes = append(keyConfig.Scopes, Scope(scope))
+		}
+		keyConfig.AllowedCIDRs = splitList(*cidrs)
+
+		created := map[string]string{}
+		if err := api.call(http.MethodPost, "/admin/keys", keyConfig, &created); err != nil {
+			return err
+		}
+		if *asJSON {
+			return c.print(true, created, "", nil)
+		}
+		fmt.Fprintf(c.stdout, "Created key %s, the key is only shown once :\n%s\n", created["id"], created["key"])
+		return nil
+
+	case "ls":
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		keys := []AuthWithLimit{}
+		if err := api.call(http.MethodGet, "/admin/keys", nil, &keys); err != nil {
+			return err
+		}
+		rows := [][]string{}
+		for _, keyConfig := range keys {
+			scopes := []string{}
+			for _, scope := range keyConfig.Scopes {
+				scopes = append(scopes, string(scope))
+			}
+			rows = append(rows, []string{
+				keyConfig.ID,
+				string(keyConfig.Role),
+				strings.Join(scopes, ","),
+				strconv.FormatInt(keyConfig.Limit, 10),
+				string(keyConfig.window()),
+				strconv.FormatFloat(keyConfig.RateLimit, 'f', -1, 64),
+			})
+		}
+		return c.print(*asJSON, keys, "ID\tROLE\tSCOPES\tLIMIT\tWINDOW\tRATE", rows)
+
+	case "revoke":
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		if flags.NArg() != 1 {
+			return fmt.Errorf("Usage : keys revoke <id>")
+		}
+		result := map[string]string{}
+		if err := api.call(http.MethodDelete, "/admin/keys/"+url.PathEscape(flags.Arg(0)), nil, &result); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.stdout, "key %s %s\n", flags.Arg(0), result["status"])
+		return nil
+	}
+	return fmt.Errorf("Unknown keys command %s, expected add, ls or revoke", command)
+}
+
+func (c *cli) usage(args []string) error {
+	flags, api := c.flags("usage")
+	all := flags.Bool("all", false, "show the usage of every key")
+	asCSV := flags.Bool("csv", false, "print the daily history as csv")
+	asJSON := flags.Bool("json", false, "print the api response as json")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	path := "/usage"
+	if *all {
+		path = "/admin/usage"
+	}
+	if *asCSV {
+		data, err := api.do(http.MethodGet, path+"?format=csv", nil)
+		if err != nil {
+			return err
+		}
+		_, err = c.stdout.Write(data)
+		return err
+	}
+
+	data, err := api.do(http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	reports := []UsageReport{}
+	if *all {
+		err = json.Unmarshal(data, &reports)
+	} else {
+		report := UsageReport{}
+		err = json.Unmarshal(data, &report)
+		reports = append(reports, report)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to parse response from %s : %+v", path, err)
+	}
+
+	rows := [][]string{}
+	for _, report := range reports {
+		rows = append(rows, []string{report.Key, report.Requests.String(), report.DailyBytes.String(), report.MonthlyBytes.String()})
+	}
+	if *all {
+		return c.print(*asJSON, reports, "KEY\tREQUESTS\tDAILY BYTES\tMONTHLY BYTES", rows)
+	}
+	return c.print(*asJSON, reports[0], "KEY\tREQUESTS\tDAILY BYTES\tMONTHLY BYTES", rows)
+}
+
+// String describes the usage as used out of the limit, in the window and period it applies to
+func (u UsageCurrent) String() string {
+	limit := "unlimited"
+	if u.Limit > 0 {
+		limit = strconv.FormatInt(u.Limit, 10)
+	}
+	return fmt.Sprintf("%d/%s (%s %s)", u.Used, limit, u.Window, u.Period)
+}
+
+// checkUpstream sends a request through the configured upstream proxy, without a session
+func (c *cli) checkUpstream(args []string) error {
+	flags := flag.NewFlagSet("check-upstream", flag.ContinueOnError)
+	flags.SetOutput(c.stderr)
+	target := flags.String("url", defaultCheckURL, "url to request through the upstream")
+	timeout := flags.Duration("timeout", 15*time.Second, "how long to wait for a response")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	config, err := loadConfig(os.Getenv(configVar))
+	if err != nil {
+		return err
+	}
+	proxyURL, err := url.Parse(config.Upstream.URL)
+	if err != nil {
+		return err
+	}
+	username := appendSessionIfAllowed(config.Upstream.URL, config.Upstream.Username, rand.Intn(1000))
+	proxyURL.User = url.UserPassword(username, config.Upstream.Password)
+
+	client := &http.Client{
+		Timeout:   *timeout,
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+	}
+	started := time.Now()
+	resp, err := client.Get(*target)
+	if err != nil {
+		return fmt.Errorf("Upstream %s failed : %+v", config.Upstream.URL, err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Upstream %s responded with %d in %s : %s", config.Upstream.URL, resp.StatusCode, time.Since(started).Round(time.Millisecond), strings.TrimSpace(string(body)))
+	}
+	fmt.Fprintf(c.stdout, "Upstream %s is working, %s responded in %s : %s\n", config.Upstream.URL, *target, time.Since(started).Round(time.Millisecond), strings.TrimSpace(string(body)))
+	return nil
+}
+
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func testAPI(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(authKeyHeader) != "testing.testingapikey" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"Unauthorized"}`))
+			return
+		}
+		switch r.Method + " " + r.URL.Path {
+		case "GET /sessions":
+			w.Write([]byte(`[{"session":3001,"status":"127.0.0.1:3001","owner":"testing"},{"session":3002,"status":"127.0.0.1:3002","owner":"other"}]`))
+		case "POST /create":
+			if r.URL.Query().Get("token") != "true" || r.URL.Query().Get("token_ttl") != "30m" {
+				t.Errorf("Expected token flags to be sent but got %s", r.URL.RawQuery)
+			}
+			w.Write([]byte(`{"session":3003,"port":3003,"token":"signed"}`))
+		case "DELETE /session/3001":
+			w.Write([]byte(`{"status":"deleted"}`))
+		case "POST /admin/keys":
+			keyConfig := AuthWithLimit{}
+			json.NewDecoder(r.Body).Decode(&keyConfig)
+			if keyConfig.Limit != 1000 || keyConfig.Window != HourlyWindow || len(keyConfig.Scopes) != 2 {
+				t.Errorf("Expected key flags to be sent but got %+v", keyConfig)
+			}
+			w.Write([]byte(`{"id":"crawler","key":"crawler.secret"}`))
+		case "GET /usage":
+			if r.URL.Query().Get("format") == "csv" {
+				w.Write([]byte("key,date,requests,bytes,denied\ntesting,2020-01-01,5,10,0\n"))
+				return
+			}
+			w.Write([]byte(`{"key":"testing","requests":{"window":"daily","period":"2020-01-01","used":5,"limit":100}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func runTestCLI(args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := runCLI(args, strings.NewReader(""), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestCLISessions(t *testing.T) {
+	server := testAPI(t)
+	defer server.Close()
+	defer setTestEnv(map[string]string{apiURLVar: server.URL, apiKeyVar: "testing.testingapikey"})()
+
+	code, out, errOut := runTestCLI("sessions", "ls")
+	if code != 0 || !strings.Contains(out, "3001") || !strings.Contains(out, "other") || !strings.HasPrefix(out, "SESSION") {
+		t.Fatalf("Expected a table of sessions but got %d %q %q", code, out, errOut)
+	}
+
+	code, out, errOut = runTestCLI("sessions", "create", "-token", "-token-ttl", "30m", "-json")
+	created := createdSession{}
+	if err := json.Unmarshal([]byte(out), &created); code != 0 || err != nil || created.Session != 3003 || created.Token != "signed" {
+		t.Fatalf("Expected the created session as json but got %d %q %q", code, out, errOut)
+	}
+
+	if code, out, _ := runTestCLI("sessions", "rm", "3001"); code != 0 || out != "session 3001 deleted\n" {
+		t.Fatalf("Expected session to be removed but got %d %q", code, out)
+	}
+	if code, _, errOut := runTestCLI("sessions", "rm", "lots"); code != 1 || !strings.Contains(errOut, "must be a number") {
+		t.Fatalf("Expected a bad id to fail but got %d %q", code, errOut)
+	}
+}
+
+func TestCLIKeysAndUsage(t *testing.T) {
+	server := testAPI(t)
+	defer server.Close()
+	defer setTestEnv(map[string]string{apiURLVar: server.URL, apiKeyVar: "testing.testingapikey"})()
+
+	code, out, errOut := runTestCLI("keys", "add", "-limit", "1000", "-window", "hourly", "-scopes", "sessions:create, usage:read")
+	if code != 0 || !strings.Contains(out, "crawler.secret") {
+		t.Fatalf("Expected the new key to be printed but got %d %q %q", code, out, errOut)
+	}
+
+	code, out, _ = runTestCLI("usage")
+	if code != 0 || !strings.Contains(out, "5/100 (daily 2020-01-01)") {
+		t.Fatalf("Expected usage to be summarised but got %d %q", code, out)
+	}
+	code, out, _ = runTestCLI("usage", "-csv")
+	if code != 0 || !strings.HasPrefix(out, "key,date,requests") {
+		t.Fatalf("Expected usage as csv but got %d %q", code, out)
+	}
+}
+
+func TestCLIErrors(t *testing.T) {
+	server := testAPI(t)
+	defer server.Close()
+
+	code, _, errOut := runTestCLI("sessions", "ls", "-api", server.URL, "-key", "wrong.key")
+	if code != 1 || !strings.Contains(errOut, "401") {
+		t.Fatalf("Expected a refused request to fail but got %d %q", code, errOut)
+	}
+	if code, _, errOut := runTestCLI("launch"); code != 2 || !strings.Contains(errOut, "Unknown command launch") {
+		t.Fatalf("Expected an unknown command to print usage but got %d %q", code, errOut)
+	}
+	if code, _, _ := runTestCLI("keys", "ls", "-unknown"); code == 0 {
+		t.Fatalf("Expected an unknown flag to fail but got %d", code)
+	}
+}
+
+func TestCLICheckUpstream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(proxyAuthHeader) != "Basic "+basicAuth("customer", "secret") {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		w.Write([]byte(`{"ip":"203.0.113.7"}`))
+	}))
+	defer upstream.Close()
+
+	env := map[string]string{
+		"SERVE_PORT":     "8080",
+		"PRAXIS_LOWER":   "3000",
+		"PRAXIS_UPPER":   "3010",
+		"PROXY_URL":      upstream.URL,
+		"PROXY_USERNAME": "customer",
+		"PROXY_PASSWORD": "secret",
+	}
+	restore := setTestEnv(env)
+	defer restore()
+
+	code, out, errOut := runTestCLI("check-upstream", "-url", "http://example.com/ip")
+	if code != 0 || !strings.Contains(out, "203.0.113.7") {
+		t.Fatalf("Expected the upstream to work but got %d %q %q", code, out, errOut)
+	}
+
+	setTestEnv(map[string]string{"PROXY_PASSWORD": "wrong"})
+	code, _, errOut = runTestCLI("check-upstream", "-url", "http://example.com/ip")
+	if code != 1 || !strings.Contains(errOut, "407") {
+		t.Fatalf("Expected bad credentials to fail but got %d %q", code, errOut)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	instanceURLVar  = "INSTANCE_URL"
+	instanceHostVar = "INSTANCE_HOST"
+
+	instanceHeartbeat = 10 * time.Second
+	instanceTTL       = 30 // seconds without a heartbeat before an instance is gone
+
+	forwardedKeyHeader       = "Praxis-Forwarded-Key"
+	forwardedExpiresHeader   = "Praxis-Forwarded-Expires"
+	forwardedSignatureHeader = "Praxis-Forwarded-Signature"
+	forwardTTL               = 30 * time.Second
+)
+
+// Instance is a running Praxis replica, registered so others can find and forward to it
+type Instance struct {
+	ID      string    `json:"id"`
+	URL     string    `json:"url"`
+	Host    string    `json:"host"`
+	Started time.Time `json:"started"`
+}
+
+// SessionRecord is the shared record of a session, naming the instance which owns it
+type SessionRecord struct {
+	Session  int       `json:"session"`
+	Instance string    `json:"instance"`
+	Host     string    `json:"host"`
+	Port     int       `json:"port"`
+	Addr     string    `json:"addr"`
+	Owner    string    `json:"owner"`
+	Created  time.Time `json:"created"`
+}
+
+// Cluster coordinates sessions between replicas sharing a store
+type Cluster struct {
+	store    Store
+	auth     *AuthConfig
+	instance Instance
+	client   *http.Client
+}
+
+// loadCluster joins the cluster when INSTANCE_URL is set, returning nil otherwise
+func loadCluster(store Store, auth *AuthConfig) *Cluster {
+	instanceURL := os.Getenv(instanceURLVar)
+	if instanceURL == "" {
+		return nil
+	}
+	if store == nil {
+		panic(fmt.Sprintf("Failed to join cluster : %s needs a store", instanceURLVar))
+	}
+
+	host := os.Getenv(instanceHostVar)
+	if host == "" {
+		host, _ = os.Hostname()
+	}
+	id, err := randomHex(keyIDBytes)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to join cluster : %+v", err))
+	}
+
+	cluster := &Cluster{
+		store: store,
+		auth:  auth,
+		instance: Instance{
+			ID:      id,
+			URL:     strings.TrimSuffix(instanceURL, "/"),
+			Host:    host,
+			Started: time.Now(),
+		},
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	if err := cluster.register(); err != nil {
+		panic(fmt.Sprintf("Failed to join cluster : %+v", err))
+	}
+	go cluster.heartbeat()
+	clusterLog.Infof("Registered as instance %s at %s", id, cluster.instance.URL)
+	return cluster
+}
+
+func (c *Cluster) instanceKey(id string) string {
+	return fmt.Sprintf("instances:%s:%s", c.auth.ServiceName, id)
+}
+
+func (c *Cluster) sessionKey(id int) string {
+	return fmt.Sprintf("sessions:%s:%d", c.auth.ServiceName, id)
+}
+
+func (c *Cluster) register() error {
+	data, _ := json.Marshal(c.instance)
+	return c.store.SetEx(c.instanceKey(c.instance.ID), data, instanceTTL)
+}
+
+func (c *Cluster) heartbeat() {
+	for {
+		time.Sleep(instanceHeartbeat)
+		if err := c.register(); err != nil {
+			clusterLog.Errorf("Error occured refreshing instance registration : %+v", err)
+		}
+	}
+}
+
+// nextSessionID allocates a session id unique across all instances. Ids always come from the
+// shared store, as ids counted locally while it is degraded would collide with other instances,
+// and the counter never expires so ids are never handed out twice
+func (c *Cluster) nextSessionID() (int, error) {
+	store := c.store
+	if failover, ok := store.(*failoverStore); ok {
+		store = failover.Store
+	}
+	id, err := store.IncrBy(fmt.Sprintf("sessions:%s:next", c.auth.ServiceName), 1, 0)
+	if err != nil {
+		return -1, &sessionIDError{err: err}
+	}
+	return int(id), nil
+}
+
+// sessionIDError is returned when session ids can't be allocated, such as when the store is down
+type sessionIDError struct {
+	err error
+}
+
+func (e *sessionIDError) Error() string {
+	return fmt.Sprintf("Unable to allocate a session id : %+v", e.err)
+}
+
+func (c *Cluster) addSession(record SessionRecord) error {
+	record.Instance = c.instance.ID
+	record.Host = c.instance.Host
+	data, _ := json.Marshal(record)
+	return c.store.Set(c.sessionKey(record.Session), data)
+}
+
+func (c *Cluster) removeSession(id int) error {
+	return c.store.Delete(c.sessionKey(id))
+}
+
+// session finds the record of a session and its instance, cleaning up records left behind
+// by instances which have since gone away
+func (c *Cluster) session(id int) (*SessionRecord, *Instance) {
+	data, err := c.store.Get(c.sessionKey(id))
+	if err != nil {
+		return nil, nil
+	}
+	record := &SessionRecord{}
+	if err := json.Unmarshal(data, record); err != nil {
+		clusterLog.Warnf("Unable to parse session record %d : %+v", id, err)
+		return nil, nil
+	}
+
+	data, err = c.store.Get(c.instanceKey(record.Instance))
+	if err != nil {
+		clusterLog.Warnf("Removing session %d of instance %s which is gone", id, record.Instance)
+		c.removeSession(id)
+		return nil, nil
+	}
+	instance := &Instance{}
+	if err := json.Unmarshal(data, instance); err != nil {
+		clusterLog.Warnf("Unable to parse instance %s : %+v", record.Instance, err)
+		return nil, nil
+	}
+	return record, instance
+}
+
+// sessions returns the records of every session in the cluster, oldest first
+func (c *Cluster) sessions() ([]SessionRecord, error) {
+	prefix := fmt.Sprintf("sessions:%s:", c.auth.ServiceName)
+	keys, err := c.store.GetKeys(escapePattern(prefix) + "*")
+	if err != nil {
+		return nil, err
+	}
+
+	records := []SessionRecord{}
+	for _, key := range keys {
+		// The session id counter shares the prefix
+		id, err := strconv.Atoi(strings.TrimPrefix(key, prefix))
+		if err != nil {
+			continue
+		}
+		if record, _ := c.session(id); record != nil {
+			records = append(records, *record)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Created.Before(records[j].Created)
+	})
+	return records, nil
+}
+
+// instances returns every instance which is still heartbeating
+func (c *Cluster) instances() ([]Instance, error) {
+	keys, err := c.store.GetKeys(escapePattern(c.instanceKey("")) + "*")
+	if err != nil {
+		return nil, err
+	}
+
+	instances := []Instance{}
+	for _, key := range keys {
+		data, err := c.store.Get(key)
+		if err != nil {
+			continue
+		}
+		instance := Instance{}
+		if err := json.Unmarshal(data, &instance); err != nil {
+			clusterLog.Warnf("Unable to parse instance %s : %+v", key, err)
+			continue
+		}
+		instances = append(instances, instance)
+	}
+	return instances, nil
+}
+
+// searchHistory runs a search of the request history on every other instance on behalf of
+// `keyID`, leaving out those which can't be reached
+func (c *Cluster) searchHistory(query url.Values, keyID string) []*accessEntry {
+	instances, err := c.instances()
+	if err != nil {
+		clusterLog.Errorf("Error occured listing instances : %+v", err)
+		return nil
+	}
+
+	// The other instances only search their own history
+	local := url.Values{}
+	for name, values := range query {
+		local[name] = values
+	}
+	local.Set("local", "true")
+
+	found := []*accessEntry{}
+	for i := range instances {
+		instance := &instances[i]
+		if instance.ID == c.instance.ID {
+			continue
+		}
+		resp, err := c.forward(instance, http.MethodGet, "/requests?"+local.Encode(), keyID)
+		if err != nil {
+			clusterLog.Warnf("Unable to search the request history of instance %s : %+v", instance.ID, err)
+			continue
+		}
+		entries := []*accessEntry{}
+		err = json.NewDecoder(resp.Body).Decode(&entries)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			clusterLog.Warnf("Unable to search the request history of instance %s : %d %+v", instance.ID, resp.StatusCode, err)
+			continue
+		}
+		found = append(found, entries...)
+	}
+	return found
+}
+
+// forwardDelete asks the instance owning a session to close it on behalf of `keyID`
+func (c *Cluster) forwardDelete(instance *Instance, id int, keyID string) (*http.Response, error) {
+	return c.forward(instance, http.MethodDelete, fmt.Sprintf("/session/%d", id), keyID)
+}
+
+// forward sends a request for `path`, including any query, to another instance on behalf of `keyID`
+func (c *Cluster) forward(instance *Instance, method, path, keyID string) (*http.Response, error) {
+	req, err := http.NewRequest(method, instance.URL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	expires := time.Now().Add(forwardTTL).Unix()
+	req.Header.Set(forwardedKeyHeader, keyID)
+	req.Header.Set(forwardedExpiresHeader, strconv.FormatInt(expires, 10))
+	req.Header.Set(forwardedSignatureHeader, c.auth.sign(forwardPayload(method, path, keyID, expires)))
+	return c.client.Do(req)
+}
+
+func forwardPayload(method, path, keyID string, expires int64) string {
+	return fmt.Sprintf("%s\n%s\n%s\n%d", method, path, keyID, expires)
+}
+
+// forwardedKey returns the key a request was forwarded from another instance on behalf of,
+// the request was already counted against the keys limits by the instance which received it
+func (c *AuthConfig) forwardedKey(store Store, req *http.Request) (*AuthWithLimit, error) {
+	keyID := req.Header.Get(forwardedKeyHeader)
+	expires, err := strconv.ParseInt(req.Header.Get(forwardedExpiresHeader), 10, 64)
+	if err != nil || time.Now().Unix() >= expires {
+		return nil, &authError{Status: http.StatusForbidden, Message: "Forwarded request expired"}
+	}
+
+	signature := req.Header.Get(forwardedSignatureHeader)
+	if len(c.TokenSecret) == 0 || !hmac.Equal([]byte(c.sign(forwardPayload(req.Method, req.URL.RequestURI(), keyID, expires))), []byte(signature)) {
+		return nil, &authError{Status: http.StatusForbidden, Message: "Bad forwarded request signature"}
+	}
+
+	keyConfig, err := c.keyByID(store, keyID)
+	if err != nil {
+		return nil, storeUnavailable("Error occured looking up key")
+	}
+	if keyConfig == nil {
+		return nil, &authError{Status: http.StatusForbidden, Message: "Bad Authentication Key"}
+	}
+	return keyConfig, nil
+}
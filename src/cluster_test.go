@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestCluster(store Store, auth *AuthConfig, id string) *Cluster {
+	cluster := &Cluster{
+		store:    store,
+		auth:     auth,
+		instance: Instance{ID: id, URL: "http://" + id, Host: id, Started: time.Now()},
+		client:   http.DefaultClient,
+	}
+	cluster.register()
+	return cluster
+}
+
+func TestClusterSessions(t *testing.T) {
+	store, _ := NewMemoryStore("")
+	auth := &AuthConfig{ServiceName: "praxis"}
+	first := newTestCluster(store, auth, "first")
+	second := newTestCluster(store, auth, "second")
+
+	firstID, _ := first.nextSessionID()
+	secondID, _ := second.nextSessionID()
+	if firstID == secondID {
+		t.Fatalf("Expected unique session ids across instances but got %d twice", firstID)
+	}
+
+	first.addSession(SessionRecord{Session: firstID, Port: 3001, Addr: "0.0.0.0:3001", Owner: "testing"})
+	record, instance := second.session(firstID)
+	if record == nil || instance.ID != "first" || record.Host != "first" || record.Owner != "testing" {
+		t.Fatalf("Expected session owned by the first instance but got %+v on %+v", record, instance)
+	}
+
+	// Sessions of instances which stopped heartbeating are cleaned up
+	store.Delete(first.instanceKey("first"))
+	if record, _ := second.session(firstID); record != nil {
+		t.Fatalf("Expected session of a gone instance to be removed but got %+v", record)
+	}
+	if exists, _ := store.Exists(first.sessionKey(firstID)); exists {
+		t.Fatalf("Expected stale session record to be deleted")
+	}
+}
+
+func TestClusterForwardDelete(t *testing.T) {
+	store, _ := NewMemoryStore("")
+	auth := &AuthConfig{
+		ServiceName: "praxis",
+		TokenSecret: []byte("not a real secret"),
+		AuthKeys:    []AuthWithLimit{AuthWithLimit{ID: "testing"}},
+	}
+
+	var forwarded *AuthWithLimit
+	var forwardErr error
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		forwarded, forwardErr = auth.forwardedKey(store, req)
+	}))
+	defer server.Close()
+
+	cluster := newTestCluster(store, auth, "first")
+	resp, err := cluster.forwardDelete(&Instance{ID: "second", URL: server.URL}, 42, "testing")
+	if err != nil {
+		t.Fatalf("Unexpected error forwarding : %+v", err)
+	}
+	resp.Body.Close()
+	if forwardErr != nil || forwarded == nil || forwarded.ID != "testing" {
+		t.Fatalf("Expected forwarded request for key %s but got %+v : %+v", "testing", forwarded, forwardErr)
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/session/43", nil)
+	req.Header.Set(forwardedKeyHeader, "testing")
+	req.Header.Set(forwardedExpiresHeader, "9999999999")
+	req.Header.Set(forwardedSignatureHeader, auth.sign(forwardPayload(http.MethodDelete, "/session/42", "testing", 9999999999)))
+	if _, err := auth.forwardedKey(store, req); err == nil {
+		t.Fatalf("Expected signature for another session to be rejected")
+	}
+
+	// The query is signed along with the path
+	signed := func(target, payload string) error {
+		req := httptest.NewRequest(http.MethodPost, target, nil)
+		req.Header.Set(forwardedKeyHeader, "testing")
+		req.Header.Set(forwardedExpiresHeader, "9999999999")
+		req.Header.Set(forwardedSignatureHeader, auth.sign(forwardPayload(http.MethodPost, payload, "testing", 9999999999)))
+		_, err := auth.forwardedKey(store, req)
+		return err
+	}
+	if err := signed("/session/42/debug?duration=15m", "/session/42/debug?duration=15m"); err != nil {
+		t.Fatalf("Expected the signed query to be accepted but got %+v", err)
+	}
+	if err := signed("/session/42/debug?duration=1h", "/session/42/debug"); err == nil {
+		t.Fatalf("Expected a signature without the query to be rejected")
+	}
+	if err := signed("/session/42/debug?duration=1h", "/session/42/debug?duration=15m"); err == nil {
+		t.Fatalf("Expected a changed query to be rejected")
+	}
+}
+
+func TestClusterSessionIDsSkipFailover(t *testing.T) {
+	flaky := newFlakyStore()
+	flaky.down = false
+	auth := &AuthConfig{ServiceName: "praxis"}
+	cluster := newTestCluster(newFailoverStore(flaky, LocalOnFailure), auth, "first")
+
+	first, err := cluster.nextSessionID()
+	if err != nil || first != 1 {
+		t.Fatalf("Expected the first session id but got %d : %+v", first, err)
+	}
+	if exists, _ := flaky.Exists("sessions:praxis:next"); !exists {
+		t.Fatalf("Expected the counter in the shared store")
+	}
+	if entry := flaky.entries["sessions:praxis:next"]; !entry.Expires.IsZero() {
+		t.Fatalf("Expected the session id counter never to expire but it expires at %s", entry.Expires)
+	}
+
+	// Ids counted locally while degraded would collide with other instances
+	flaky.down = true
+	if id, err := cluster.nextSessionID(); err == nil {
+		t.Fatalf("Expected allocating an id to fail while the store is down but got %d", id)
+	} else if _, ok := err.(*sessionIDError); !ok {
+		t.Fatalf("Expected a session id error but got %+v", err)
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	configVar = "PRAXIS_CONFIG"
+)
+
+// Config describes how Praxis is run. It is read from the yaml file named by PRAXIS_CONFIG,
+// with any of the original environment variables overriding the file
+type Config struct {
+	Listen   ListenConfig   `yaml:"listen"`
+	Ports    PortsConfig    `yaml:"ports"`
+	Upstream UpstreamConfig `yaml:"upstream"`
+	Auth     AuthFileConfig `yaml:"auth"`
+	Logging  LoggingConfig  `yaml:"logging"`
+	// AccessLog is reopened on reload, picking up any change to it
+	AccessLog AccessLogConfig `yaml:"access_log"`
+
+	// credentials are those decrypted from PRAXIS_CREDENTIALS, kept so the store can use them
+	credentials *Credentials
+}
+
+// ListenConfig is where the management api is served
+type ListenConfig struct {
+	Port int          `yaml:"port"`
+	TLS  APITLSConfig `yaml:"tls"`
+}
+
+// PortsConfig is the range of local ports handed out to sessions
+type PortsConfig struct {
+	Lower int `yaml:"lower"`
+	Upper int `yaml:"upper"`
+}
+
+// UpstreamConfig is the end proxy sessions send their traffic through
+type UpstreamConfig struct {
+	URL      string `yaml:"url"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// AuthFileConfig enables auth and lists the keys along with their limits
+type AuthFileConfig struct {
+	Enabled bool            `yaml:"enabled"`
+	Keys    []AuthWithLimit `yaml:"keys"`
+}
+
+// LoggingConfig controls what is logged
+type LoggingConfig struct {
+	// Debug logs everything passing through new sessions, as PROXY_MODE=debug does
+	Debug bool `yaml:"debug"`
+	// Level is the least severe level logged, defaulting to debug with Debug set or info otherwise
+	Level string `yaml:"level"`
+	// Format is either json, the default, or text
+	Format string `yaml:"format"`
+}
+
+// AccessLogConfig controls the access log of proxied requests
+type AccessLogConfig struct {
+	// Path is where the access log is written, it is disabled when empty
+	Path string `yaml:"path"`
+	// Format is squid, the default, combined or jsonl
+	Format string `yaml:"format"`
+	// MaxSize is how many megabytes the access log grows to before it is rotated, defaulting to 100
+	MaxSize int `yaml:"max_size"`
+	// MaxBackups is how many rotated access logs are kept, defaulting to 5
+	MaxBackups int `yaml:"max_backups"`
+}
+
+// defaultAuthKeys are used when the configuration does not list any keys. Their secret is
+// published, so they are only clients and can't manage keys or see other keys usage
+var defaultAuthKeys = []AuthWithLimit{
+	// Presented as "testing.testingapikey"
+	AuthWithLimit{
+		ID:      "testing",
+		KeyHash: "sha256$ec707eb8911593c1860fd26f23cd3d80$b824ea3df7b878c3a83af56cd71ceb1274ac34b27d60672b9c45bfbb84b42970",
+		Limit:   10000,
+		Role:    RoleClient,
+	},
+}
+
+// ConfigError lists every problem found with a configuration
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("Invalid configuration :\n  - %s", strings.Join(e.Problems, "\n  - "))
+}
+
+// loadConfig reads the configuration file at `path`, if any, then applies the environment
+// and validates the result, reporting every problem at once
+func loadConfig(path string) (*Config, error) {
+	config := &Config{}
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read configuration : %+v", err)
+		}
+		if err := yaml.UnmarshalStrict(data, config); err != nil {
+			return nil, fmt.Errorf("Unable to parse configuration %s : %+v", path, err)
+		}
+	}
+
+	problems := config.applySecrets()
+	problems = append(problems, config.applyEnv()...)
+	problems = append(problems, config.validate()...)
+	problems = append(problems, config.checkEnv()...)
+	if len(problems) > 0 {
+		return nil, &ConfigError{Problems: problems}
+	}
+	return config, nil
+}
+
+// applySecrets adds the upstream credentials and keys kept in the encrypted credentials file,
+// along with any keys in AUTH_KEYS_FILE, to those in the configuration file. The built in
+// keys are only used when none of these list keys, even an empty list
+func (c *Config) applySecrets() []string {
+	problems := []string{}
+	configured := c.Auth.Keys != nil
+	c.credentials = &Credentials{}
+	credentials, err := loadCredentials()
+	if err != nil {
+		problems = append(problems, err.Error())
+	} else {
+		c.credentials = credentials
+		if credentials.UpstreamUsername != "" {
+			c.Upstream.Username = credentials.UpstreamUsername
+		}
+		if credentials.UpstreamPassword != "" {
+			c.Upstream.Password = credentials.UpstreamPassword
+		}
+		if credentials.AuthKeys != nil {
+			configured = true
+			c.Auth.Keys = append(c.Auth.Keys, credentials.AuthKeys...)
+		}
+	}
+
+	keys, err := loadAuthKeysFile()
+	if err != nil {
+		problems = append(problems, err.Error())
+	} else if keys != nil {
+		configured = true
+		c.Auth.Keys = append(c.Auth.Keys, keys...)
+	}
+
+	if !configured {
+		c.Auth.Keys = defaultAuthKeys
+	} else if c.Auth.Keys == nil {
+		c.Auth.Keys = []AuthWithLimit{}
+	}
+	return problems
+}
+
+// applyEnv overrides the configuration with any of the environment variables which are set
+func (c *Config) applyEnv() []string {
+	problems := []string{}
+	overrideInt := func(name string, value *int) {
+		if raw := os.Getenv(name); raw != "" {
+			i, err := strconv.Atoi(raw)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s must be a number, got %q", name, raw))
+				return
+			}
+			*value = i
+		}
+	}
+	overrideBool := func(name string, value *bool) {
+		if raw := os.Getenv(name); raw != "" {
+			b, err := strconv.ParseBool(raw)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s must be true or false, got %q", name, raw))
+				return
+			}
+			*value = b
+		}
+	}
+	// Any of the strings can also be read from a file, such as PROXY_PASSWORD_FILE
+	overrideString := func(name string, value *string) {
+		raw, err := secretEnv(name)
+		if err != nil {
+			problems = append(problems, err.Error())
+		} else if raw != "" {
+			*value = raw
+		}
+	}
+
+	overrideInt("SERVE_PORT", &c.Listen.Port)
+	overrideString("API_TLS_CERT", &c.Listen.TLS.CertFile)
+	overrideString("API_TLS_KEY", &c.Listen.TLS.KeyFile)
+	overrideString("API_TLS_CLIENT_CA", &c.Listen.TLS.ClientCAFile)
+	overrideBool("API_TLS_CLIENT_REQUIRED", &c.Listen.TLS.RequireClientCert)
+	overrideInt("PRAXIS_LOWER", &c.Ports.Lower)
+	overrideInt("PRAXIS_UPPER", &c.Ports.Upper)
+	overrideString("PROXY_URL", &c.Upstream.URL)
+	overrideString("PROXY_USERNAME", &c.Upstream.Username)
+	overrideString("PROXY_PASSWORD", &c.Upstream.Password)
+	overrideBool("AUTH_ENABLED", &c.Auth.Enabled)
+	overrideString(logLevelVar, &c.Logging.Level)
+	overrideString(logFormatVar, &c.Logging.Format)
+	overrideString("ACCESS_LOG", &c.AccessLog.Path)
+	overrideString("ACCESS_LOG_FORMAT", &c.AccessLog.Format)
+	overrideInt("ACCESS_LOG_MAX_SIZE", &c.AccessLog.MaxSize)
+	overrideInt("ACCESS_LOG_MAX_BACKUPS", &c.AccessLog.MaxBackups)
+	if mode := os.Getenv(proxyModeVar); mode != "" {
+		c.Logging.Debug = mode == "debug"
+	}
+	return problems
+}
+
+func validPort(port int) bool {
+	return port > 0 && port <= 65535
+}
+
+// validate returns every problem with the configuration
+func (c *Config) validate() []string {
+	problems := []string{}
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if !validPort(c.Listen.Port) {
+		add("listen.port (SERVE_PORT) must be between 1 and 65535, got %d", c.Listen.Port)
+	}
+	tls := c.Listen.TLS
+	if (tls.CertFile == "") != (tls.KeyFile == "") {
+		add("listen.tls.cert (API_TLS_CERT) and listen.tls.key (API_TLS_KEY) must be set together")
+	}
+	if tls.ClientCAFile != "" && !tls.enabled() {
+		add("listen.tls.client_ca (API_TLS_CLIENT_CA) needs listen.tls.cert and listen.tls.key")
+	}
+	if tls.RequireClientCert && tls.ClientCAFile == "" {
+		add("listen.tls.client_required (API_TLS_CLIENT_REQUIRED) needs listen.tls.client_ca")
+	}
+
+	if !validPort(c.Ports.Lower) {
+		add("ports.lower (PRAXIS_LOWER) must be between 1 and 65535, got %d", c.Ports.Lower)
+	}
+	if !validPort(c.Ports.Upper) {
+		add("ports.upper (PRAXIS_UPPER) must be between 1 and 65535, got %d", c.Ports.Upper)
+	}
+	if c.Ports.Lower > c.Ports.Upper {
+		add("ports.lower (PRAXIS_LOWER) %d is above ports.upper (PRAXIS_UPPER) %d", c.Ports.Lower, c.Ports.Upper)
+	} else if c.Listen.Port >= c.Ports.Lower && c.Listen.Port <= c.Ports.Upper {
+		add("listen.port %d is within the session ports %d-%d", c.Listen.Port, c.Ports.Lower, c.Ports.Upper)
+	}
+
+	if c.Upstream.URL == "" {
+		add("upstream.url (PROXY_URL) is required")
+	} else if u, err := url.Parse(c.Upstream.URL); err != nil || u.Scheme == "" || u.Host == "" {
+		add("upstream.url (PROXY_URL) must be an absolute url, got %q", c.Upstream.URL)
+	}
+	if c.Upstream.Username == "" {
+		add("upstream.username (PROXY_USERNAME) is required")
+	}
+	if c.Upstream.Password == "" {
+		add("upstream.password (PROXY_PASSWORD) is required")
+	}
+
+	if c.Logging.Level != "" {
+		if _, err := parseLogLevel(c.Logging.Level); err != nil {
+			add("logging.level (LOG_LEVEL) : %s", err)
+		}
+	}
+	if c.Logging.Format != "" && c.Logging.Format != jsonLogFormat && c.Logging.Format != textLogFormat {
+		add("logging.format (LOG_FORMAT) must be json or text, got %q", c.Logging.Format)
+	}
+
+	switch c.AccessLog.Format {
+	case "", squidAccessLogFormat, combinedAccessLogFormat, jsonlAccessLogFormat:
+	default:
+		add("access_log.format (ACCESS_LOG_FORMAT) must be squid, combined or jsonl, got %q", c.AccessLog.Format)
+	}
+	if c.AccessLog.MaxSize < 0 {
+		add("access_log.max_size (ACCESS_LOG_MAX_SIZE) can't be negative, got %d", c.AccessLog.MaxSize)
+	}
+	if c.AccessLog.MaxBackups < 0 {
+		add("access_log.max_backups (ACCESS_LOG_MAX_BACKUPS) can't be negative, got %d", c.AccessLog.MaxBackups)
+	}
+
+	ids := make(map[string]bool)
+	for i, keyConfig := range c.Auth.Keys {
+		name := fmt.Sprintf("auth.keys[%d]", i)
+		if keyConfig.ID == "" {
+			add("%s.id is required", name)
+		} else if ids[keyConfig.ID] {
+			add("%s.id %s is used by another key", name, keyConfig.ID)
+		}
+		ids[keyConfig.ID] = true
+
+		if parts := strings.Split(keyConfig.KeyHash, "$"); len(parts) != 3 || parts[0] != keyHashScheme {
+			add("%s.key_hash must be a %s$<salt>$<hash> hash", name, keyHashScheme)
+		}
+		if err := keyConfig.validate(); err != nil {
+			add("%s : %s", name, err)
+		}
+	}
+	return problems
+}
+
+// checkEnv returns every problem with the settings only read from the environment, which are
+// loaded once praxis starts
+func (c *Config) checkEnv() []string {
+	problems := []string{}
+	add := func(err error) {
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	// Only auth and clustering need a store
+	if c.Auth.Enabled || os.Getenv(instanceURLVar) != "" {
+		problems = append(problems, checkStoreEnv(c.credentials)...)
+	}
+	// Replicas sign the requests they forward to each other, so they must share the secret
+	if secret, err := secretEnv(tokenSecretVar); err != nil {
+		add(err)
+	} else if secret == "" && os.Getenv(instanceURLVar) != "" {
+		problems = append(problems, fmt.Sprintf("%s is required when %s is set", tokenSecretVar, instanceURLVar))
+	}
+	if _, err := parseClientCertificateKeys(os.Getenv(clientKeysVar)); err != nil {
+		problems = append(problems, fmt.Sprintf("%s : %s", clientKeysVar, err))
+	}
+	_, err := parseTrustedProxies()
+	add(err)
+	_, _, err = parseWebhookEnv()
+	add(err)
+	_, err = parseAnomalyDetection()
+	add(err)
+	_, err = parseHistorySize(historyPerSessionVar, defaultHistoryPerSession)
+	add(err)
+	_, err = parseHistorySize(historyPerKeyVar, defaultHistoryPerKey)
+	add(err)
+	_, _, err = parseRollupEnv()
+	add(err)
+	_, err = secretEnv(metricsTokenVar)
+	add(err)
+	return problems
+}
+
+// restartRequired returns the settings which differ in `next` but can only be applied by restarting
+func (c *Config) restartRequired(next *Config) []string {
+	changed := []string{}
+	if c.Listen != next.Listen {
+		changed = append(changed, "listen")
+	}
+	if c.Ports != next.Ports {
+		changed = append(changed, "ports")
+	}
+	if c.Auth.Enabled != next.Auth.Enabled {
+		changed = append(changed, "auth.enabled")
+	}
+	return changed
+}
+
+// watchConfig reloads the configuration when sent SIGHUP, handing it to `apply` if it is valid
+func watchConfig(path string, apply func(*Config)) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			config, err := loadConfig(path)
+			if err != nil {
+				configLog.Warnf("Keeping the current configuration, reload failed : %+v", err)
+				continue
+			}
+			apply(config)
+		}
+	}()
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testConfig = `
+listen:
+  port: 8080
+ports:
+  lower: 3000
+  upper: 3010
+upstream:
+  url: http://zproxy.example.com:22225
+  username: customer
+  password: secret
+auth:
+  enabled: true
+  keys:
+    - id: crawler
+      key_hash: sha256$ec707eb8911593c1860fd26f23cd3d80$b824ea3df7b878c3a83af56cd71ceb1274ac34b27d60672b9c45bfbb84b42970
+      limit: 500
+      window: hourly
+      rate_limit: 2.5
+      daily_bytes: 1048576
+      scopes: [sessions:create]
+      anomaly:
+        repeated_url: 30
+        action: suspend
+      destinations:
+        allow:
+          - host: "*.example.com"
+            ports: [443]
+        deny:
+          - cidr: 10.0.0.0/8
+logging:
+  debug: true
+`
+
+func writeTestConfig(t *testing.T, contents string) string {
+	file, err := ioutil.TempFile("", "praxis-config")
+	if err != nil {
+		t.Fatalf("Unable to create config : %+v", err)
+	}
+	file.WriteString(contents)
+	file.Close()
+	return file.Name()
+}
+
+func setTestEnv(env map[string]string) func() {
+	for name, value := range env {
+		os.Setenv(name, value)
+	}
+	return func() {
+		for name := range env {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeTestConfig(t, testConfig)
+	defer os.Remove(path)
+
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("Unexpected error loading config : %+v", err)
+	}
+	if config.Listen.Port != 8080 || config.Ports.Lower != 3000 || config.Upstream.Username != "customer" || !config.Auth.Enabled || !config.Logging.Debug {
+		t.Fatalf("Config was not read from the file : %+v", config)
+	}
+	if len(config.Auth.Keys) != 1 {
+		t.Fatalf("Expected the configured key to replace the defaults but got %+v", config.Auth.Keys)
+	}
+	key := config.Auth.Keys[0]
+	if key.ID != "crawler" || key.Limit != 500 || key.Window != HourlyWindow || key.RateLimit != 2.5 ||
+		key.DailyBytes != 1048576 || len(key.Scopes) != 1 || key.Anomaly == nil || key.Anomaly.Action != SuspendAction {
+		t.Fatalf("Key was not read from the file : %+v", key)
+	}
+	if key.Destinations == nil || len(key.Destinations.Allow) != 1 || key.Destinations.Allow[0].Host != "*.example.com" ||
+		len(key.Destinations.Allow[0].Ports) != 1 || len(key.Destinations.Deny) != 1 || key.Destinations.Deny[0].CIDR != "10.0.0.0/8" {
+		t.Fatalf("Destinations were not read from the file : %+v", key.Destinations)
+	}
+
+	// The environment overrides the file
+	defer setTestEnv(map[string]string{"SERVE_PORT": "9090", "PROXY_USERNAME": "other", "PROXY_MODE": "normal"})()
+	config, err = loadConfig(path)
+	if err != nil {
+		t.Fatalf("Unexpected error loading config : %+v", err)
+	}
+	if config.Listen.Port != 9090 || config.Upstream.Username != "other" || config.Logging.Debug {
+		t.Fatalf("Expected environment to override the file but got %+v", config)
+	}
+}
+
+func TestLoadConfigFromEnv(t *testing.T) {
+	defer setTestEnv(map[string]string{
+		"SERVE_PORT":     "8080",
+		"PRAXIS_LOWER":   "3000",
+		"PRAXIS_UPPER":   "3010",
+		"PROXY_URL":      "http://zproxy.example.com:22225",
+		"PROXY_USERNAME": "customer",
+		"PROXY_PASSWORD": "secret",
+	})()
+
+	config, err := loadConfig("")
+	if err != nil {
+		t.Fatalf("Unexpected error loading config : %+v", err)
+	}
+	if len(config.Auth.Keys) != 1 || config.Auth.Keys[0].ID != "testing" {
+		t.Fatalf("Expected the default keys without a file but got %+v", config.Auth.Keys)
+	}
+	// The default keys secret is published, so it can't be allowed to manage keys
+	if config.Auth.Keys[0].hasScope(ScopeKeysAdmin) || config.Auth.Keys[0].hasScope(ScopeUsageReadAll) {
+		t.Fatalf("Expected the default key to only be a client but got %+v", config.Auth.Keys[0])
+	}
+}
+
+func TestLoadConfigReportsEveryProblem(t *testing.T) {
+	path := writeTestConfig(t, `
+listen:
+  port: 3005
+ports:
+  lower: 3000
+  upper: 3010
+upstream:
+  url: zproxy
+auth:
+  keys:
+    - id: crawler
+      window: fortnightly
+    - id: crawler
+      key_hash: sha256$salt$hash
+`)
+	defer os.Remove(path)
+	defer setTestEnv(map[string]string{"PRAXIS_UPPER": "lots", "AUTH_ENABLED": "maybe"})()
+
+	_, err := loadConfig(path)
+	configErr, ok := err.(*ConfigError)
+	if !ok {
+		t.Fatalf("Expected a config error but got %+v", err)
+	}
+	expected := []string{
+		"PRAXIS_UPPER must be a number",
+		"AUTH_ENABLED must be true or false",
+		"listen.port 3005 is within the session ports",
+		"upstream.url (PROXY_URL) must be an absolute url",
+		"upstream.username (PROXY_USERNAME) is required",
+		"upstream.password (PROXY_PASSWORD) is required",
+		"auth.keys[0].key_hash must be",
+		"auth.keys[0] : Unknown window fortnightly",
+		"auth.keys[1].id crawler is used by another key",
+	}
+	message := err.Error()
+	for _, problem := range expected {
+		if !strings.Contains(message, problem) {
+			t.Errorf("Expected %q to be reported in :\n%s", problem, message)
+		}
+	}
+	if len(configErr.Problems) != len(expected) {
+		t.Errorf("Expected %d problems but got %d :\n%s", len(expected), len(configErr.Problems), message)
+	}
+}
+
+func TestLoadConfigReportsEnvProblems(t *testing.T) {
+	path := writeTestConfig(t, testConfig)
+	defer os.Remove(path)
+	defer setTestEnv(map[string]string{
+		"STORE":               "mongo",
+		"INSTANCE_URL":        "http://praxis-1:3000",
+		"API_TLS_CLIENT_KEYS": "CN=crawler=",
+		"TRUSTED_PROXIES":     "10.0.0.0/33",
+		"WEBHOOK_THRESHOLDS":  "80,150",
+		"ANOMALY_DETECTION":   "sometimes",
+		"HISTORY_PER_SESSION": "-1",
+		"HISTORY_PER_KEY":     "many",
+		"ROLLUP_INTERVAL":     "0s",
+		"METRICS_TOKEN":       "token",
+		"METRICS_TOKEN_FILE":  "/run/secrets/metrics",
+	})()
+
+	_, err := loadConfig(path)
+	configErr, ok := err.(*ConfigError)
+	if !ok {
+		t.Fatalf("Expected a config error but got %+v", err)
+	}
+	expected := []string{
+		"STORE must be redis or memory",
+		"PRAXIS_TOKEN_SECRET is required when INSTANCE_URL is set",
+		"API_TLS_CLIENT_KEYS",
+		"TRUSTED_PROXIES",
+		"WEBHOOK_THRESHOLDS must be percentages",
+		"ANOMALY_DETECTION must be true or false",
+		"HISTORY_PER_SESSION can't be negative",
+		"Unable to parse HISTORY_PER_KEY",
+		"ROLLUP_INTERVAL must be positive",
+		"Only one of METRICS_TOKEN and METRICS_TOKEN_FILE",
+	}
+	message := err.Error()
+	for _, problem := range expected {
+		if !strings.Contains(message, problem) {
+			t.Errorf("Expected %q to be reported in :\n%s", problem, message)
+		}
+	}
+	if len(configErr.Problems) != len(expected) {
+		t.Errorf("Expected %d problems but got %d :\n%s", len(expected), len(configErr.Problems), message)
+	}
+}
+
+func TestLoadConfigRejectsUnknownFields(t *testing.T) {
+	path := writeTestConfig(t, "listen:\n  prot: 8080\n")
+	defer os.Remove(path)
+
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "prot") {
+		t.Fatalf("Expected unknown field to be rejected but got %+v", err)
+	}
+}
+
+func TestConfigRestartRequired(t *testing.T) {
+	current := &Config{Listen: ListenConfig{Port: 8080}, Ports: PortsConfig{Lower: 3000, Upper: 3010}}
+	next := *current
+	next.Upstream.URL = "http://other.example.com"
+	if changed := current.restartRequired(&next); len(changed) != 0 {
+		t.Fatalf("Expected upstream changes to apply without a restart but got %v", changed)
+	}
+	next.Ports.Upper = 3020
+	next.Auth.Enabled = true
+	if changed := current.restartRequired(&next); strings.Join(changed, ",") != "ports,auth.enabled" {
+		t.Fatalf("Expected ports and auth to need a restart but got %v", changed)
+	}
+}
+
+func TestProxyReconfigure(t *testing.T) {
+	proxy := &Proxy{URL: "http://old.example.com", username: "old", password: "old"}
+	proxy.Reconfigure(UpstreamConfig{URL: "http://new.example.com", Username: "new", Password: "new"}, true)
+	upstream, debug := proxy.upstream()
+	if upstream.URL != "http://new.example.com" || upstream.Username != "new" || upstream.Password != "new" || !debug {
+		t.Fatalf("Expected new upstream but got %+v (debug %t)", upstream, debug)
+	}
+}
+
+func TestKeySetReload(t *testing.T) {
+	store, _ := NewMemoryStore("")
+	keys := NewKeySet(defaultAuthKeys)
+	config := &AuthConfig{ServiceName: "praxis", Keys: keys}
+	if key, _ := config.keyConfig(store, "testing.testingapikey"); key == nil {
+		t.Fatalf("Expected the default key to be valid")
+	}
+
+	keys.Set([]AuthWithLimit{AuthWithLimit{ID: "other", KeyHash: defaultAuthKeys[0].KeyHash}})
+	if key, _ := config.keyConfig(store, "testing.testingapikey"); key != nil {
+		t.Fatalf("Expected the removed key to be rejected after reload")
+	}
+	if key, _ := config.keyConfig(store, "other.testingapikey"); key == nil {
+		t.Fatalf("Expected the new key to be valid after reload")
+	}
+}
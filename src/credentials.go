@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	credentialsVar        = "PRAXIS_CREDENTIALS"
+	credentialsKeyFileVar = "PRAXIS_CREDENTIALS_KEY_FILE"
+	authKeysFileVar       = "AUTH_KEYS_FILE"
+
+	credentialsHeader = "praxis-credentials:v1"
+	credentialsKeyLen = 32
+)
+
+// Credentials are the secrets kept encrypted at rest in the file named by PRAXIS_CREDENTIALS,
+// unlocked with the key in PRAXIS_CREDENTIALS_KEY_FILE
+type Credentials struct {
+	UpstreamUsername      string          `yaml:"upstream_username"`
+	UpstreamPassword      string          `yaml:"upstream_password"`
+	RedisPassword         string          `yaml:"redis_password"`
+	RedisSentinelPassword string          `yaml:"redis_sentinel_password"`
+	AuthKeys              []AuthWithLimit `yaml:"auth_keys"`
+}
+
+// secretEnv reads a variable, or the contents of the file named by <name>_FILE such as a
+// docker or kubernetes secret. Trailing newlines left by editors are trimmed
+func secretEnv(name string) (string, error) {
+	value := os.Getenv(name)
+	path := os.Getenv(name + "_FILE")
+	if path == "" {
+		return value, nil
+	}
+	if value != "" {
+		return "", fmt.Errorf("Only one of %s and %s_FILE can be set", name, name)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Unable to read %s_FILE : %+v", name, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// readCredentialsKey reads a hex encoded 256 bit key, warning when others can read it
+func readCredentialsKey(path string) ([]byte, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode().Perm()&0077 != 0 {
+		configLog.Warnf("Credentials key %s can be read by other users, it should be 0600", path)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read credentials key : %+v", err)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != credentialsKeyLen {
+		return nil, fmt.Errorf("Credentials key %s must be %d hex encoded bytes", path, credentialsKeyLen)
+	}
+	return key, nil
+}
+
+func newCredentialsKey() (string, error) {
+	key := make([]byte, credentialsKeyLen)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// encryptCredentials seals `plaintext` with AES-256-GCM, the result is a header line followed
+// by the base64 encoded nonce and ciphertext
+func encryptCredentials(key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, plaintext, []byte(credentialsHeader))
+	return []byte(credentialsHeader + "\n" + base64.StdEncoding.EncodeToString(sealed) + "\n"), nil
+}
+
+func decryptCredentials(key, data []byte) ([]byte, error) {
+	parts := strings.SplitN(strings.TrimSpace(string(data)), "\n", 2)
+	if len(parts) != 2 || parts[0] != credentialsHeader {
+		return nil, fmt.Errorf("Not a credentials file, expected it to start with %s", credentialsHeader)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode credentials : %+v", err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("Credentials file is truncated")
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(credentialsHeader))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decrypt credentials, the key may be wrong or the file modified")
+	}
+	return plaintext, nil
+}
+
+// loadCredentials decrypts the credentials file when PRAXIS_CREDENTIALS is set, returning
+// empty credentials otherwise
+func loadCredentials() (*Credentials, error) {
+	credentials := &Credentials{}
+	path := os.Getenv(credentialsVar)
+	if path == "" {
+		return credentials, nil
+	}
+	keyPath := os.Getenv(credentialsKeyFileVar)
+	if keyPath == "" {
+		return nil, fmt.Errorf("%s is required to unlock %s", credentialsKeyFileVar, credentialsVar)
+	}
+
+	key, err := readCredentialsKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read credentials : %+v", err)
+	}
+	plaintext, err := decryptCredentials(key, data)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(plaintext, credentials); err != nil {
+		return nil, fmt.Errorf("Unable to parse credentials : %+v", err)
+	}
+	return credentials, nil
+}
+
+// loadAuthKeysFile reads the list of keys in the yaml file named by AUTH_KEYS_FILE, if any
+func loadAuthKeysFile() ([]AuthWithLimit, error) {
+	path := os.Getenv(authKeysFileVar)
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read %s : %+v", authKeysFileVar, err)
+	}
+	keys := []AuthWithLimit{}
+	if err := yaml.UnmarshalStrict(data, &keys); err != nil {
+		return nil, fmt.Errorf("Unable to parse %s : %+v", authKeysFileVar, err)
+	}
+	return keys, nil
+}
+
+// credentialsCommand creates credentials keys and encrypts credentials files, as
+// `credentials key > praxis.key` and `credentials encrypt < credentials.yml > credentials.enc`
+func credentialsCommand(args []string, in io.Reader, out io.Writer) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage : credentials key|encrypt|decrypt")
+	}
+
+	switch args[0] {
+	case "key":
+		key, err := newCredentialsKey()
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(out, key)
+		return err
+	case "encrypt", "decrypt":
+		keyPath := os.Getenv(credentialsKeyFileVar)
+		if keyPath == "" {
+			return fmt.Errorf("%s is required", credentialsKeyFileVar)
+		}
+		key, err := readCredentialsKey(keyPath)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadAll(in)
+		if err != nil {
+			return err
+		}
+
+		var result []byte
+		if args[0] == "encrypt" {
+			// Check the credentials parse before they are locked away
+			if err := yaml.UnmarshalStrict(data, &Credentials{}); err != nil {
+				return fmt.Errorf("Unable to parse credentials : %+v", err)
+			}
+			result, err = encryptCredentials(key, data)
+		} else {
+			result, err = decryptCredentials(key, data)
+		}
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(result)
+		return err
+	}
+	return fmt.Errorf("Unknown credentials command %s, expected key, encrypt or decrypt", args[0])
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testCredentials = `
+upstream_password: s3cr3t
+redis_password: r3d1s
+auth_keys:
+  - id: secret
+    key_hash: sha256$ec707eb8911593c1860fd26f23cd3d80$b824ea3df7b878c3a83af56cd71ceb1274ac34b27d60672b9c45bfbb84b42970
+    limit: 100
+`
+
+func TestCredentialsEncryption(t *testing.T) {
+	key, _ := newCredentialsKey()
+	keyPath := writeTestConfig(t, key+"\n")
+	defer os.Remove(keyPath)
+	keyBytes, err := readCredentialsKey(keyPath)
+	if err != nil {
+		t.Fatalf("Unexpected error reading key : %+v", err)
+	}
+
+	sealed, err := encryptCredentials(keyBytes, []byte(testCredentials))
+	if err != nil {
+		t.Fatalf("Unexpected error encrypting : %+v", err)
+	}
+	if bytes.Contains(sealed, []byte("s3cr3t")) {
+		t.Fatalf("Expected credentials to be encrypted but got %s", sealed)
+	}
+	plaintext, err := decryptCredentials(keyBytes, sealed)
+	if err != nil || string(plaintext) != testCredentials {
+		t.Fatalf("Expected credentials back but got %q : %+v", plaintext, err)
+	}
+
+	otherKey, _ := newCredentialsKey()
+	otherPath := writeTestConfig(t, otherKey)
+	defer os.Remove(otherPath)
+	otherBytes, _ := readCredentialsKey(otherPath)
+	if _, err := decryptCredentials(otherBytes, sealed); err == nil {
+		t.Fatalf("Expected the wrong key to fail")
+	}
+
+	tampered := []byte(strings.Replace(string(sealed), credentialsHeader+"\n", credentialsHeader+"\nAA", 1))
+	if _, err := decryptCredentials(keyBytes, tampered); err == nil {
+		t.Fatalf("Expected a modified file to fail")
+	}
+
+	shortPath := writeTestConfig(t, "abcd")
+	defer os.Remove(shortPath)
+	if _, err := readCredentialsKey(shortPath); err == nil {
+		t.Fatalf("Expected a short key to be rejected")
+	}
+}
+
+func TestSecretEnv(t *testing.T) {
+	path := writeTestConfig(t, "from a file\n")
+	defer os.Remove(path)
+
+	defer setTestEnv(map[string]string{"PRAXIS_TEST_SECRET_FILE": path})()
+	if value, err := secretEnv("PRAXIS_TEST_SECRET"); err != nil || value != "from a file" {
+		t.Fatalf("Expected secret read from file but got %q : %+v", value, err)
+	}
+
+	defer setTestEnv(map[string]string{"PRAXIS_TEST_SECRET": "from the environment"})()
+	if _, err := secretEnv("PRAXIS_TEST_SECRET"); err == nil {
+		t.Fatalf("Expected setting both the variable and file to fail")
+	}
+}
+
+func TestLoadConfigEmptyKeysFile(t *testing.T) {
+	keysPath := writeTestConfig(t, "[]\n")
+	defer os.Remove(keysPath)
+	defer setTestEnv(map[string]string{
+		authKeysFileVar:  keysPath,
+		"SERVE_PORT":     "8080",
+		"PRAXIS_LOWER":   "3000",
+		"PRAXIS_UPPER":   "3010",
+		"PROXY_URL":      "http://zproxy.example.com:22225",
+		"PROXY_USERNAME": "customer",
+		"PROXY_PASSWORD": "secret",
+	})()
+
+	// Listing no keys must not fall back to the well known testing key
+	config, err := loadConfig("")
+	if err != nil {
+		t.Fatalf("Unexpected error loading config : %+v", err)
+	}
+	if len(config.Auth.Keys) != 0 {
+		t.Fatalf("Expected no keys from an empty keys file but got %+v", config.Auth.Keys)
+	}
+}
+
+func TestLoadConfigSecrets(t *testing.T) {
+	key, _ := newCredentialsKey()
+	keyPath := writeTestConfig(t, key)
+	defer os.Remove(keyPath)
+
+	var sealed bytes.Buffer
+	defer setTestEnv(map[string]string{credentialsKeyFileVar: keyPath})()
+	if err := credentialsCommand([]string{"encrypt"}, strings.NewReader(testCredentials), &sealed); err != nil {
+		t.Fatalf("Unexpected error encrypting : %+v", err)
+	}
+	credentialsPath := writeTestConfig(t, sealed.String())
+	defer os.Remove(credentialsPath)
+
+	keysPath := writeTestConfig(t, "- id: mounted\n  key_hash: "+defaultAuthKeys[0].KeyHash+"\n")
+	defer os.Remove(keysPath)
+	usernamePath := writeTestConfig(t, "customer\n")
+	defer os.Remove(usernamePath)
+
+	defer setTestEnv(map[string]string{
+		credentialsVar:        credentialsPath,
+		authKeysFileVar:       keysPath,
+		"SERVE_PORT":          "8080",
+		"PRAXIS_LOWER":        "3000",
+		"PRAXIS_UPPER":        "3010",
+		"PROXY_URL":           "http://zproxy.example.com:22225",
+		"PROXY_USERNAME_FILE": usernamePath,
+	})()
+
+	config, err := loadConfig("")
+	if err != nil {
+		t.Fatalf("Unexpected error loading config : %+v", err)
+	}
+	if config.Upstream.Username != "customer" || config.Upstream.Password != "s3cr3t" {
+		t.Fatalf("Expected upstream credentials from files but got %+v", config.Upstream)
+	}
+	if len(config.Auth.Keys) != 2 || config.Auth.Keys[0].ID != "secret" || config.Auth.Keys[1].ID != "mounted" {
+		t.Fatalf("Expected keys from the credentials and keys files but got %+v", config.Auth.Keys)
+	}
+
+	redisConfig, err := loadRedisConfig(config.credentials)
+	if err != nil || redisConfig.Password != "r3d1s" {
+		t.Fatalf("Expected redis password from the credentials but got %q : %+v", redisConfig.Password, err)
+	}
+
+	// Mounted keys are added to those in the configuration file
+	path := writeTestConfig(t, testConfig)
+	defer os.Remove(path)
+	if config, err = loadConfig(path); err != nil || len(config.Auth.Keys) != 3 || config.Auth.Keys[0].ID != "crawler" {
+		t.Fatalf("Expected the mounted keys added to the configured key but got %+v : %+v", config, err)
+	}
+
+	var opened bytes.Buffer
+	if err := credentialsCommand([]string{"decrypt"}, strings.NewReader(sealed.String()), &opened); err != nil || opened.String() != testCredentials {
+		t.Fatalf("Expected credentials back but got %q : %+v", opened.String(), err)
+	}
+	if err := credentialsCommand([]string{"encrypt"}, strings.NewReader("unknown: field\n"), ioutil.Discard); err == nil {
+		t.Fatalf("Expected unparsable credentials to be refused")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDebugDuration = 10 * time.Minute
+	maxDebugDuration     = time.Hour
+)
+
+// sessionDebug tracks the sessions being debugged at runtime and until when, so a single
+// misbehaving session can be traced without turning on debug logging for every session
+type sessionDebug struct {
+	sessions map[int]time.Time
+	mutex    sync.Mutex
+}
+
+// until returns when debugging `id` ends, forgetting windows which have already ended
+func (d *sessionDebug) until(id int, now time.Time) (time.Time, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	until, ok := d.sessions[id]
+	if !ok {
+		return time.Time{}, false
+	}
+	if !now.Before(until) {
+		delete(d.sessions, id)
+		proxyLog.With(Fields{"session": id}).Infof("Debugging ended")
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+func (d *sessionDebug) set(id int, until time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.sessions == nil {
+		d.sessions = make(map[int]time.Time)
+	}
+	if until.IsZero() {
+		delete(d.sessions, id)
+		return
+	}
+	d.sessions[id] = until
+}
+
+// DebugSession traces every request of session `id` until `until`, or stops when it is zero
+func (p *Proxy) DebugSession(id int, until time.Time) {
+	p.debugSessions.set(id, until)
+	if until.IsZero() {
+		proxyLog.With(Fields{"session": id}).Infof("Debugging disabled")
+	} else {
+		proxyLog.With(Fields{"session": id}).Infof("Debugging enabled until %s", until.Format(time.RFC3339))
+	}
+}
+
+// debugging reports whether session `id` is being debugged at runtime, and until when
+func (p *Proxy) debugging(id int) (time.Time, bool) {
+	return p.debugSessions.until(id, time.Now())
+}
+
+// debugDuration parses how long to debug a session for, capped to maxDebugDuration
+func debugDuration(requested string) (time.Duration, error) {
+	if requested == "" {
+		return defaultDebugDuration, nil
+	}
+	duration, err := time.ParseDuration(requested)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("Invalid debug duration %s", requested)
+	}
+	if duration > maxDebugDuration {
+		return maxDebugDuration, nil
+	}
+	return duration, nil
+}
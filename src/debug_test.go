@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer collects log lines written from the proxies goroutines
+type lockedBuffer struct {
+	buffer bytes.Buffer
+	mutex  sync.Mutex
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.String()
+}
+
+// captureLogs sends everything logged to a buffer until the returned function is called
+func captureLogs() (*lockedBuffer, func()) {
+	captured := &lockedBuffer{}
+	logger.output.mutex.Lock()
+	previous := logger.output.out
+	logger.output.out = captured
+	logger.output.mutex.Unlock()
+	return captured, func() {
+		logger.output.mutex.Lock()
+		logger.output.out = previous
+		logger.output.mutex.Unlock()
+	}
+}
+
+func TestDebugDuration(t *testing.T) {
+	if duration, err := debugDuration(""); err != nil || duration != defaultDebugDuration {
+		t.Fatalf("Expected the default duration but got %s : %+v", duration, err)
+	}
+	if duration, err := debugDuration("3h"); err != nil || duration != maxDebugDuration {
+		t.Fatalf("Expected the duration to be capped but got %s : %+v", duration, err)
+	}
+	if _, err := debugDuration("-5m"); err == nil {
+		t.Fatalf("Expected a negative duration to be refused")
+	}
+}
+
+func TestSessionDebugExpires(t *testing.T) {
+	debug := sessionDebug{}
+	now := time.Now()
+	debug.set(3001, now.Add(time.Minute))
+
+	if until, ok := debug.until(3001, now); !ok || !until.Equal(now.Add(time.Minute)) {
+		t.Fatalf("Expected the session to be debugged until %s but got %s", now.Add(time.Minute), until)
+	}
+	if _, ok := debug.until(3002, now); ok {
+		t.Fatalf("Expected other sessions not to be debugged")
+	}
+	if _, ok := debug.until(3001, now.Add(2*time.Minute)); ok || len(debug.sessions) != 0 {
+		t.Fatalf("Expected debugging to end and be forgotten once the window passed")
+	}
+}
+
+func TestSessionDebugTracing(t *testing.T) {
+	endProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("through the end proxy"))
+	}))
+	defer endProxy.Close()
+
+	underTest := Proxy{
+		URL:        endProxy.URL,
+		upperBound: 8087,
+		lowerBound: 8087,
+		freePorts:  makeRange(8087, 8087),
+	}
+	id, proxy, err := underTest.Create(8087)
+	if err != nil {
+		t.Fatalf("Error encountered creating proxy : %+v", err)
+	}
+	defer proxy.Close()
+
+	time.Sleep(1 * time.Second)
+
+	client := &http.Client{Transport: &http.Transport{
+		Proxy: func(req *http.Request) (*url.URL, error) {
+			return url.Parse("http://localhost:8087")
+		},
+	}}
+	get := func(path string) {
+		req, _ := http.NewRequest(http.MethodGet, "http://praxis.invalid"+path, nil)
+		req.Header.Set(authKeyHeader, "crawler.supersecret")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Unexpected error proxying : %+v", err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	logs, restore := captureLogs()
+	defer restore()
+
+	get("/before")
+	underTest.DebugSession(id, time.Now().Add(time.Minute))
+	get("/during")
+	underTest.DebugSession(id, time.Time{})
+	get("/after")
+
+	logged := logs.String()
+	if !strings.Contains(logged, "GET http://praxis.invalid/during responded 200") {
+		t.Fatalf("Expected the request to be traced while debugging but got :\n%s", logged)
+	}
+	if strings.Contains(logged, "/before") || strings.Contains(logged, "/after") {
+		t.Fatalf("Expected requests outside the window not to be traced but got :\n%s", logged)
+	}
+	if strings.Contains(logged, "supersecret") {
+		t.Fatalf("Expected the key to be redacted from traces but got :\n%s", logged)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const destinationLookupTimeout = 2 * time.Second
+
+// DestinationRule matches proxied targets by host glob (e.g. "*.example.com") or CIDR, along
+// with an optional list of ports. A rule with neither a host nor a CIDR matches any host
+type DestinationRule struct {
+	Host  string `json:",omitempty" yaml:"host"`
+	CIDR  string `json:",omitempty" yaml:"cidr"`
+	Ports []int  `json:",omitempty" yaml:"ports"`
+}
+
+// DestinationPolicy restricts where a key can proxy to, denied rules always win and when
+// there are allowed rules a target must match one of them
+type DestinationPolicy struct {
+	Allow []DestinationRule `json:",omitempty" yaml:"allow"`
+	Deny  []DestinationRule `json:",omitempty" yaml:"deny"`
+}
+
+func (r *DestinationRule) validate() error {
+	if r.Host != "" {
+		if _, err := path.Match(r.Host, ""); err != nil {
+			return fmt.Errorf("Unable to parse destination host %s", r.Host)
+		}
+	}
+	if r.CIDR != "" {
+		if _, err := parseCIDR(r.CIDR); err != nil {
+			return err
+		}
+	}
+	for _, port := range r.Ports {
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("Invalid destination port %d", port)
+		}
+	}
+	return nil
+}
+
+// lookupDestination resolves hostnames compared against CIDR rules
+var lookupDestination = func(host string) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), destinationLookupTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, nil
+}
+
+// destinationTarget is a host and port being checked, resolving the host at most once and only
+// when a CIDR rule needs its addresses
+type destinationTarget struct {
+	host string
+	port int
+
+	ips      []net.IP
+	err      error
+	resolved bool
+}
+
+func (t *destinationTarget) addresses() ([]net.IP, error) {
+	if !t.resolved {
+		t.resolved = true
+		if ip := net.ParseIP(t.host); ip != nil {
+			t.ips = []net.IP{ip}
+		} else {
+			t.ips, t.err = lookupDestination(t.host)
+		}
+	}
+	return t.ips, t.err
+}
+
+// matches checks the rule against a target. Hostnames are resolved to compare them to CIDRs,
+// a deny rule matches when any address is in its range or the host can't be resolved, while
+// an allow rule needs every address in its range
+func (r *DestinationRule) matches(target *destinationTarget, deny bool) bool {
+	if len(r.Ports) > 0 {
+		found := false
+		for _, p := range r.Ports {
+			if p == target.port {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if r.Host == "" && r.CIDR == "" {
+		return true
+	}
+	if r.Host != "" {
+		if matched, _ := path.Match(strings.ToLower(r.Host), target.host); matched {
+			return true
+		}
+	}
+	if r.CIDR != "" {
+		network, err := parseCIDR(r.CIDR)
+		if err != nil {
+			return false
+		}
+		ips, err := target.addresses()
+		if err != nil {
+			return deny
+		}
+		inside := 0
+		for _, ip := range ips {
+			if network.Contains(ip) {
+				inside++
+			}
+		}
+		if deny {
+			return inside > 0
+		}
+		return len(ips) > 0 && inside == len(ips)
+	}
+	return false
+}
+
+func (p *DestinationPolicy) validate() error {
+	for _, rules := range [][]DestinationRule{p.Allow, p.Deny} {
+		for i := range rules {
+			if err := rules[i].validate(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// allows checks a target against the policy, a nil policy allows everything
+func (p *DestinationPolicy) allows(host string, port int) bool {
+	if p == nil {
+		return true
+	}
+	target := &destinationTarget{host: host, port: port}
+	for i := range p.Deny {
+		if p.Deny[i].matches(target, true) {
+			return false
+		}
+	}
+	if len(p.Allow) == 0 {
+		return true
+	}
+	for i := range p.Allow {
+		if p.Allow[i].matches(target, false) {
+			return true
+		}
+	}
+	return false
+}
+
+// destination returns the host and port a proxied request is for, being either the
+// target of a CONNECT or the url of a plain http request
+func destination(req *http.Request) (string, int) {
+	hostPort := req.URL.Host
+	if hostPort == "" {
+		hostPort = req.Host
+	}
+
+	host, portString, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host = hostPort
+		portString = "80"
+		if req.URL.Scheme == "https" || req.Method == http.MethodConnect {
+			portString = "443"
+		}
+	}
+	port, _ := strconv.Atoi(portString)
+	return strings.ToLower(strings.Trim(host, "[]")), port
+}
+
+func (c *AuthConfig) deniedKey(key string, bucket usageWindow) string {
+	return c.statKey(key, bucket) + ":denied"
+}
+
+// checkDestination refuses proxied requests the keys policy does not allow, counting
+// the denial against the keys daily usage so it shows up in its history
+func (c *AuthConfig) checkDestination(store Store, keyConfig *AuthWithLimit, req *http.Request) error {
+	host, port := destination(req)
+	if keyConfig.Destinations.allows(host, port) {
+		return nil
+	}
+
+	loc, err := keyConfig.location()
+	if err != nil {
+		loc = time.UTC
+	}
+	now := time.Now()
+	day := DailyWindow.current(now, loc)
+	if _, err := store.IncrBy(c.deniedKey(keyConfig.ID, day), 1, DailyWindow.ttl(day, now)); err != nil {
+		authProxyLog.Errorf("Error occured counting key denials : %+v", err)
+	}
+	return &authError{Status: http.StatusForbidden, Message: fmt.Sprintf("Destination %s:%d is not allowed for this key", host, port)}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// stubDestinations resolves hostnames from `hosts` until the returned function is called
+func stubDestinations(hosts map[string][]string) func() {
+	previous := lookupDestination
+	lookupDestination = func(host string) ([]net.IP, error) {
+		addrs, ok := hosts[host]
+		if !ok {
+			return nil, fmt.Errorf("no such host %s", host)
+		}
+		ips := []net.IP{}
+		for _, addr := range addrs {
+			ips = append(ips, net.ParseIP(addr))
+		}
+		return ips, nil
+	}
+	return func() {
+		lookupDestination = previous
+	}
+}
+
+func TestDestinationPolicy(t *testing.T) {
+	defer stubDestinations(map[string][]string{
+		"www.example.com": []string{"93.184.216.34"},
+		"api.partner.com": []string{"198.51.100.20"},
+		"cdn.partner.com": []string{"198.51.100.21", "203.0.113.5"},
+	})()
+
+	policy := &DestinationPolicy{
+		Allow: []DestinationRule{
+			DestinationRule{Host: "*.example.com", Ports: []int{80, 443}},
+			DestinationRule{CIDR: "198.51.100.0/24"},
+		},
+		Deny: []DestinationRule{
+			DestinationRule{Host: "admin.example.com"},
+			DestinationRule{Ports: []int{25}},
+		},
+	}
+	if err := policy.validate(); err != nil {
+		t.Fatalf("Unexpected error validating policy : %+v", err)
+	}
+
+	tests := []struct {
+		host    string
+		port    int
+		allowed bool
+	}{
+		{"www.example.com", 443, true},
+		{"a.b.example.com", 80, true},
+		{"www.example.com", 8080, false},
+		{"example.com", 443, false},
+		{"admin.example.com", 443, false},
+		{"198.51.100.7", 8080, true},
+		{"198.51.100.7", 25, false},
+		{"203.0.113.5", 443, false},
+		{"api.partner.com", 8080, true},
+		{"cdn.partner.com", 8080, false},
+		{"unknown.partner.com", 8080, false},
+	}
+	for _, test := range tests {
+		if policy.allows(test.host, test.port) != test.allowed {
+			t.Fatalf("Expected %s:%d allowed to be %t", test.host, test.port, test.allowed)
+		}
+	}
+
+	// Hostnames resolving into a denied range are refused, as are those that can't be resolved
+	defer stubDestinations(map[string][]string{
+		"intranet.corp":    []string{"10.1.2.3"},
+		"localtest.me":     []string{"127.0.0.1"},
+		"dual.example.com": []string{"93.184.216.34", "10.9.9.9"},
+		"www.example.com":  []string{"93.184.216.34"},
+	})()
+	internal := &DestinationPolicy{Deny: []DestinationRule{
+		DestinationRule{CIDR: "10.0.0.0/8"},
+		DestinationRule{CIDR: "127.0.0.0/8"},
+	}}
+	for host, allowed := range map[string]bool{"intranet.corp": false, "localtest.me": false, "dual.example.com": false, "unknown.corp": false, "www.example.com": true} {
+		if internal.allows(host, 443) != allowed {
+			t.Fatalf("Expected %s allowed to be %t", host, allowed)
+		}
+	}
+
+	var empty *DestinationPolicy
+	if !empty.allows("anywhere.com", 443) {
+		t.Fatalf("Expected keys without a policy to reach anything")
+	}
+
+	invalid := []DestinationPolicy{
+		DestinationPolicy{Allow: []DestinationRule{DestinationRule{Host: "[example.com"}}},
+		DestinationPolicy{Deny: []DestinationRule{DestinationRule{CIDR: "10.0.0.0/40"}}},
+		DestinationPolicy{Deny: []DestinationRule{DestinationRule{Ports: []int{70000}}}},
+	}
+	for _, policy := range invalid {
+		if err := policy.validate(); err == nil {
+			t.Fatalf("Expected policy to fail validation : %+v", policy)
+		}
+	}
+}
+
+func TestDestination(t *testing.T) {
+	tests := []struct {
+		method string
+		url    string
+		host   string
+		port   int
+	}{
+		{http.MethodConnect, "//WWW.Example.com:443", "www.example.com", 443},
+		{http.MethodConnect, "//[2001:db8::1]:8443", "2001:db8::1", 8443},
+		{http.MethodGet, "http://example.com/path", "example.com", 80},
+		{http.MethodGet, "https://example.com/path", "example.com", 443},
+		{http.MethodGet, "http://example.com:8080/path", "example.com", 8080},
+	}
+	for _, test := range tests {
+		parsed, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatalf("Unable to parse url %s : %+v", test.url, err)
+		}
+		host, port := destination(&http.Request{Method: test.method, URL: parsed})
+		if host != test.host || port != test.port {
+			t.Fatalf("Expected destination %s:%d for %s but got %s:%d", test.host, test.port, test.url, host, port)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	storeFailureVar = "STORE_FAILURE_POLICY"
+
+	storeRecoveryInterval = 5 * time.Second
+)
+
+// StoreFailurePolicy decides what happens to limit checks while the store is unavailable
+type StoreFailurePolicy string
+
+const (
+	// RejectOnFailure refuses requests which need the store, failing closed
+	RejectOnFailure StoreFailurePolicy = "reject"
+	// AllowOnFailure lets requests through without counting or limiting them, failing open
+	AllowOnFailure StoreFailurePolicy = "allow"
+	// LocalOnFailure counts and limits requests in process, adding the counts to the store once it returns
+	LocalOnFailure StoreFailurePolicy = "local"
+)
+
+func (p StoreFailurePolicy) valid() bool {
+	return p == RejectOnFailure || p == AllowOnFailure || p == LocalOnFailure
+}
+
+type pendingCount struct {
+	amount int64
+	ttl    int
+}
+
+// StoreStatus reports whether the store is degraded and how often it has failed
+type StoreStatus struct {
+	Policy        StoreFailurePolicy `json:"policy"`
+	Degraded      bool               `json:"degraded"`
+	DegradedSince *time.Time         `json:"degraded_since,omitempty"`
+	Failures      int64              `json:"failures"`
+	Pending       int                `json:"pending"`
+	Reconciled    int64              `json:"reconciled"`
+}
+
+// failoverStore applies a StoreFailurePolicy to the counters and rate limits of another store.
+// Once an operation fails the store is considered degraded, skipping it until a ping succeeds
+type failoverStore struct {
+	Store
+	policy StoreFailurePolicy
+
+	local   *MemoryStore
+	pending map[string]*pendingCount
+
+	degradedSince time.Time
+	failures      int64
+	reconciled    int64
+	mutex         sync.Mutex
+}
+
+func newFailoverStore(store Store, policy StoreFailurePolicy) *failoverStore {
+	local, _ := NewMemoryStore("")
+	return &failoverStore{
+		Store:   store,
+		policy:  policy,
+		local:   local,
+		pending: make(map[string]*pendingCount),
+	}
+}
+
+// parseStoreFailurePolicy reads the failure policy from the environment, defaulting to rejecting requests
+func parseStoreFailurePolicy() (StoreFailurePolicy, error) {
+	policy := StoreFailurePolicy(os.Getenv(storeFailureVar))
+	if policy == "" {
+		return RejectOnFailure, nil
+	}
+	if !policy.valid() {
+		return "", fmt.Errorf("%s must be reject, allow or local, got %q", storeFailureVar, policy)
+	}
+	return policy, nil
+}
+
+func loadStoreFailurePolicy() StoreFailurePolicy {
+	policy, err := parseStoreFailurePolicy()
+	if err != nil {
+		panic(fmt.Sprintf("Failed to parse store failure policy : %+v", err))
+	}
+	return policy
+}
+
+func (f *failoverStore) degraded() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return !f.degradedSince.IsZero()
+}
+
+// fail records a failed operation, starting to watch for the store returning if it wasn't already degraded
+func (f *failoverStore) fail(err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.failures++
+	if !f.degradedSince.IsZero() {
+		return
+	}
+	f.degradedSince = time.Now()
+	metrics.storeDegraded.set(1)
+	storeLog.Warnf("Store unavailable, continuing degraded with the %s policy : %+v", f.policy, err)
+	go f.recover()
+}
+
+func (f *failoverStore) recover() {
+	for {
+		time.Sleep(storeRecoveryInterval)
+		if err := f.Store.Ping(); err != nil {
+			continue
+		}
+		if f.reconcile() {
+			return
+		}
+	}
+}
+
+// reconcile adds the counts made while degraded to the store, returning if all made it. Counts
+// made while reconciling are left pending for the next attempt
+func (f *failoverStore) reconcile() bool {
+	f.mutex.Lock()
+	counts := make(map[string]pendingCount)
+	for key, count := range f.pending {
+		counts[key] = *count
+	}
+	f.mutex.Unlock()
+
+	for key, count := range counts {
+		if _, err := f.Store.IncrBy(key, count.amount, count.ttl); err != nil {
+			storeLog.Errorf("Error occured reconciling local counters, staying degraded : %+v", err)
+			return false
+		}
+
+		f.mutex.Lock()
+		f.pending[key].amount -= count.amount
+		if f.pending[key].amount == 0 {
+			delete(f.pending, key)
+		}
+		f.reconciled++
+		metrics.storeReconciled.add(1)
+		metrics.storePending.set(float64(len(f.pending)))
+		f.mutex.Unlock()
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if len(f.pending) > 0 {
+		return false
+	}
+	storeLog.Infof("Store available again after %s", time.Since(f.degradedSince).Round(time.Second))
+	f.degradedSince = time.Time{}
+	f.local, _ = NewMemoryStore("")
+	metrics.storeDegraded.set(0)
+	return true
+}
+
+func (f *failoverStore) status() StoreStatus {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	status := StoreStatus{
+		Policy:     f.policy,
+		Degraded:   !f.degradedSince.IsZero(),
+		Failures:   f.failures,
+		Pending:    len(f.pending),
+		Reconciled: f.reconciled,
+	}
+	if status.Degraded {
+		since := f.degradedSince
+		status.DegradedSince = &since
+	}
+	return status
+}
+
+func (f *failoverStore) localStore() *MemoryStore {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.local
+}
+
+// IncrBy increments the counter, keeping it locally to add to the store later when degraded
+func (f *failoverStore) IncrBy(key string, amount int64, ttl int) (int64, error) {
+	for {
+		var err error
+		if !f.degraded() {
+			var value int64
+			if value, err = f.Store.IncrBy(key, amount, ttl); err == nil {
+				return value, nil
+			}
+			f.fail(err)
+		}
+
+		switch f.policy {
+		case AllowOnFailure:
+			return 0, nil
+		case LocalOnFailure:
+			// Pending counts are only reconciled while degraded, so the store is tried again
+			// if it recovered since it was skipped
+			f.mutex.Lock()
+			if f.degradedSince.IsZero() {
+				f.mutex.Unlock()
+				continue
+			}
+			if _, ok := f.pending[key]; !ok {
+				f.pending[key] = &pendingCount{}
+			}
+			f.pending[key].amount += amount
+			f.pending[key].ttl = ttl
+			metrics.storePending.set(float64(len(f.pending)))
+			value, err := f.local.IncrBy(key, amount, ttl)
+			f.mutex.Unlock()
+			return value, err
+		}
+		return 0, f.unavailable(err)
+	}
+}
+
+// GetCounters reads the counters, only counting what happened locally when degraded
+func (f *failoverStore) GetCounters(keys ...string) ([]int64, error) {
+	var err error
+	if !f.degraded() {
+		var counters []int64
+		if counters, err = f.Store.GetCounters(keys...); err == nil {
+			return counters, nil
+		}
+		f.fail(err)
+	}
+
+	switch f.policy {
+	case AllowOnFailure:
+		return make([]int64, len(keys)), nil
+	case LocalOnFailure:
+		return f.localStore().GetCounters(keys...)
+	}
+	return nil, f.unavailable(err)
+}
+
+// TakeToken takes a token from the bucket, using a local bucket when degraded
+func (f *failoverStore) TakeToken(key string, rate float64, burst int64) (bool, time.Duration, error) {
+	var err error
+	if !f.degraded() {
+		var allowed bool
+		var wait time.Duration
+		if allowed, wait, err = f.Store.TakeToken(key, rate, burst); err == nil {
+			return allowed, wait, nil
+		}
+		f.fail(err)
+	}
+
+	switch f.policy {
+	case AllowOnFailure:
+		return true, 0, nil
+	case LocalOnFailure:
+		return f.localStore().TakeToken(key, rate, burst)
+	}
+	return false, 0, f.unavailable(err)
+}
+
+func (f *failoverStore) unavailable(err error) error {
+	if err == nil {
+		return fmt.Errorf("store unavailable")
+	}
+	return fmt.Errorf("store unavailable: %v", err)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// flakyStore is a memory store which can be taken down to simulate an outage
+type flakyStore struct {
+	*MemoryStore
+	down bool
+}
+
+func (f *flakyStore) IncrBy(key string, amount int64, ttl int) (int64, error) {
+	if f.down {
+		return 0, fmt.Errorf("connection refused")
+	}
+	return f.MemoryStore.IncrBy(key, amount, ttl)
+}
+
+func (f *flakyStore) GetCounters(keys ...string) ([]int64, error) {
+	if f.down {
+		return nil, fmt.Errorf("connection refused")
+	}
+	return f.MemoryStore.GetCounters(keys...)
+}
+
+func (f *flakyStore) Get(key string) ([]byte, error) {
+	if f.down {
+		return nil, fmt.Errorf("connection refused")
+	}
+	return f.MemoryStore.Get(key)
+}
+
+func newFlakyStore() *flakyStore {
+	store, _ := NewMemoryStore("")
+	return &flakyStore{MemoryStore: store, down: true}
+}
+
+func TestFailoverStorePolicies(t *testing.T) {
+	rejecting := newFailoverStore(newFlakyStore(), RejectOnFailure)
+	if _, err := rejecting.GetCounters("counter"); err == nil {
+		t.Fatalf("Expected reject policy to return an error")
+	}
+	if !rejecting.status().Degraded || rejecting.status().Failures != 1 {
+		t.Fatalf("Expected store to be degraded after a failure : %+v", rejecting.status())
+	}
+
+	allowing := newFailoverStore(newFlakyStore(), AllowOnFailure)
+	counters, err := allowing.GetCounters("counter", "other")
+	if err != nil || len(counters) != 2 || counters[0] != 0 {
+		t.Fatalf("Expected allow policy to return empty counters but got %v : %+v", counters, err)
+	}
+	if _, err := allowing.IncrBy("counter", 1, 60); err != nil {
+		t.Fatalf("Expected allow policy to ignore failed increments but got %+v", err)
+	}
+
+	config := AuthConfig{ServiceName: "praxis"}
+	err = config.checkLimits(rejecting, &AuthWithLimit{ID: "limited", Limit: 10})
+	if authErr, ok := err.(*authError); !ok || authErr.Status != http.StatusServiceUnavailable || authErr.RetryAfter <= 0 {
+		t.Fatalf("Expected limits to be unavailable when rejecting but got %+v", err)
+	}
+	if err := config.checkLimits(allowing, &AuthWithLimit{ID: "limited", Limit: 10}); err != nil {
+		t.Fatalf("Expected limits to be skipped when allowing but got %+v", err)
+	}
+}
+
+func TestKeyLookupStoreUnavailable(t *testing.T) {
+	flaky := newFlakyStore()
+	config := AuthConfig{ServiceName: "praxis", Keys: NewKeySet(defaultAuthKeys)}
+
+	req, _ := http.NewRequest("GET", "/session", nil)
+	req.Header.Set(authKeyHeader, "stored.secret")
+	_, err := config.authorize(flaky, req)
+	if authErr, ok := err.(*authError); !ok || authErr.Status != http.StatusServiceUnavailable || authErr.RetryAfter <= 0 {
+		t.Fatalf("Expected stored key lookup to be unavailable but got %+v", err)
+	}
+
+	flaky.down = false
+	_, err = config.authorize(flaky, req)
+	if authErr, ok := err.(*authError); !ok || authErr.Status != http.StatusForbidden {
+		t.Fatalf("Expected a missing key to be forbidden but got %+v", err)
+	}
+}
+
+func TestFailoverStoreReconcile(t *testing.T) {
+	flaky := newFlakyStore()
+	store := newFailoverStore(flaky, LocalOnFailure)
+
+	store.IncrBy("counter", 2, 60)
+	store.IncrBy("counter", 3, 60)
+	if counters, err := store.GetCounters("counter"); err != nil || counters[0] != 5 {
+		t.Fatalf("Expected local counter of %d but got %v : %+v", 5, counters, err)
+	}
+	if store.status().Pending != 1 {
+		t.Fatalf("Expected a pending counter : %+v", store.status())
+	}
+
+	if store.reconcile() {
+		t.Fatalf("Expected reconcile to fail while the store is down")
+	}
+
+	flaky.down = false
+	flaky.MemoryStore.IncrBy("counter", 10, 60)
+	if !store.reconcile() {
+		t.Fatalf("Expected reconcile to succeed once the store returns")
+	}
+	if store.status().Degraded || store.status().Pending != 0 {
+		t.Fatalf("Expected store to no longer be degraded : %+v", store.status())
+	}
+	if counters, _ := store.GetCounters("counter"); counters[0] != 15 {
+		t.Fatalf("Expected reconciled counter of %d but got %d", 15, counters[0])
+	}
+
+	// Increments after recovering go straight to the store rather than being left pending
+	if value, err := store.IncrBy("counter", 1, 60); err != nil || value != 16 || store.status().Pending != 0 {
+		t.Fatalf("Expected the increment to reach the store but got %d : %+v", value, err)
+	}
+
+	var out bytes.Buffer
+	metrics.WriteTo(&out)
+	for _, line := range []string{"praxis_store_degraded 0", "praxis_store_pending_counters 0", "praxis_store_reconciled_total "} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("Expected %q in metrics :\n%s", line, out.String())
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	historyPerSessionVar = "HISTORY_PER_SESSION"
+	historyPerKeyVar     = "HISTORY_PER_KEY"
+
+	defaultHistoryPerSession = 500
+	defaultHistoryPerKey     = 5000
+
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+)
+
+// historyRing keeps the most recent entries, overwriting the oldest once full
+type historyRing struct {
+	entries []*accessEntry
+	next    int
+}
+
+func (r *historyRing) add(entry *accessEntry, size int) {
+	if len(r.entries) < size {
+		r.entries = append(r.entries, entry)
+		return
+	}
+	r.entries[r.next] = entry
+	r.next = (r.next + 1) % size
+}
+
+// remove drops the entries matching `drop`, keeping the rest in order
+func (r *historyRing) remove(drop func(entry *accessEntry) bool) {
+	kept := []*accessEntry{}
+	count := len(r.entries)
+	for i := 0; i < count; i++ {
+		if entry := r.entries[(r.next+i)%count]; !drop(entry) {
+			kept = append(kept, entry)
+		}
+	}
+	r.entries, r.next = kept, 0
+}
+
+// newestFirst calls `visit` with each entry from the most recent until it returns false
+func (r *historyRing) newestFirst(visit func(entry *accessEntry) bool) {
+	count := len(r.entries)
+	for i := 0; i < count; i++ {
+		if !visit(r.entries[(r.next-1-i+2*count)%count]) {
+			return
+		}
+	}
+}
+
+// RequestHistory keeps the most recent requests of each open session and of each key, so what
+// happened to a failing crawler can be looked into afterwards. Each instance keeps the history
+// of the sessions it serves
+type RequestHistory struct {
+	perSession int
+	perKey     int
+
+	sessions map[int]*historyRing
+	keys     map[string]*historyRing
+	mutex    sync.RWMutex
+}
+
+// NewRequestHistory keeps up to `perSession` requests of each session and `perKey` of each key,
+// either is not kept when zero
+func NewRequestHistory(perSession, perKey int) *RequestHistory {
+	return &RequestHistory{
+		perSession: perSession,
+		perKey:     perKey,
+		sessions:   make(map[int]*historyRing),
+		keys:       make(map[string]*historyRing),
+	}
+}
+
+// parseHistorySize reads how many requests to keep from `name`, which can't be negative
+func parseHistorySize(name string, fallback int) (int, error) {
+	size, err := envInt(name, fallback)
+	if err != nil {
+		return 0, err
+	}
+	if size < 0 {
+		return 0, fmt.Errorf("%s can't be negative, got %d", name, size)
+	}
+	return size, nil
+}
+
+// loadRequestHistory sizes the history from HISTORY_PER_SESSION and HISTORY_PER_KEY
+func loadRequestHistory() *RequestHistory {
+	perSession, err := parseHistorySize(historyPerSessionVar, defaultHistoryPerSession)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to parse request history : %+v", err))
+	}
+	perKey, err := parseHistorySize(historyPerKeyVar, defaultHistoryPerKey)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to parse request history : %+v", err))
+	}
+	return NewRequestHistory(perSession, perKey)
+}
+
+// record keeps a finished request, requests refused before their key was known are kept
+// under the empty key
+func (h *RequestHistory) record(entry *accessEntry) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.perSession > 0 {
+		ring, ok := h.sessions[entry.Session]
+		if !ok {
+			ring = &historyRing{}
+			h.sessions[entry.Session] = ring
+		}
+		ring.add(entry, h.perSession)
+	}
+	if h.perKey > 0 {
+		ring, ok := h.keys[entry.Key]
+		if !ok {
+			ring = &historyRing{}
+			h.keys[entry.Key] = ring
+		}
+		ring.add(entry, h.perKey)
+	}
+}
+
+// forget drops the history of a closed session, including its requests kept for its key, as
+// its id may be handed to another key
+func (h *RequestHistory) forget(sessionID int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	delete(h.sessions, sessionID)
+	for _, ring := range h.keys {
+		ring.remove(func(entry *accessEntry) bool {
+			return entry.Session == sessionID
+		})
+	}
+}
+
+// search returns the most recent requests matching `filter`, newest first
+func (h *RequestHistory) search(filter historyFilter) []*accessEntry {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	// Open sessions keep more of their own requests than their key does
+	rings := []*historyRing{}
+	if filter.hasSession && h.perSession > 0 {
+		if ring, ok := h.sessions[filter.session]; ok {
+			rings = append(rings, ring)
+		}
+	} else if filter.hasKey {
+		if ring, ok := h.keys[filter.key]; ok {
+			rings = append(rings, ring)
+		}
+	} else {
+		for _, ring := range h.keys {
+			rings = append(rings, ring)
+		}
+	}
+
+	found := []*accessEntry{}
+	for _, ring := range rings {
+		matched := 0
+		ring.newestFirst(func(entry *accessEntry) bool {
+			if filter.matches(entry) {
+				found = append(found, entry)
+				matched++
+			}
+			return matched < filter.limit
+		})
+	}
+	return newestEntries(found, filter.limit)
+}
+
+// newestEntries sorts entries newest first, keeping at most `limit`
+func newestEntries(entries []*accessEntry, limit int) []*accessEntry {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Time.After(entries[j].Time)
+	})
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries
+}
+
+// historyFilter narrows down a search of the request history
+type historyFilter struct {
+	session    int
+	hasSession bool
+	key        string
+	hasKey     bool
+
+	since, until time.Time
+	// host is matched as a glob against the host requested, without its port
+	host string
+	// statuses are exact statuses such as 407, or classes such as 5xx
+	statuses []string
+	limit    int
+}
+
+func (f *historyFilter) matches(entry *accessEntry) bool {
+	if f.hasSession && entry.Session != f.session {
+		return false
+	}
+	if f.hasKey && entry.Key != f.key {
+		return false
+	}
+	if !f.since.IsZero() && entry.Time.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && entry.Time.After(f.until) {
+		return false
+	}
+	if f.host != "" {
+		host, _, err := net.SplitHostPort(entry.Host)
+		if err != nil {
+			host = entry.Host
+		}
+		if matched, _ := path.Match(f.host, strings.ToLower(host)); !matched {
+			return false
+		}
+	}
+	if len(f.statuses) > 0 {
+		status := strconv.Itoa(entry.Status)
+		for _, pattern := range f.statuses {
+			if matched, _ := path.Match(strings.Replace(pattern, "x", "?", -1), status); matched {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// historyTime parses a time to search from or until, either as RFC3339 or as a duration ago
+func historyTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if ago, err := time.ParseDuration(value); err == nil && ago >= 0 {
+		return now.Add(-ago), nil
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid time %s, expected RFC3339 or a duration such as 15m", value)
+	}
+	return parsed, nil
+}
+
+var historyStatusPattern = regexp.MustCompile(`^[1-5][0-9x]{2}$`)
+
+// parseHistoryFilter reads a search of the request history from the query
+func parseHistoryFilter(context *gin.Context) (historyFilter, error) {
+	filter := historyFilter{limit: defaultHistoryLimit, host: strings.ToLower(context.Query("host"))}
+	now := time.Now()
+
+	var err error
+	if filter.since, err = historyTime(context.Query("since"), now); err != nil {
+		return filter, err
+	}
+	if filter.until, err = historyTime(context.Query("until"), now); err != nil {
+		return filter, err
+	}
+	if _, err := path.Match(filter.host, ""); err != nil {
+		return filter, fmt.Errorf("Invalid host pattern %s", filter.host)
+	}
+	if statuses := context.Query("status"); statuses != "" {
+		for _, status := range strings.Split(strings.ToLower(statuses), ",") {
+			status = strings.TrimSpace(status)
+			if !historyStatusPattern.MatchString(status) {
+				return filter, fmt.Errorf("Invalid status %s, expected a status such as 407 or a class such as 5xx", status)
+			}
+			filter.statuses = append(filter.statuses, status)
+		}
+	}
+	if session := context.Query("session"); session != "" {
+		if filter.session, err = strconv.Atoi(session); err != nil {
+			return filter, fmt.Errorf("Invalid session %s", session)
+		}
+		filter.hasSession = true
+	}
+	if key, ok := context.GetQuery("key"); ok {
+		filter.key, filter.hasKey = key, true
+	}
+	if limit := context.Query("limit"); limit != "" {
+		if filter.limit, err = strconv.Atoi(limit); err != nil || filter.limit <= 0 {
+			return filter, fmt.Errorf("Invalid limit %s", limit)
+		}
+		if filter.limit > maxHistoryLimit {
+			filter.limit = maxHistoryLimit
+		}
+	}
+	return filter, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func historyEntry(session int, key, host string, status int, at time.Time) *accessEntry {
+	return &accessEntry{Session: session, Key: key, Host: host, Status: status, Time: at}
+}
+
+func TestRequestHistoryBounded(t *testing.T) {
+	history := NewRequestHistory(2, 3)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		history.record(historyEntry(3001, "crawler", "example.com", 200+i, now.Add(time.Duration(i)*time.Second)))
+	}
+	history.record(historyEntry(3002, "crawler", "example.com", 404, now.Add(5*time.Second)))
+
+	found := history.search(historyFilter{session: 3001, hasSession: true, limit: 10})
+	if len(found) != 2 || found[0].Status != 202 || found[1].Status != 201 {
+		t.Fatalf("Expected the 2 newest requests of the session but got %+v", found)
+	}
+	found = history.search(historyFilter{key: "crawler", hasKey: true, limit: 10})
+	if len(found) != 3 || found[0].Status != 404 || found[2].Status != 201 {
+		t.Fatalf("Expected the 3 newest requests of the key but got %+v", found)
+	}
+
+	if found := history.search(historyFilter{limit: 1}); len(found) != 1 || found[0].Status != 404 {
+		t.Fatalf("Expected the limit to keep the newest request but got %+v", found)
+	}
+
+	// Closed sessions are forgotten entirely, as their id may be reused by another key
+	history.forget(3001)
+	if found := history.search(historyFilter{session: 3001, hasSession: true, limit: 10}); len(found) != 0 {
+		t.Fatalf("Expected nothing of the closed session but got %+v", found)
+	}
+	found = history.search(historyFilter{key: "crawler", hasKey: true, limit: 10})
+	if len(found) != 1 || found[0].Session != 3002 {
+		t.Fatalf("Expected the closed sessions requests dropped from its key but got %+v", found)
+	}
+
+	// A reused id starts with an empty history rather than another keys requests
+	history.record(historyEntry(3002, "crawler", "example.com", 200, now.Add(6*time.Second)))
+	history.forget(3002)
+	if found := history.search(historyFilter{session: 3002, hasSession: true, key: "other", hasKey: true, limit: 10}); len(found) != 0 {
+		t.Fatalf("Expected a reused session id to have no history but got %+v", found)
+	}
+}
+
+func TestHistoryFilter(t *testing.T) {
+	parse := func(query string) (historyFilter, error) {
+		context, _ := gin.CreateTestContext(httptest.NewRecorder())
+		context.Request = httptest.NewRequest(http.MethodGet, "/requests?"+query, nil)
+		return parseHistoryFilter(context)
+	}
+
+	now := time.Now()
+	filter, err := parse("host=*.Example.com&status=407,5xx&since=10m")
+	if err != nil {
+		t.Fatalf("Unexpected error parsing filter : %+v", err)
+	}
+	cases := []struct {
+		entry   *accessEntry
+		matches bool
+	}{
+		{historyEntry(3001, "crawler", "shop.example.com:443", 407, now), true},
+		{historyEntry(3001, "crawler", "shop.example.com", 502, now), true},
+		{historyEntry(3001, "crawler", "shop.example.com", 404, now), false},
+		{historyEntry(3001, "crawler", "example.org", 502, now), false},
+		{historyEntry(3001, "crawler", "shop.example.com", 502, now.Add(-time.Hour)), false},
+	}
+	for _, c := range cases {
+		if filter.matches(c.entry) != c.matches {
+			t.Errorf("Expected %+v matching to be %t", c.entry, c.matches)
+		}
+	}
+
+	if filter, err := parse("limit=5000&key="); err != nil || filter.limit != maxHistoryLimit || !filter.hasKey || filter.key != "" {
+		t.Fatalf("Expected the limit to be capped and the empty key kept but got %+v : %+v", filter, err)
+	}
+	for _, bad := range []string{"status=4xxx", "since=yesterday", "limit=0", "session=abc", "host=["} {
+		if _, err := parse(bad); err == nil {
+			t.Errorf("Expected %s to be refused", bad)
+		}
+	}
+}
+
+func TestProxyHistoryUpstreamError(t *testing.T) {
+	endProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(upstreamErrorHeader, "Could not resolve host")
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer endProxy.Close()
+
+	history := NewRequestHistory(10, 10)
+	underTest := Proxy{
+		URL:        endProxy.URL,
+		upperBound: 8089,
+		lowerBound: 8089,
+		freePorts:  makeRange(8089, 8089),
+	}
+	underTest.Record(history.record)
+	id, proxy, err := underTest.Create(8089)
+	if err != nil {
+		t.Fatalf("Error encountered creating proxy : %+v", err)
+	}
+	defer proxy.Close()
+
+	time.Sleep(1 * time.Second)
+
+	client := &http.Client{Transport: &http.Transport{
+		Proxy: func(req *http.Request) (*url.URL, error) {
+			return url.Parse("http://localhost:8089")
+		},
+	}}
+	resp, err := client.Get("http://praxis.invalid/missing")
+	if err != nil {
+		t.Fatalf("Unexpected error proxying : %+v", err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	found := history.search(historyFilter{session: id, hasSession: true, statuses: []string{"5xx"}, limit: 10})
+	if len(found) != 1 || found[0].Status != http.StatusBadGateway || found[0].UpstreamError != "Could not resolve host" || found[0].URL != "http://praxis.invalid/missing" {
+		t.Fatalf("Expected the failed request with the end proxies error but got %+v", found)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	keyIDBytes     = 6
+	keySecretBytes = 24
+	keySaltBytes   = 16
+	keyHashScheme  = "sha256"
+)
+
+// Auth keys are presented as "<id>.<secret>", the id is public and used to look the key
+// up while only a salted hash of the secret is ever stored
+
+func splitAuthKey(key string) (string, string) {
+	parts := strings.SplitN(key, ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", ""
+	}
+	return parts[0], parts[1]
+}
+
+// authKeyID returns only the public id of a presented key so it is safe to log
+func authKeyID(key string) string {
+	id, _ := splitAuthKey(key)
+	if id == "" {
+		return "<malformed>"
+	}
+	return id
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("Unable to generate random bytes : %+v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashSecret(salt, secret string) string {
+	sum := sha256.Sum256([]byte(salt + secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// hashAuthKeySecret produces a KeyHash in the form "sha256$<salt>$<hash>"
+func hashAuthKeySecret(secret string) (string, error) {
+	salt, err := randomHex(keySaltBytes)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join([]string{keyHashScheme, salt, hashSecret(salt, secret)}, "$"), nil
+}
+
+// generateAuthKey creates a new random key, returning the full key to hand out once along
+// with its id and hash for storage
+func generateAuthKey() (key, id, keyHash string, err error) {
+	id, err = randomHex(keyIDBytes)
+	if err != nil {
+		return "", "", "", err
+	}
+	secret, err := randomHex(keySecretBytes)
+	if err != nil {
+		return "", "", "", err
+	}
+	keyHash, err = hashAuthKeySecret(secret)
+	if err != nil {
+		return "", "", "", err
+	}
+	return id + "." + secret, id, keyHash, nil
+}
+
+// matches compares the secret against the stored hash in constant time
+func (k *AuthWithLimit) matches(secret string) bool {
+	parts := strings.Split(k.KeyHash, "$")
+	if len(parts) != 3 || parts[0] != keyHashScheme {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashSecret(parts[1], secret)), []byte(parts[2])) == 1
+}
+
+// KeySet holds the keys from the configuration, which are replaced as a whole on reload
+type KeySet struct {
+	keys  []AuthWithLimit
+	mutex sync.RWMutex
+}
+
+// NewKeySet creates a set holding `keys`
+func NewKeySet(keys []AuthWithLimit) *KeySet {
+	return &KeySet{keys: keys}
+}
+
+// Set replaces the keys, requests already authorized keep the key they were authorized with
+func (s *KeySet) Set(keys []AuthWithLimit) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.keys = keys
+}
+
+func (s *KeySet) get() []AuthWithLimit {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.keys
+}
+
+// configuredKeys returns the keys from the configuration rather than those created through the api
+func (c *AuthConfig) configuredKeys() []AuthWithLimit {
+	if c.Keys != nil {
+		return c.Keys.get()
+	}
+	return c.AuthKeys
+}
+
+func (c *AuthConfig) storedKey(id string) string {
+	return fmt.Sprintf("keys:%s:%s", c.ServiceName, id)
+}
+
+// keyByID finds a key by its id, checking the configured keys before those created through the api.
+// It returns nil if there is no such key, and an error only when the store couldn't be read
+func (c *AuthConfig) keyByID(store Store, id string) (*AuthWithLimit, error) {
+	for _, i := range c.configuredKeys() {
+		if i.ID == id {
+			return &i, nil
+		}
+	}
+
+	data, err := store.Get(c.storedKey(id))
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	keyConfig := &AuthWithLimit{}
+	if err := json.Unmarshal(data, keyConfig); err != nil {
+		authLog.Warnf("Unable to parse stored key %s : %+v", id, err)
+		return nil, nil
+	}
+	return keyConfig, nil
+}
+
+// keyConfig returns the configuration for a presented key, or nil if it isn't valid
+func (c *AuthConfig) keyConfig(store Store, key string) (*AuthWithLimit, error) {
+	id, secret := splitAuthKey(key)
+	if id == "" {
+		return nil, nil
+	}
+
+	keyConfig, err := c.keyByID(store, id)
+	if err != nil || keyConfig == nil || !keyConfig.matches(secret) {
+		return nil, err
+	}
+	return keyConfig, nil
+}
+
+// allKeys returns the configured keys followed by those created through the api
+func (c *AuthConfig) allKeys(store Store) ([]*AuthWithLimit, error) {
+	keys := []*AuthWithLimit{}
+	configured := c.configuredKeys()
+	for i := range configured {
+		keys = append(keys, &configured[i])
+	}
+
+	stored, err := store.GetKeys(escapePattern(c.storedKey("")) + "*")
+	if err != nil {
+		return nil, err
+	}
+	for _, storedKey := range stored {
+		keyConfig, err := c.keyByID(store, strings.TrimPrefix(storedKey, c.storedKey("")))
+		if err != nil {
+			return nil, err
+		}
+		if keyConfig != nil {
+			keys = append(keys, keyConfig)
+		}
+	}
+	return keys, nil
+}
+
+// validate checks the settings of a key, other than its id and hash
+func (k *AuthWithLimit) validate() error {
+	if !k.Window.valid() {
+		return fmt.Errorf("Unknown window %s", k.Window)
+	}
+	if _, err := k.location(); err != nil {
+		return err
+	}
+	if k.Limit < 0 || k.RateLimit < 0 || k.Burst < 0 || k.DailyBytes < 0 || k.MonthlyBytes < 0 {
+		return fmt.Errorf("Limits can not be negative")
+	}
+	if err := k.validateAccess(); err != nil {
+		return err
+	}
+	if _, err := parseCIDRs(k.AllowedCIDRs); err != nil {
+		return err
+	}
+	if k.Destinations != nil {
+		if err := k.Destinations.validate(); err != nil {
+			return err
+		}
+	}
+	if err := validateWebhookURL(k.WebhookURL); err != nil {
+		return err
+	}
+	if k.Anomaly != nil {
+		return k.Anomaly.validate()
+	}
+	return nil
+}
+
+// KeyHandlers provides admin handlers to create, list and revoke keys kept in the store
+func KeyHandlers(config AuthConfig, store Store) (create, list, revoke gin.HandlerFunc) {
+	create = func(context *gin.Context) {
+		keyConfig := AuthWithLimit{}
+		if err := context.BindJSON(&keyConfig); err != nil {
+			return
+		}
+		if err := keyConfig.validate(); err != nil {
+			context.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		key, id, keyHash, err := generateAuthKey()
+		if err != nil {
+			context.AbortWithError(http.StatusInternalServerError, fmt.Errorf("Unable to create key : %+v", err))
+			return
+		}
+		keyConfig.ID = id
+		keyConfig.KeyHash = keyHash
+
+		data, _ := json.Marshal(keyConfig)
+		if err := store.Set(config.storedKey(id), data); err != nil {
+			context.AbortWithError(http.StatusInternalServerError, fmt.Errorf("Unable to store key : %+v", err))
+			return
+		}
+
+		authLog.Infof("Created key %s", id)
+		// This is the only time the full key is available
+		context.JSON(http.StatusOK, gin.H{"id": id, "key": key})
+	}
+
+	list = func(context *gin.Context) {
+		keys, err := config.allKeys(store)
+		if err != nil {
+			context.AbortWithError(http.StatusInternalServerError, fmt.Errorf("Unable to list keys : %+v", err))
+			return
+		}
+
+		listed := []AuthWithLimit{}
+		for _, keyConfig := range keys {
+			k := *keyConfig
+			k.KeyHash = ""
+			listed = append(listed, k)
+		}
+		context.JSON(http.StatusOK, listed)
+	}
+
+	revoke = func(context *gin.Context) {
+		id := context.Params.ByName("id")
+		exists, err := store.Exists(config.storedKey(id))
+		if err != nil {
+			context.AbortWithError(http.StatusInternalServerError, fmt.Errorf("Unable to revoke key : %+v", err))
+			return
+		}
+		if !exists {
+			context.JSON(http.StatusOK, gin.H{"id": id, "status": "not found"})
+			return
+		}
+		if err := store.Delete(config.storedKey(id)); err != nil {
+			context.AbortWithError(http.StatusInternalServerError, fmt.Errorf("Unable to revoke key : %+v", err))
+			return
+		}
+
+		authLog.Infof("Revoked key %s", id)
+		context.JSON(http.StatusOK, gin.H{"id": id, "status": "revoked"})
+	}
+
+	return create, list, revoke
+}
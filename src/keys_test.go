@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGenerateAuthKey(t *testing.T) {
+	key, id, keyHash, err := generateAuthKey()
+	if err != nil {
+		t.Fatalf("Unexpected error generating key : %+v", err)
+	}
+
+	if !strings.HasPrefix(key, id+".") {
+		t.Fatalf("Expected key %s to start with its id %s", key, id)
+	}
+	if strings.Contains(keyHash, key[len(id)+1:]) {
+		t.Fatalf("Expected the hash %s not to contain the secret", keyHash)
+	}
+
+	keyConfig := AuthWithLimit{ID: id, KeyHash: keyHash}
+	_, secret := splitAuthKey(key)
+	if !keyConfig.matches(secret) {
+		t.Fatalf("Expected generated secret to match its hash")
+	}
+	if keyConfig.matches(secret + "x") {
+		t.Fatalf("Expected a different secret not to match")
+	}
+}
+
+func TestSplitAuthKey(t *testing.T) {
+	id, secret := splitAuthKey("testing.testingapikey")
+	if id != "testing" || secret != "testingapikey" {
+		t.Fatalf("Unexpected split of %s and %s", id, secret)
+	}
+
+	for _, malformed := range []string{"", "testingapikey", ".testingapikey", "testing."} {
+		if id, _ := splitAuthKey(malformed); id != "" {
+			t.Fatalf("Expected %q to be malformed but got id %s", malformed, id)
+		}
+	}
+
+	if authKeyID("testing.testingapikey") != "testing" {
+		t.Fatalf("Expected only the id to be logged")
+	}
+}
+
+func TestMatchesRejectsUnknownScheme(t *testing.T) {
+	keyConfig := AuthWithLimit{ID: "testing", KeyHash: "md5$salt$hash"}
+	if keyConfig.matches("testingapikey") {
+		t.Fatalf("Expected unknown hash scheme not to match")
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	logLevelVar  = "LOG_LEVEL"
+	logFormatVar = "LOG_FORMAT"
+
+	jsonLogFormat = "json"
+	textLogFormat = "text"
+
+	requestIDHeader  = "X-Request-Id"
+	requestIDContext = "praxis-request-id"
+
+	redacted = "[REDACTED]"
+)
+
+// LogLevel is the severity of a log line, lines below the configured level are dropped
+type LogLevel int
+
+// Log levels, from the most to the least verbose
+const (
+	DebugLevel LogLevel = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l LogLevel) String() string {
+	if l < DebugLevel || l > ErrorLevel {
+		return "unknown"
+	}
+	return logLevelNames[l]
+}
+
+func parseLogLevel(name string) (LogLevel, error) {
+	for i, levelName := range logLevelNames {
+		if strings.EqualFold(name, levelName) {
+			return LogLevel(i), nil
+		}
+	}
+	return InfoLevel, fmt.Errorf("Unknown log level %s, expected debug, info, warn or error", name)
+}
+
+// Fields are attached to a log line, such as the session, key and request it is about
+type Fields map[string]interface{}
+
+// logOutput is shared by a logger and all of the loggers derived from it, so they are
+// all reconfigured together
+type logOutput struct {
+	level  LogLevel
+	format string
+	out    io.Writer
+
+	// secrets are redacted from every line, such as the upstream password
+	secrets []string
+	mutex   sync.RWMutex
+}
+
+// Logger writes leveled log lines as json or text, redacting credentials from them
+type Logger struct {
+	output    *logOutput
+	component string
+	fields    Fields
+
+	// verbose loggers write debug lines whatever the level, such as for a session being debugged
+	verbose bool
+}
+
+// NewLogger creates a logger writing json lines at info and above to `out`
+func NewLogger(out io.Writer) *Logger {
+	return &Logger{output: &logOutput{level: InfoLevel, format: jsonLogFormat, out: out}}
+}
+
+// logger is the root logger, standard library and goproxy logging is sent through it
+var logger = NewLogger(os.Stderr)
+
+// Configure changes the level, format and redacted secrets of the logger and all derived from it
+func (l *Logger) Configure(level LogLevel, format string, secrets ...string) {
+	l.output.mutex.Lock()
+	defer l.output.mutex.Unlock()
+
+	l.output.level = level
+	l.output.format = format
+	l.output.secrets = []string{}
+	for _, secret := range secrets {
+		// Very short values would redact too much of everything else
+		if len(secret) >= 4 {
+			l.output.secrets = append(l.output.secrets, secret)
+		}
+	}
+}
+
+// Component returns a logger for part of praxis, shown like the old `[PROXY]` prefixes
+func (l *Logger) Component(name string) *Logger {
+	return &Logger{output: l.output, component: name, fields: l.fields, verbose: l.verbose}
+}
+
+// With returns a logger adding `fields` to every line
+func (l *Logger) With(fields Fields) *Logger {
+	merged := Fields{}
+	for name, value := range l.fields {
+		merged[name] = value
+	}
+	for name, value := range fields {
+		merged[name] = value
+	}
+	return &Logger{output: l.output, component: l.component, fields: merged, verbose: l.verbose}
+}
+
+// Verbose returns a logger writing debug lines even when the level is above debug
+func (l *Logger) Verbose() *Logger {
+	return &Logger{output: l.output, component: l.component, fields: l.fields, verbose: true}
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) { l.logf(DebugLevel, format, args...) }
+func (l *Logger) Infof(format string, args ...interface{})  { l.logf(InfoLevel, format, args...) }
+func (l *Logger) Warnf(format string, args ...interface{})  { l.logf(WarnLevel, format, args...) }
+func (l *Logger) Errorf(format string, args ...interface{}) { l.logf(ErrorLevel, format, args...) }
+
+// Fatalf logs at the error level then exits
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	l.logf(ErrorLevel, format, args...)
+	os.Exit(1)
+}
+
+func (l *Logger) logf(level LogLevel, format string, args ...interface{}) {
+	l.output.mutex.RLock()
+	defer l.output.mutex.RUnlock()
+	if level < l.output.level && !l.verbose {
+		return
+	}
+
+	message := l.output.redact(fmt.Sprintf(format, args...))
+	names := make([]string, 0, len(l.fields))
+	for name := range l.fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var line bytes.Buffer
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	if l.output.format == textLogFormat {
+		fmt.Fprintf(&line, "%s %-5s ", now, strings.ToUpper(level.String()))
+		if l.component != "" {
+			fmt.Fprintf(&line, "[%s] ", strings.ToUpper(l.component))
+		}
+		line.WriteString(message)
+		for _, name := range names {
+			fmt.Fprintf(&line, " %s=%s", name, l.output.redact(fmt.Sprint(l.fields[name])))
+		}
+	} else {
+		line.WriteString(`{"time":`)
+		writeJSON(&line, now)
+		line.WriteString(`,"level":`)
+		writeJSON(&line, level.String())
+		if l.component != "" {
+			line.WriteString(`,"component":`)
+			writeJSON(&line, l.component)
+		}
+		line.WriteString(`,"msg":`)
+		writeJSON(&line, message)
+		for _, name := range names {
+			value := l.fields[name]
+			if text, ok := value.(string); ok {
+				value = l.output.redact(text)
+			} else if err, ok := value.(error); ok {
+				value = l.output.redact(err.Error())
+			}
+			line.WriteString(",")
+			writeJSON(&line, name)
+			line.WriteString(":")
+			writeJSON(&line, value)
+		}
+		line.WriteString("}")
+	}
+	line.WriteString("\n")
+
+	// Lines are written whole so concurrent lines never interleave
+	l.output.out.Write(line.Bytes())
+}
+
+func writeJSON(buffer *bytes.Buffer, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buffer.Write(data)
+}
+
+var (
+	// Basic and bearer credentials in Authorization and Proxy-Authorization headers, however they are printed
+	authorizationPattern = regexp.MustCompile(`(?i)(authorization["']?\s*[:=]\s*\[?["']?)(basic|bearer)\s+[^\s"'\],]+`)
+	// The secret half of <id>.<secret> keys sent as Auth-Key
+	authKeyPattern = regexp.MustCompile(`(?i)(auth-key["']?\s*[:=]\s*\[?["']?)([^\s"'\],.]+)\.[^\s"'\],]+`)
+	// Passwords in urls, such as redis://:<password>@host or an upstream with credentials
+	urlPasswordPattern = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://[^:/@\s]*):[^@/\s]+@`)
+)
+
+// redact removes credentials from a log line. The output must be locked
+func (o *logOutput) redact(text string) string {
+	text = authorizationPattern.ReplaceAllString(text, "${1}${2} "+redacted)
+	text = authKeyPattern.ReplaceAllString(text, "${1}${2}."+redacted)
+	text = urlPasswordPattern.ReplaceAllString(text, "${1}:"+redacted+"@")
+	for _, secret := range o.secrets {
+		text = strings.Replace(text, secret, redacted, -1)
+	}
+	return text
+}
+
+// redactHeaders copies `header` with credentials redacted, for logging whole requests
+func redactHeaders(header http.Header) http.Header {
+	copied := http.Header{}
+	for name, values := range header {
+		switch http.CanonicalHeaderKey(name) {
+		case proxyAuthHeader, "Authorization":
+			copied[name] = []string{redacted}
+		case authKeyHeader:
+			redactedValues := []string{}
+			for _, value := range values {
+				redactedValues = append(redactedValues, authKeyID(value)+"."+redacted)
+			}
+			copied[name] = redactedValues
+		default:
+			copied[name] = values
+		}
+	}
+	return copied
+}
+
+// logWriter adapts the logger to an io.Writer, logging each write as a line at `level`
+type logWriter struct {
+	logger *Logger
+	level  LogLevel
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	message := strings.TrimRight(string(p), "\n")
+	if message != "" {
+		w.logger.logf(w.level, "%s", message)
+	}
+	return len(p), nil
+}
+
+// Writer returns a writer logging each line written to it at `level`, such as for a *log.Logger
+func (l *Logger) Writer(level LogLevel) io.Writer {
+	return &logWriter{logger: l, level: level}
+}
+
+// rememberSecrets adds credentials to those already redacted without repeating any. Sessions keep
+// the upstream credentials they were created with, so credentials replaced by a reload are kept
+func rememberSecrets(secrets []string, more ...string) []string {
+	for _, secret := range more {
+		known := false
+		for _, existing := range secrets {
+			if existing == secret {
+				known = true
+				break
+			}
+		}
+		if !known {
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets
+}
+
+// configureLogging applies the logging configuration, sending the standard logger through it too
+func configureLogging(config LoggingConfig, secrets ...string) {
+	level, err := parseLogLevel(config.Level)
+	if config.Level == "" {
+		level, err = InfoLevel, nil
+		if config.Debug {
+			level = DebugLevel
+		}
+	}
+	if err != nil {
+		// The configuration is validated before it is applied, so this is not expected
+		level = InfoLevel
+	}
+	format := config.Format
+	if format == "" {
+		format = jsonLogFormat
+	}
+
+	logger.Configure(level, format, secrets...)
+	log.SetFlags(0)
+	log.SetOutput(logger.Writer(InfoLevel))
+}
+
+// Loggers for each part of praxis
+var (
+	apiLog       = logger.Component("api")
+	authLog      = logger.Component("auth")
+	authAPILog   = logger.Component("auth-api")
+	authProxyLog = logger.Component("auth-proxy")
+	anomalyLog   = logger.Component("anomaly")
+	clusterLog   = logger.Component("cluster")
+	configLog    = logger.Component("config")
+	proxyLog     = logger.Component("proxy")
+	rollupLog    = logger.Component("rollup")
+	storeLog     = logger.Component("store")
+	webhookLog   = logger.Component("webhook")
+)
+
+type requestIDContextKey struct{}
+
+// withRequestID tags a proxied request with a new request id for its log lines
+func withRequestID(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), requestIDContextKey{}, newRequestID()))
+}
+
+func requestIDFromRequest(req *http.Request) string {
+	requestID, _ := req.Context().Value(requestIDContextKey{}).(string)
+	return requestID
+}
+
+func newRequestID() string {
+	random := make([]byte, 8)
+	rand.Read(random)
+	return hex.EncodeToString(random)
+}
+
+// requestLogger logs each api request once it has been handled, tagging it with a request id
+// taken from X-Request-Id or generated, which is also sent back
+func requestLogger(apiLog *Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader(requestIDHeader)
+		if requestID == "" || len(requestID) > 64 {
+			requestID = newRequestID()
+		}
+		c.Set(requestIDContext, requestID)
+		c.Header(requestIDHeader, requestID)
+
+		started := time.Now()
+		c.Next()
+
+		fields := Fields{
+			"request_id": requestID,
+			"method":     c.Request.Method,
+			"path":       c.Request.URL.Path,
+			"status":     c.Writer.Status(),
+			"duration":   time.Since(started).Seconds(),
+			"client":     c.ClientIP(),
+		}
+		if keyConfig := authorizedKey(c); keyConfig != nil {
+			fields["key"] = keyConfig.ID
+		}
+		line := apiLog.With(fields)
+		switch {
+		case len(c.Errors) > 0 && c.Writer.Status() >= http.StatusInternalServerError:
+			line.Errorf("%s %s : %s", c.Request.Method, c.Request.URL.Path, c.Errors.String())
+		case len(c.Errors) > 0:
+			line.Warnf("%s %s : %s", c.Request.Method, c.Request.URL.Path, c.Errors.String())
+		default:
+			line.Infof("%s %s", c.Request.Method, c.Request.URL.Path)
+		}
+	}
+}
+
+// contextLogger returns a logger tagged with the api request being handled
+func contextLogger(apiLog *Logger, c *gin.Context) *Logger {
+	fields := Fields{"request_id": c.GetString(requestIDContext)}
+	if keyConfig := authorizedKey(c); keyConfig != nil {
+		fields["key"] = keyConfig.ID
+	}
+	return apiLog.With(fields)
+}
@@ -2,39 +2,161 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-var proxies = make(map[int]*http.Server)
+// session is a running proxy along with the id of the key which created it
+type session struct {
+	server *http.Server
+	owner  string
+}
+
 var (
-	redisServer *Redis
+	proxies = make(map[int]*session)
+	// proxiesMutex guards proxies along with the free ports of the proxy serving them, as both
+	// are used by concurrent api requests
+	proxiesMutex sync.RWMutex
 )
 
-func setupRouter(proxy Proxy, authEnabled bool) *gin.Engine {
-	router := gin.Default()
+// liveSession returns a session served by this instance
+func liveSession(id int) (*session, bool) {
+	proxiesMutex.RLock()
+	defer proxiesMutex.RUnlock()
+	value, ok := proxies[id]
+	return value, ok
+}
+
+// liveSessionIDs lists the sessions served by this instance in order
+func liveSessionIDs() []int {
+	proxiesMutex.RLock()
+	defer proxiesMutex.RUnlock()
+	ids := []int{}
+	for id := range proxies {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// reservePort takes a random free port for a new session, returning false when there are none left
+func reservePort(proxy *Proxy) (int, bool) {
+	proxiesMutex.Lock()
+	defer proxiesMutex.Unlock()
+	if len(proxy.freePorts) <= 0 {
+		return 0, false
+	}
+	portIndex := rand.Intn(len(proxy.freePorts))
+	port := proxy.freePorts[portIndex]
+	proxy.freePorts = remove(proxy.freePorts, portIndex)
+	return port, true
+}
+
+// releasePort hands back the port of a session which failed to start or has been closed
+func releasePort(proxy *Proxy, port int) {
+	proxiesMutex.Lock()
+	defer proxiesMutex.Unlock()
+	proxy.freePorts = append(proxy.freePorts, port)
+	metrics.sessionsChanged(len(proxies), len(proxy.freePorts))
+}
+
+// addSession registers a session started on a reserved port
+func addSession(proxy *Proxy, id int, value *session) {
+	proxiesMutex.Lock()
+	defer proxiesMutex.Unlock()
+	proxies[id] = value
+	metrics.sessionsChanged(len(proxies), len(proxy.freePorts))
+}
+
+// takeSession unregisters a session being closed, so only one of several concurrent closes gets it
+func takeSession(id int) (*session, bool) {
+	proxiesMutex.Lock()
+	defer proxiesMutex.Unlock()
+	value, ok := proxies[id]
+	delete(proxies, id)
+	return value, ok
+}
+
+// setupRouter builds the api, `store` is only used and needed when auth is enabled
+func setupRouter(proxy *Proxy, authEnabled bool, store Store, keys *KeySet) *gin.Engine {
+	router := gin.New()
+	router.Use(requestLogger(apiLog), gin.Recovery())
+
+	authConfig := AuthConfig{
+		Keys:               keys,
+		TokenSecret:        loadTokenSecret(),
+		ClientCertificates: loadClientCertificateKeys(),
+		TrustedProxies:     loadTrustedProxies(),
+		Webhooks:           loadWebhooks(),
+		SessionOwner:       liveSessionOwner,
+	}
+
+	proxy.Trust(authConfig.TrustedProxies)
+
+	// Replicas sharing a store coordinate session ids and ownership when clustered
+	cluster := loadCluster(store, &authConfig)
+	if cluster != nil {
+		proxy.UseSessionIDs(cluster.nextSessionID)
+	}
+
+	// Routes are only restricted by scope when auth is enabled
+	requireScope := func(scopes ...Scope) gin.HandlerFunc {
+		if !authEnabled {
+			return func(context *gin.Context) {}
+		}
+		if len(scopes) == 1 {
+			return RequireScope(scopes[0])
+		}
+		return RequireAnyScope(scopes...)
+	}
+
+	// Every proxied request is kept for a while to look into failures
+	history := loadRequestHistory()
+	proxy.Record(history.record)
+
+	// Registered before the auth middleware so a degraded store can still be seen when it is rejecting requests
+	if failover, ok := store.(*failoverStore); ok {
+		router.GET("/health/store", func(context *gin.Context) {
+			status := failover.status()
+			code := http.StatusOK
+			if status.Degraded {
+				code = http.StatusServiceUnavailable
+			}
+			context.JSON(code, status)
+		})
+	}
+
+	// Prometheus scrapes without a key, so metrics are only protected by their own token. They
+	// are never served without one when auth is enabled, as they name keys and sessions
+	if metricsToken := loadMetricsToken(); metricsToken != "" || !authEnabled {
+		router.GET("/metrics", MetricsHandler(metricsToken))
+	} else {
+		apiLog.Warnf("Not serving /metrics, %s is needed to serve them with auth enabled", metricsTokenVar)
+	}
+	proxiesMutex.RLock()
+	metrics.sessionsChanged(len(proxies), len(proxy.freePorts))
+	proxiesMutex.RUnlock()
 
 	// Register auth/limiting middleware if needed
 	if authEnabled {
-		// TODO : This should load from some type of config, while
-		// being abstracted out into the auth.go file
-		authConfig := AuthConfig{
-			AuthKeys: []AuthWithLimit{
-				AuthWithLimit{
-					AuthKey: "testingapikey",
-					Limit:   10000,
-				},
-			},
-		}
-		ginAuthHandler, proxyAuthHandler := AuthLimit(authConfig, redisServer)
+		loadRollup(&authConfig, store).start()
+
+		authConfig.Anomalies = loadAnomalyDetector(&authConfig)
+
+		ginAuthHandler, proxyAuthHandler := AuthLimit(authConfig, store)
 		router.Use(ginAuthHandler)
 		proxy.Use(proxyAuthHandler)
+		proxy.Meter(BandwidthLimit(authConfig, store))
+		proxy.Observe(authConfig.Anomalies.observe)
+		proxy.Identify(authConfig.proxyKeyID)
 	}
 
 	router.GET("/health", func(context *gin.Context) {
@@ -42,45 +164,137 @@ func setupRouter(proxy Proxy, authEnabled bool) *gin.Engine {
 	})
 
 	// Create proxy, return id and port
-	router.POST("/create", func(context *gin.Context) {
-		if len(proxy.freePorts) <= 0 {
+	router.POST("/create", requireScope(ScopeSessionsCreate), func(context *gin.Context) {
+		// Optionally hand back a short lived token for the proxy instead of needing the key
+		wantToken := context.Query("token") == "true"
+		ttl, err := tokenTTL(context.Query("token_ttl"))
+		if wantToken && err != nil {
+			context.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		if wantToken && authorizedKey(context) == nil {
+			context.AbortWithError(http.StatusBadRequest, fmt.Errorf("Session tokens require auth to be enabled"))
+			return
+		}
+
+		port, ok := reservePort(proxy)
+		if !ok {
 			context.AbortWithError(http.StatusInternalServerError, fmt.Errorf("Unable to create the proxy : no more free ports"))
-		} else {
-			portIndex := rand.Intn(len(proxy.freePorts))
-			port := proxy.freePorts[portIndex]
-			proxySession, proxyServer, err := proxy.Create(port)
+			return
+		}
+		proxySession, proxyServer, err := proxy.Create(port)
+		if err != nil {
+			releasePort(proxy, port)
+			status := http.StatusInternalServerError
+			if _, ok := err.(*sessionIDError); ok {
+				status = http.StatusServiceUnavailable
+			}
+			context.AbortWithError(status, fmt.Errorf("Unable to create the proxy : %+v", err))
+			return
+		}
+
+		// The token is signed before the session is registered, so a failure only needs it shut down
+		var token string
+		expires := time.Now().Add(ttl)
+		if wantToken {
+			token, err = authConfig.signToken(sessionToken{Session: proxySession, KeyID: sessionOwner(context), Expires: expires.Unix()})
 			if err != nil {
-				context.AbortWithError(http.StatusInternalServerError, fmt.Errorf("Unable to create the proxy : %+v", err))
-			} else {
-				proxies[proxySession] = proxyServer
-				proxy.freePorts = remove(proxy.freePorts, portIndex)
-				context.JSON(http.StatusOK, gin.H{"session": proxySession, "port": port})
+				proxyServer.Close()
+				releasePort(proxy, port)
+				context.AbortWithError(http.StatusInternalServerError, fmt.Errorf("Unable to sign session token : %+v", err))
+				return
 			}
 		}
+
+		addSession(proxy, proxySession, &session{server: proxyServer, owner: sessionOwner(context)})
+		metrics.sessionsCreated.add(1)
+		response := gin.H{"session": proxySession, "port": port}
+		if cluster != nil {
+			record := SessionRecord{Session: proxySession, Port: port, Addr: proxyServer.Addr, Owner: sessionOwner(context), Created: time.Now()}
+			if err := cluster.addSession(record); err != nil {
+				clusterLog.Errorf("Error occured recording session %d : %+v", proxySession, err)
+			}
+			response["instance"] = cluster.instance.ID
+			response["host"] = cluster.instance.Host
+		}
+		if wantToken {
+			response["token"] = token
+			response["token_expires"] = expires
+		}
+		context.JSON(http.StatusOK, response)
 	})
 
 	// Get proxy info via id
-	router.GET("/session/:id", func(context *gin.Context) {
+	router.GET("/session/:id", requireScope(ScopeSessionsCreate, ScopeSessionsReadAll), func(context *gin.Context) {
 		id, err := strconv.Atoi(context.Params.ByName("id"))
 		if err != nil {
 			context.AbortWithError(http.StatusInternalServerError, fmt.Errorf("Unable to properly get the session id : %+v", err))
+			return
 		}
-		value, ok := proxies[id]
-		if ok {
-			context.JSON(http.StatusOK, gin.H{"session": id, "status": value.Addr})
+		value, ok := liveSession(id)
+		if ok && !canAccessSession(context, value.owner, ScopeSessionsReadAll) {
+			context.AbortWithError(http.StatusForbidden, fmt.Errorf("Session belongs to another key"))
+		} else if ok {
+			response := gin.H{"session": id, "status": value.server.Addr}
+			if cluster != nil {
+				response["instance"] = cluster.instance.ID
+				response["host"] = cluster.instance.Host
+			}
+			if anomaly := authConfig.Anomalies.status(id); anomaly != nil {
+				response["anomaly"] = anomaly
+			}
+			if until, debugging := proxy.debugging(id); debugging {
+				response["debug_until"] = until
+			}
+			context.JSON(http.StatusOK, response)
+		} else if record, instance := clusterSession(cluster, id); record != nil {
+			// Sessions owned by other instances are answered from their shared record
+			if !canAccessSession(context, record.Owner, ScopeSessionsReadAll) {
+				context.AbortWithError(http.StatusForbidden, fmt.Errorf("Session belongs to another key"))
+				return
+			}
+			context.JSON(http.StatusOK, gin.H{"session": id, "status": record.Addr, "instance": instance.ID, "host": record.Host})
 		} else {
 			context.JSON(http.StatusOK, gin.H{"session": id, "status": "not found"})
 		}
 	})
 
+	// List the sessions the key can see, across every instance when clustered
+	router.GET("/sessions", requireScope(ScopeSessionsCreate, ScopeSessionsReadAll), func(context *gin.Context) {
+		listed := []gin.H{}
+		if cluster != nil {
+			records, err := cluster.sessions()
+			if err != nil {
+				context.AbortWithError(http.StatusInternalServerError, fmt.Errorf("Unable to list sessions : %+v", err))
+				return
+			}
+			for _, record := range records {
+				if canAccessSession(context, record.Owner, ScopeSessionsReadAll) {
+					listed = append(listed, gin.H{"session": record.Session, "status": record.Addr, "owner": record.Owner, "instance": record.Instance, "host": record.Host})
+				}
+			}
+		} else {
+			for _, id := range liveSessionIDs() {
+				if value, ok := liveSession(id); ok && canAccessSession(context, value.owner, ScopeSessionsReadAll) {
+					listed = append(listed, gin.H{"session": id, "status": value.server.Addr, "owner": value.owner})
+				}
+			}
+		}
+		context.JSON(http.StatusOK, listed)
+	})
+
 	// Delete proxy info via id
-	router.DELETE("/session/:id", func(context *gin.Context) {
+	router.DELETE("/session/:id", requireScope(ScopeSessionsCreate, ScopeSessionsAdmin), func(context *gin.Context) {
 		id, err := strconv.Atoi(context.Params.ByName("id"))
 		if err != nil {
 			context.AbortWithError(http.StatusInternalServerError, fmt.Errorf("Unable to close the proxy : %+v", err))
+			return
 		}
-		proxyServer, ok := proxies[id]
-		if ok {
+		value, ok := liveSession(id)
+		if ok && !canAccessSession(context, value.owner, ScopeSessionsAdmin) {
+			context.AbortWithError(http.StatusForbidden, fmt.Errorf("Session belongs to another key"))
+		} else if value, ok := takeSession(id); ok {
+			proxyServer := value.server
 			err := proxyServer.Close()
 			if err != nil {
 				context.AbortWithError(http.StatusInternalServerError, fmt.Errorf("Unable to close the proxy : %+v", err))
@@ -89,72 +303,249 @@ func setupRouter(proxy Proxy, authEnabled bool) *gin.Engine {
 			if err != nil {
 				context.AbortWithError(http.StatusInternalServerError, fmt.Errorf("Unable to close the proxy : %+v", err))
 			}
-			proxy.freePorts = append(proxy.freePorts, newlyFreePort)
-			delete(proxies, id)
+			releasePort(proxy, newlyFreePort)
+			authConfig.Anomalies.forget(id)
+			history.forget(id)
+			proxy.debugSessions.set(id, time.Time{})
+			metrics.sessionClosed(id)
+			if cluster != nil {
+				if err := cluster.removeSession(id); err != nil {
+					clusterLog.Errorf("Error occured removing session %d : %+v", id, err)
+				}
+			}
 			context.JSON(http.StatusOK, gin.H{"session": id, "status": "closed"})
+		} else if record, instance := clusterSession(cluster, id); record != nil {
+			// The owning instance closes its own sessions, so the request is forwarded on
+			if !canAccessSession(context, record.Owner, ScopeSessionsAdmin) {
+				context.AbortWithError(http.StatusForbidden, fmt.Errorf("Session belongs to another key"))
+				return
+			}
+			resp, err := cluster.forwardDelete(instance, id, sessionOwner(context))
+			relayForwarded(context, instance, resp, err)
 		} else {
 			context.JSON(http.StatusOK, gin.H{"session": id, "status": "not found"})
 		}
 	})
 
+	// Trace every request of a session for a while, or stop tracing it
+	debugSession := func(context *gin.Context) {
+		id, err := strconv.Atoi(context.Params.ByName("id"))
+		if err != nil {
+			context.AbortWithError(http.StatusBadRequest, fmt.Errorf("Unable to properly get the session id : %+v", err))
+			return
+		}
+
+		if _, ok := liveSession(id); ok {
+			if context.Request.Method == http.MethodDelete {
+				proxy.DebugSession(id, time.Time{})
+				context.JSON(http.StatusOK, gin.H{"session": id, "debug": false})
+				return
+			}
+			duration, err := debugDuration(context.Query("duration"))
+			if err != nil {
+				context.AbortWithError(http.StatusBadRequest, err)
+				return
+			}
+			until := time.Now().Add(duration)
+			proxy.DebugSession(id, until)
+			context.JSON(http.StatusOK, gin.H{"session": id, "debug": true, "debug_until": until})
+		} else if record, instance := clusterSession(cluster, id); record != nil {
+			// Sessions are traced by the instance serving them
+			resp, err := cluster.forward(instance, context.Request.Method, context.Request.URL.RequestURI(), sessionOwner(context))
+			relayForwarded(context, instance, resp, err)
+		} else {
+			context.JSON(http.StatusNotFound, gin.H{"session": id, "status": "not found"})
+		}
+	}
+	router.POST("/session/:id/debug", requireScope(ScopeSessionsAdmin), debugSession)
+	router.DELETE("/session/:id/debug", requireScope(ScopeSessionsAdmin), debugSession)
+
+	// The recent requests of a session, kept by the instance serving it
+	router.GET("/session/:id/requests", requireScope(ScopeSessionsCreate, ScopeSessionsReadAll), func(context *gin.Context) {
+		id, err := strconv.Atoi(context.Params.ByName("id"))
+		if err != nil {
+			context.AbortWithError(http.StatusBadRequest, fmt.Errorf("Unable to properly get the session id : %+v", err))
+			return
+		}
+		filter, err := parseHistoryFilter(context)
+		if err != nil {
+			context.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		value, ok := liveSession(id)
+		if ok && !canAccessSession(context, value.owner, ScopeSessionsReadAll) {
+			context.AbortWithError(http.StatusForbidden, fmt.Errorf("Session belongs to another key"))
+		} else if ok {
+			filter.session, filter.hasSession = id, true
+			context.JSON(http.StatusOK, history.search(filter))
+		} else if record, instance := clusterSession(cluster, id); record != nil {
+			if !canAccessSession(context, record.Owner, ScopeSessionsReadAll) {
+				context.AbortWithError(http.StatusForbidden, fmt.Errorf("Session belongs to another key"))
+				return
+			}
+			resp, err := cluster.forward(instance, http.MethodGet, context.Request.URL.RequestURI(), sessionOwner(context))
+			relayForwarded(context, instance, resp, err)
+		} else {
+			context.JSON(http.StatusNotFound, gin.H{"session": id, "status": "not found"})
+		}
+	})
+
+	// Search the recent requests of the key, or of every key with sessions:read-all, across every instance
+	router.GET("/requests", requireScope(ScopeSessionsCreate, ScopeSessionsReadAll), func(context *gin.Context) {
+		filter, err := parseHistoryFilter(context)
+		if err != nil {
+			context.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		if keyConfig := authorizedKey(context); keyConfig != nil && !keyConfig.hasScope(ScopeSessionsReadAll) {
+			if filter.hasKey && filter.key != keyConfig.ID {
+				context.AbortWithError(http.StatusForbidden, fmt.Errorf("Requests of other keys need %s", ScopeSessionsReadAll))
+				return
+			}
+			filter.key, filter.hasKey = keyConfig.ID, true
+		}
+
+		found := history.search(filter)
+		if cluster != nil && context.Query("local") != "true" {
+			found = append(found, cluster.searchHistory(context.Request.URL.Query(), sessionOwner(context))...)
+			found = newestEntries(found, filter.limit)
+		}
+		context.JSON(http.StatusOK, found)
+	})
+
+	// Usage and keys only exist when auth is enabled
+	if authEnabled {
+		ownUsage, allUsage := UsageHandlers(authConfig, store)
+		router.GET("/usage", RequireScope(ScopeUsageRead), ownUsage)
+
+		createKey, listKeys, revokeKey := KeyHandlers(authConfig, store)
+		admin := router.Group("/admin")
+		admin.GET("/usage", RequireScope(ScopeUsageReadAll), allUsage)
+		admin.POST("/keys", RequireScope(ScopeKeysAdmin), createKey)
+		admin.GET("/keys", RequireScope(ScopeKeysAdmin), listKeys)
+		admin.DELETE("/keys/:id", RequireScope(ScopeKeysAdmin), revokeKey)
+	}
+
 	return router
 }
 
-func main() {
-	lowerBounds, err := strconv.Atoi(os.Getenv("PRAXIS_LOWER"))
-	if err != nil {
-		panic(fmt.Sprintf("Failed to get lower bounds variable PRAXIS_LOWER : %+v", err))
+// liveSessionOwner names the key owning a session served by this instance
+func liveSessionOwner(sessionID int) (string, bool) {
+	value, ok := liveSession(sessionID)
+	if !ok {
+		return "", false
 	}
+	return value.owner, true
+}
 
-	upperBounds, err := strconv.Atoi(os.Getenv("PRAXIS_UPPER"))
-	if err != nil {
-		panic(fmt.Sprintf("Failed to get upper bounds variable PRAXIS_UPPER : %+v", err))
+// sessionOwner is the id of the key creating a session, or empty when auth is disabled
+func sessionOwner(context *gin.Context) string {
+	keyConfig := authorizedKey(context)
+	if keyConfig == nil {
+		return ""
 	}
+	return keyConfig.ID
+}
 
-	servePort, err := strconv.Atoi(os.Getenv("SERVE_PORT"))
-	if err != nil {
-		panic(fmt.Sprintf("Failed to get serve port variable SERVE_PORT : %+v", err))
+// canAccessSession allows keys to access sessions they own, or any session with `scope`
+func canAccessSession(context *gin.Context, owner string, scope Scope) bool {
+	keyConfig := authorizedKey(context)
+	if keyConfig == nil {
+		// Auth is disabled
+		return true
 	}
+	return keyConfig.ID == owner || keyConfig.hasScope(scope)
+}
 
-	proxyURL := os.Getenv("PROXY_URL")
-	if proxyURL == "" {
-		panic(fmt.Sprintf("Failed to get proxy url variable PROXY_URL : %+v", err))
+// relayForwarded returns the response of a request forwarded to `instance` to the client
+func relayForwarded(context *gin.Context, instance *Instance, resp *http.Response, err error) {
+	if err != nil {
+		context.AbortWithError(http.StatusBadGateway, fmt.Errorf("Unable to forward to instance %s : %+v", instance.ID, err))
+		return
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		context.AbortWithError(http.StatusBadGateway, fmt.Errorf("Unable to forward to instance %s : %+v", instance.ID, err))
+		return
 	}
+	context.Data(resp.StatusCode, resp.Header.Get("Content-Type"), body)
+}
 
-	proxyUsername := os.Getenv("PROXY_USERNAME")
-	if proxyUsername == "" {
-		panic(fmt.Sprintf("Failed to get proxy username variable PROXY_USERNAME : %+v", err))
+// clusterSession finds a session owned by another instance, if clustered
+func clusterSession(cluster *Cluster, id int) (*SessionRecord, *Instance) {
+	if cluster == nil {
+		return nil, nil
 	}
+	return cluster.session(id)
+}
+
+func main() {
+	os.Exit(runCLI(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
 
-	proxyPassword := os.Getenv("PROXY_PASSWORD")
-	if proxyPassword == "" {
-		panic(fmt.Sprintf("Failed to get proxy password variable PROXY_PASSWORD : %+v", err))
+// serve runs the api until it fails
+func serve() {
+	configPath := os.Getenv(configVar)
+	config, err := loadConfig(configPath)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to load configuration : %+v", err))
+	}
+	secrets := rememberSecrets(nil, config.Upstream.Username, config.Upstream.Password)
+	configureLogging(config.Logging, secrets...)
+	if !config.Auth.Enabled {
+		authLog.Warnf("Auth is not enabled, every request is allowed...")
 	}
 
-	authVar := os.Getenv("AUTH_ENABLED")
-	authEnabled := false
-	if authVar == "" {
-		log.Printf("No AUTH_ENABLED flag found, defaulting to none...")
-	} else {
-		authEnabled, err = strconv.ParseBool(authVar)
-		if err != nil {
-			panic(fmt.Sprintf("Failed to parse auth flag variable AUTH_ENABLED : %+v", err))
-		}
+	proxy := &Proxy{
+		username:   config.Upstream.Username,
+		password:   config.Upstream.Password,
+		URL:        config.Upstream.URL,
+		upperBound: config.Ports.Upper,
+		lowerBound: config.Ports.Lower,
+		freePorts:  makeRange(config.Ports.Lower, config.Ports.Upper),
+		debug:      config.Logging.Debug,
 	}
 
-	proxy := Proxy{
-		username:   proxyUsername,
-		password:   proxyPassword,
-		URL:        proxyURL,
-		upperBound: upperBounds,
-		lowerBound: lowerBounds,
-		freePorts:  makeRange(lowerBounds, upperBounds),
+	accessLog := &AccessLog{}
+	if err := accessLog.Configure(config.AccessLog); err != nil {
+		panic(fmt.Sprintf("Failed to open the access log : %+v", err))
 	}
+	proxy.Record(accessLog.Log)
 
-	log.Printf("[PROXY] Capable of serving up %d proxies per configuration settings...", upperBounds-lowerBounds)
+	proxyLog.Infof("Capable of serving up %d proxies per configuration settings...", config.Ports.Upper-config.Ports.Lower)
 
-	redisServer.Init()
+	// Nothing is stored without auth or clustering, so there's no need for redis
+	var store Store
+	if config.Auth.Enabled || os.Getenv(instanceURLVar) != "" {
+		store = loadStore(config.credentials)
+	}
 	rand.Seed(time.Now().UnixNano())
-	router := setupRouter(proxy, authEnabled)
-	router.Run(fmt.Sprintf(":%d", servePort))
+	keys := NewKeySet(config.Auth.Keys)
+	router := setupRouter(proxy, config.Auth.Enabled, store, keys)
+
+	// Upstream, logging, access log and key changes apply to new sessions and requests without a restart
+	watchConfig(configPath, func(next *Config) {
+		for _, setting := range config.restartRequired(next) {
+			configLog.Warnf("%s changed, it will only apply after a restart", setting)
+		}
+		// Sessions created before any reload keep using their upstream credentials
+		secrets = rememberSecrets(secrets, next.Upstream.Username, next.Upstream.Password)
+		configureLogging(next.Logging, secrets...)
+		proxy.Reconfigure(next.Upstream, next.Logging.Debug)
+		if err := accessLog.Configure(next.AccessLog); err != nil {
+			configLog.Warnf("Keeping the current access log : %+v", err)
+		}
+		keys.Set(next.Auth.Keys)
+		configLog.Infof("Reloaded configuration with %d keys", len(next.Auth.Keys))
+	})
+
+	tlsConfig := config.Listen.TLS
+	if tlsConfig.enabled() {
+		apiLog.Infof("Serving over tls, client certificates verified against %q", tlsConfig.ClientCAFile)
+	}
+	if err := serveAPI(router, fmt.Sprintf(":%d", config.Listen.Port), tlsConfig); err != nil {
+		apiLog.Fatalf("Unable to serve : %+v", err)
+	}
 }
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestSessionPortsConcurrent(t *testing.T) {
+	proxy := &Proxy{freePorts: makeRange(9001, 9050)}
+
+	// Every port is handed out once, however many sessions are created and closed at the same time
+	var wg sync.WaitGroup
+	reserved := make(chan int, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			port, ok := reservePort(proxy)
+			if !ok {
+				return
+			}
+			reserved <- port
+			addSession(proxy, 100000+id, &session{server: &http.Server{}})
+			liveSessionIDs()
+			if _, ok := takeSession(100000 + id); ok {
+				releasePort(proxy, port)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(reserved)
+
+	if len(proxy.freePorts) != 50 {
+		t.Fatalf("Expected every port to be free again but got %d", len(proxy.freePorts))
+	}
+	seen := make(map[int]bool)
+	for _, port := range proxy.freePorts {
+		if seen[port] {
+			t.Fatalf("Expected port %d to be free only once", port)
+		}
+		seen[port] = true
+	}
+	if len(reserved) == 0 {
+		t.Fatalf("Expected ports to have been reserved")
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	memorySnapshotInterval = 30 * time.Second
+)
+
+type memoryEntry struct {
+	Value   []byte    `json:"value"`
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+func (e *memoryEntry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !now.Before(e.Expires)
+}
+
+type memoryBucket struct {
+	tokens  float64
+	ts      time.Time
+	expires time.Time
+}
+
+// MemoryStore is a Store kept in process for single instance and test deployments which don't
+// want to run redis, optionally saving a snapshot to disk so keys and usage survive restarts
+type MemoryStore struct {
+	path string
+
+	entries map[string]*memoryEntry
+	buckets map[string]*memoryBucket
+	mutex   sync.Mutex
+
+	done chan struct{}
+}
+
+// NewMemoryStore creates a memory store, loading and periodically saving it to `path` if given
+func NewMemoryStore(path string) (*MemoryStore, error) {
+	m := &MemoryStore{
+		path:    path,
+		entries: make(map[string]*memoryEntry),
+		buckets: make(map[string]*memoryBucket),
+		done:    make(chan struct{}),
+	}
+	if path == "" {
+		return m, nil
+	}
+
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	go m.snapshots()
+	storeLog.Infof("Using memory store saved to %s", path)
+	return m, nil
+}
+
+func (m *MemoryStore) load() error {
+	data, err := ioutil.ReadFile(m.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to read store snapshot %s : %+v", m.path, err)
+	}
+	if err := json.Unmarshal(data, &m.entries); err != nil {
+		return fmt.Errorf("Unable to parse store snapshot %s : %+v", m.path, err)
+	}
+	return nil
+}
+
+// save writes the entries to a temporary file before moving it over the snapshot, so a crash
+// part way through never leaves a broken snapshot behind
+func (m *MemoryStore) save() error {
+	m.mutex.Lock()
+	m.expire(time.Now())
+	data, err := json.Marshal(m.entries)
+	m.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(m.path), filepath.Base(m.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), m.path)
+}
+
+func (m *MemoryStore) snapshots() {
+	ticker := time.NewTicker(memorySnapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.save(); err != nil {
+				storeLog.Errorf("Error occured saving store snapshot : %+v", err)
+			}
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// expire removes any expired entries, it must be called while holding the mutex
+func (m *MemoryStore) expire(now time.Time) {
+	for key, entry := range m.entries {
+		if entry.expired(now) {
+			delete(m.entries, key)
+		}
+	}
+	for key, bucket := range m.buckets {
+		if !now.Before(bucket.expires) {
+			delete(m.buckets, key)
+		}
+	}
+}
+
+// entry returns the unexpired entry at `key`, it must be called while holding the mutex
+func (m *MemoryStore) entry(key string) *memoryEntry {
+	entry, ok := m.entries[key]
+	if !ok {
+		return nil
+	}
+	if entry.expired(time.Now()) {
+		delete(m.entries, key)
+		return nil
+	}
+	return entry
+}
+
+// Get the value of `key`
+func (m *MemoryStore) Get(key string) ([]byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	entry := m.entry(key)
+	if entry == nil {
+		return nil, &notFoundError{key: key}
+	}
+	return entry.Value, nil
+}
+
+// Set a key to `key` using `value`
+func (m *MemoryStore) Set(key string, value []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.entries[key] = &memoryEntry{Value: value}
+	return nil
+}
+
+// SetEx sets `key` to `value`, expiring it after `ttl` seconds
+func (m *MemoryStore) SetEx(key string, value []byte, ttl int) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.entries[key] = &memoryEntry{Value: value, Expires: time.Now().Add(time.Duration(ttl) * time.Second)}
+	return nil
+}
+
+// Exists returns if `key` exists in the store
+func (m *MemoryStore) Exists(key string) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.entry(key) != nil, nil
+}
+
+// Delete `key` if it exists
+func (m *MemoryStore) Delete(key string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.entries, key)
+	return nil
+}
+
+// GetKeys returns all keys that match `pattern`, keys are never expected to contain a "/"
+// which unlike redis is not matched by a "*"
+func (m *MemoryStore) GetKeys(pattern string) ([]string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("error retrieving '%s' keys", pattern)
+	}
+
+	m.expire(time.Now())
+	keys := []string{}
+	for key := range m.entries {
+		if matched, _ := path.Match(pattern, key); matched {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// IncrBy will increment a counter based on `counterKey` by `amount`, expiring it after `ttl` seconds
+func (m *MemoryStore) IncrBy(counterKey string, amount int64, ttl int) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var value int64
+	if entry := m.entry(counterKey); entry != nil {
+		current, err := strconv.ParseInt(string(entry.Value), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("error incrementing %s: not a counter", counterKey)
+		}
+		value = current
+	}
+	value += amount
+
+	entry := &memoryEntry{Value: []byte(strconv.FormatInt(value, 10))}
+	if ttl > 0 {
+		entry.Expires = time.Now().Add(time.Duration(ttl) * time.Second)
+	}
+	m.entries[counterKey] = entry
+	return value, nil
+}
+
+// GetCounters returns the values of all counters in `keys`, with missing counters as zero
+func (m *MemoryStore) GetCounters(keys ...string) ([]int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	counters := make([]int64, len(keys))
+	for i, key := range keys {
+		entry := m.entry(key)
+		if entry == nil {
+			continue
+		}
+		value, err := strconv.ParseInt(string(entry.Value), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("error getting counters %v: %s is not a counter", keys, key)
+		}
+		counters[i] = value
+	}
+	return counters, nil
+}
+
+// TakeToken attempts to take a token from the bucket at `key`, refilling it as the redis
+// token bucket script does. Buckets are short lived so are not saved to disk
+func (m *MemoryStore) TakeToken(key string, rate float64, burst int64) (bool, time.Duration, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	bucket, ok := m.buckets[key]
+	if !ok {
+		bucket = &memoryBucket{tokens: float64(burst), ts: now}
+		m.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(float64(burst), bucket.tokens+math.Max(0, now.Sub(bucket.ts).Seconds())*rate)
+	bucket.ts = now
+	// Once the bucket would have refilled it is no different from a new one
+	bucket.expires = now.Add(time.Duration(float64(burst)/rate*float64(time.Second)) + time.Second)
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0, nil
+	}
+	wait := math.Ceil((1 - bucket.tokens) / rate * 1000)
+	return false, time.Duration(wait) * time.Millisecond, nil
+}
+
+// Ping always succeeds as the store is in process
+func (m *MemoryStore) Ping() error {
+	return nil
+}
+
+// Close stops saving snapshots, saving one last time
+func (m *MemoryStore) Close() error {
+	if m.path == "" {
+		return nil
+	}
+	close(m.done)
+	return m.save()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	store, err := NewMemoryStore("")
+	if err != nil {
+		t.Fatalf("Unexpected error creating store : %+v", err)
+	}
+
+	if _, err := store.Get("missing"); err == nil {
+		t.Fatalf("Expected missing key to return an error")
+	}
+	store.Set("keys:praxis:a", []byte("a"))
+	store.Set("keys:praxis:b", []byte("b"))
+	store.Set("keys:other:c", []byte("c"))
+	if value, err := store.Get("keys:praxis:a"); err != nil || string(value) != "a" {
+		t.Fatalf("Expected value %s but got %s : %+v", "a", value, err)
+	}
+
+	keys, _ := store.GetKeys(escapePattern("keys:praxis:") + "*")
+	sort.Strings(keys)
+	if len(keys) != 2 || keys[0] != "keys:praxis:a" || keys[1] != "keys:praxis:b" {
+		t.Fatalf("Unexpected keys matched : %v", keys)
+	}
+
+	store.Delete("keys:praxis:a")
+	if exists, _ := store.Exists("keys:praxis:a"); exists {
+		t.Fatalf("Expected key to be deleted")
+	}
+
+	store.IncrBy("counter", 2, 60)
+	if value, _ := store.IncrBy("counter", 3, 60); value != 5 {
+		t.Fatalf("Expected counter of %d but got %d", 5, value)
+	}
+	// Counters without a ttl never expire
+	store.IncrBy("persistent", 1, 0)
+	counters, err := store.GetCounters("counter", "missing", "persistent")
+	if err != nil || counters[0] != 5 || counters[1] != 0 || counters[2] != 1 {
+		t.Fatalf("Unexpected counters %v : %+v", counters, err)
+	}
+	if _, err := store.GetCounters("keys:praxis:b"); err == nil {
+		t.Fatalf("Expected an error reading a value as a counter")
+	}
+}
+
+func TestMemoryStoreTakeToken(t *testing.T) {
+	store, _ := NewMemoryStore("")
+
+	for i := 0; i < 3; i++ {
+		if allowed, _, _ := store.TakeToken("bucket", 1, 3); !allowed {
+			t.Fatalf("Expected token %d of the burst to be allowed", i)
+		}
+	}
+	allowed, wait, _ := store.TakeToken("bucket", 1, 3)
+	if allowed || wait <= 0 || wait > time.Second {
+		t.Fatalf("Expected to wait up to a second for a token but got %t after %s", allowed, wait)
+	}
+}
+
+func TestMemoryStoreSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "praxis-store")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir : %+v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "store.json")
+
+	store, err := NewMemoryStore(path)
+	if err != nil {
+		t.Fatalf("Unexpected error creating store : %+v", err)
+	}
+	store.Set("keys:praxis:a", []byte("a"))
+	store.IncrBy("counter", 7, 60)
+	if err := store.Close(); err != nil {
+		t.Fatalf("Unexpected error closing store : %+v", err)
+	}
+
+	reopened, err := NewMemoryStore(path)
+	if err != nil {
+		t.Fatalf("Unexpected error reopening store : %+v", err)
+	}
+	defer reopened.Close()
+	if value, err := reopened.Get("keys:praxis:a"); err != nil || string(value) != "a" {
+		t.Fatalf("Expected value %s to survive a restart but got %s : %+v", "a", value, err)
+	}
+	if counters, _ := reopened.GetCounters("counter"); counters[0] != 7 {
+		t.Fatalf("Expected counter of %d to survive a restart but got %d", 7, counters[0])
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// ByteCounter tracks the bytes transferred in either direction by a single proxied
+// request or CONNECT tunnel, returning an error from Add when the transfer should be aborted
+type ByteCounter interface {
+	Add(n int64) error
+	Close()
+}
+
+// byteCounters fans out to multiple counters, stopping at the first error
+type byteCounters []ByteCounter
+
+func (b byteCounters) Add(n int64) error {
+	for _, counter := range b {
+		if err := counter.Add(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b byteCounters) Close() {
+	for _, counter := range b {
+		counter.Close()
+	}
+}
+
+// meteredConn counts all bytes read and written, closing itself once a counter
+// asks for the transfer to be aborted. The bytes read are also added to `received`
+type meteredConn struct {
+	net.Conn
+	counter  ByteCounter
+	received ByteCounter
+	err      error
+	mutex    sync.Mutex
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.count(int64(n))
+		if c.received != nil {
+			c.received.Add(int64(n))
+		}
+	}
+	return n, err
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.count(int64(n))
+	}
+	return n, err
+}
+
+func (c *meteredConn) count(n int64) {
+	if err := c.counter.Add(n); err != nil {
+		c.mutex.Lock()
+		if c.err == nil {
+			c.err = err
+		}
+		c.mutex.Unlock()
+		c.Conn.Close()
+	}
+}
+
+// CloseWrite passes on the end of the data written, see closeWrite
+func (c *meteredConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// closeWrite half closes TCP and TLS connections so the other end sees EOF while it can still
+// send, connections which can't be half closed are closed entirely
+func closeWrite(conn net.Conn) error {
+	if halfClosable, ok := conn.(interface{ CloseWrite() error }); ok {
+		return halfClosable.CloseWrite()
+	}
+	return conn.Close()
+}
+
+// abortErr returns the error which caused the connection to be aborted, if any
+func (c *meteredConn) abortErr() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.err
+}
+
+// meteredBody counts all bytes read from a request or response body, closing the
+// counter along with the body when asked to
+type meteredBody struct {
+	io.ReadCloser
+	counter      ByteCounter
+	closeCounter bool
+}
+
+func (b *meteredBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if countErr := b.counter.Add(int64(n)); countErr != nil {
+			return n, countErr
+		}
+	}
+	return n, err
+}
+
+func (b *meteredBody) Close() error {
+	err := b.ReadCloser.Close()
+	if b.closeCounter {
+		b.counter.Close()
+	}
+	return err
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+type testCounter struct {
+	total  int64
+	limit  int64
+	closed bool
+}
+
+func (c *testCounter) Add(n int64) error {
+	c.total += n
+	if c.limit > 0 && c.total > c.limit {
+		return fmt.Errorf("limit exceeded")
+	}
+	return nil
+}
+
+func (c *testCounter) Close() {
+	c.closed = true
+}
+
+func TestMeteredBody(t *testing.T) {
+	counter := &testCounter{}
+	body := &meteredBody{
+		ReadCloser:   ioutil.NopCloser(strings.NewReader("twelve bytes")),
+		counter:      byteCounters{counter},
+		closeCounter: true,
+	}
+
+	if _, err := ioutil.ReadAll(body); err != nil {
+		t.Fatalf("Unexpected error reading body : %+v", err)
+	}
+	body.Close()
+
+	if counter.total != 12 {
+		t.Fatalf("Expected %d bytes counted but got %d", 12, counter.total)
+	}
+	if !counter.closed {
+		t.Fatalf("Expected counter to be closed along with the body")
+	}
+
+	counter = &testCounter{limit: 4}
+	body = &meteredBody{
+		ReadCloser: ioutil.NopCloser(strings.NewReader("twelve bytes")),
+		counter:    counter,
+	}
+	if _, err := ioutil.ReadAll(body); err == nil {
+		t.Fatalf("Expected reading past the limit to fail")
+	}
+}
+
+func TestMeteredConnAbort(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	counter := &testCounter{limit: 4}
+	conn := &meteredConn{Conn: server, counter: counter}
+
+	go client.Write([]byte("twelve bytes"))
+	buffer := make([]byte, 12)
+	if _, err := conn.Read(buffer); err != nil {
+		t.Fatalf("Unexpected error reading : %+v", err)
+	}
+
+	if conn.abortErr() == nil {
+		t.Fatalf("Expected the connection to be aborted")
+	}
+	if _, err := conn.Read(buffer); err != io.ErrClosedPipe {
+		t.Fatalf("Expected the connection to be closed but got : %+v", err)
+	}
+}
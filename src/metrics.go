@@ -0,0 +1,362 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	metricsTokenVar = "METRICS_TOKEN"
+
+	counterMetric   = "counter"
+	gaugeMetric     = "gauge"
+	histogramMetric = "histogram"
+
+	metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// latencyBuckets are the upper bounds in seconds of the histograms of upstream and store latency
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metrics holds counters, gauges and histograms in the order they were registered, written out
+// in the Prometheus text format
+type Metrics struct {
+	families []*metricFamily
+}
+
+// metricFamily is every series of a single metric, keyed by their label values
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	series map[string]*metricSeries
+	mutex  sync.Mutex
+}
+
+type metricSeries struct {
+	labels []string
+	value  float64
+
+	// Histograms count observations at or below each bucket, along with their sum
+	counts []uint64
+	count  uint64
+}
+
+func (m *Metrics) register(name, help, kind string, buckets []float64, labels []string) *metricFamily {
+	family := &metricFamily{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*metricSeries),
+	}
+	m.families = append(m.families, family)
+	return family
+}
+
+// counter registers a counter partitioned by `labels`
+func (m *Metrics) counter(name, help string, labels ...string) *metricFamily {
+	return m.register(name, help, counterMetric, nil, labels)
+}
+
+// gauge registers a gauge partitioned by `labels`
+func (m *Metrics) gauge(name, help string, labels ...string) *metricFamily {
+	return m.register(name, help, gaugeMetric, nil, labels)
+}
+
+// histogram registers a histogram with the upper bounds `buckets`, partitioned by `labels`
+func (m *Metrics) histogram(name, help string, buckets []float64, labels ...string) *metricFamily {
+	return m.register(name, help, histogramMetric, buckets, labels)
+}
+
+// get returns the series for `values`, creating it if needed. The family must be locked
+func (f *metricFamily) get(values []string) *metricSeries {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("Metric %s expects labels %v but got %v", f.name, f.labels, values))
+	}
+	id := strings.Join(values, "\xff")
+	series, ok := f.series[id]
+	if !ok {
+		series = &metricSeries{labels: append([]string{}, values...)}
+		if f.kind == histogramMetric {
+			series.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[id] = series
+	}
+	return series
+}
+
+// add increases the counter or gauge with `values` by `amount`
+func (f *metricFamily) add(amount float64, values ...string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.get(values).value += amount
+}
+
+// set sets the gauge with `values` to `value`
+func (f *metricFamily) set(value float64, values ...string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.get(values).value = value
+}
+
+// observe records `value` in the histogram with `values`
+func (f *metricFamily) observe(value float64, values ...string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	series := f.get(values)
+	for i, bound := range f.buckets {
+		if value <= bound {
+			series.counts[i]++
+		}
+	}
+	series.count++
+	series.value += value
+}
+
+// forget removes every series where `label` is `value`, such as those of a closed session
+func (f *metricFamily) forget(label, value string) {
+	index := -1
+	for i, name := range f.labels {
+		if name == label {
+			index = i
+		}
+	}
+	if index < 0 {
+		return
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for id, series := range f.series {
+		if series.labels[index] == value {
+			delete(f.series, id)
+		}
+	}
+}
+
+// WriteTo writes every metric in the Prometheus text exposition format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var out strings.Builder
+	for _, family := range m.families {
+		family.write(&out)
+	}
+	n, err := io.WriteString(w, out.String())
+	return int64(n), err
+}
+
+func (f *metricFamily) write(out *strings.Builder) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	fmt.Fprintf(out, "# HELP %s %s\n", f.name, f.help)
+	fmt.Fprintf(out, "# TYPE %s %s\n", f.name, f.kind)
+	// Unlabelled counters and gauges are reported as zero before they are first used
+	if len(f.labels) == 0 && f.kind != histogramMetric {
+		f.get(nil)
+	}
+
+	ids := make([]string, 0, len(f.series))
+	for id := range f.series {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		series := f.series[id]
+		if f.kind != histogramMetric {
+			fmt.Fprintf(out, "%s%s %s\n", f.name, formatLabels(f.labels, series.labels, "", ""), formatMetricValue(series.value))
+			continue
+		}
+		for i, bound := range f.buckets {
+			fmt.Fprintf(out, "%s_bucket%s %d\n", f.name, formatLabels(f.labels, series.labels, "le", formatMetricValue(bound)), series.counts[i])
+		}
+		fmt.Fprintf(out, "%s_bucket%s %d\n", f.name, formatLabels(f.labels, series.labels, "le", "+Inf"), series.count)
+		fmt.Fprintf(out, "%s_sum%s %s\n", f.name, formatLabels(f.labels, series.labels, "", ""), formatMetricValue(series.value))
+		fmt.Fprintf(out, "%s_count%s %d\n", f.name, formatLabels(f.labels, series.labels, "", ""), series.count)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels formats the label pairs of a series, with an extra pair such as a histograms `le`
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	pairs := []string{}
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(values[i])))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatMetricValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// praxisMetrics are the metrics Praxis reports about its sessions, proxies, auth and store
+type praxisMetrics struct {
+	*Metrics
+
+	sessionsCreated *metricFamily
+	sessionsClosed  *metricFamily
+	sessionsActive  *metricFamily
+	freePorts       *metricFamily
+
+	proxyRequests    *metricFamily
+	proxyBytes       *metricFamily
+	upstreamDuration *metricFamily
+	upstreamAuth     *metricFamily
+	upstreamDial     *metricFamily
+
+	authRejections *metricFamily
+
+	storeDuration   *metricFamily
+	storeErrors     *metricFamily
+	storeDegraded   *metricFamily
+	storePending    *metricFamily
+	storeReconciled *metricFamily
+}
+
+func newPraxisMetrics() *praxisMetrics {
+	m := &praxisMetrics{Metrics: &Metrics{}}
+	m.sessionsCreated = m.counter("praxis_sessions_created_total", "Sessions created.")
+	m.sessionsClosed = m.counter("praxis_sessions_closed_total", "Sessions closed.")
+	m.sessionsActive = m.gauge("praxis_sessions_active", "Sessions currently open on this instance.")
+	m.freePorts = m.gauge("praxis_free_ports", "Ports remaining for new sessions on this instance.")
+
+	m.proxyRequests = m.counter("praxis_proxy_requests_total", "Proxied http requests and CONNECT tunnels allowed through a session.", "type", "session", "key", "upstream")
+	m.proxyBytes = m.counter("praxis_proxy_bytes_total", "Bytes sent and received through a session.", "session", "key", "upstream")
+	m.upstreamDuration = m.histogram("praxis_upstream_duration_seconds", "Time taken for the end proxy to respond to a request or open a CONNECT tunnel.", latencyBuckets, "type", "upstream")
+	m.upstreamAuth = m.counter("praxis_upstream_auth_failures_total", "Requests and CONNECTs the end proxy refused with a 407.", "type", "upstream")
+	m.upstreamDial = m.counter("praxis_upstream_dial_failures_total", "Requests and CONNECTs which could not be sent through the end proxy.", "type", "upstream")
+
+	m.authRejections = m.counter("praxis_auth_rejections_total", "Api and proxy requests refused by auth, by the status they were refused with.", "source", "status")
+
+	m.storeDuration = m.histogram("praxis_store_command_duration_seconds", "Time taken by redis commands.", latencyBuckets, "command")
+	m.storeErrors = m.counter("praxis_store_command_errors_total", "Redis commands which failed.", "command")
+	m.storeDegraded = m.gauge("praxis_store_degraded", "Whether the store is unavailable and the failure policy is being applied.")
+	m.storePending = m.gauge("praxis_store_pending_counters", "Counters kept locally while degraded, waiting to be added to the store.")
+	m.storeReconciled = m.counter("praxis_store_reconciled_total", "Locally kept counters added to the store once it was available again.")
+	return m
+}
+
+// metrics are reported by the /metrics route
+var metrics = newPraxisMetrics()
+
+// upstreamLabel identifies an end proxy by its host, so credentials in the url are never reported
+func upstreamLabel(upstream string) string {
+	u, err := url.Parse(upstream)
+	if err != nil || u.Host == "" {
+		return upstream
+	}
+	return u.Host
+}
+
+// sessionsChanged updates the session gauges after one is created or closed
+func (m *praxisMetrics) sessionsChanged(active, free int) {
+	m.sessionsActive.set(float64(active))
+	m.freePorts.set(float64(free))
+}
+
+// sessionClosed counts a closed session, forgetting the series labelled with it
+func (m *praxisMetrics) sessionClosed(id int) {
+	m.sessionsClosed.add(1)
+	session := strconv.Itoa(id)
+	m.proxyRequests.forget("session", session)
+	m.proxyBytes.forget("session", session)
+}
+
+// authRejected counts a request refused by auth from `source`, either the api or a proxy
+func (m *praxisMetrics) authRejected(source string, err error) {
+	status := http.StatusForbidden
+	if authErr, ok := err.(*authError); ok {
+		status = authErr.Status
+	}
+	m.authRejections.add(1, source, strconv.Itoa(status))
+}
+
+// metricsCounter counts the bytes transferred by a single request or tunnel against its session
+type metricsCounter struct {
+	labels []string
+}
+
+func (c *metricsCounter) Add(n int64) error {
+	metrics.proxyBytes.add(float64(n), c.labels...)
+	return nil
+}
+
+func (c *metricsCounter) Close() {}
+
+// timedConn records how long each redis command takes
+type timedConn struct {
+	redis.Conn
+}
+
+func (c timedConn) Do(command string, args ...interface{}) (interface{}, error) {
+	started := time.Now()
+	reply, err := c.Conn.Do(command, args...)
+	// Flushing pipelined commands is reported as an empty command
+	if command == "" {
+		command = "FLUSH"
+	}
+	metrics.storeDuration.observe(time.Since(started).Seconds(), command)
+	if err != nil {
+		metrics.storeErrors.add(1, command)
+	}
+	return reply, err
+}
+
+// MetricsHandler serves the metrics, requiring `token` as a bearer token when it is set
+func MetricsHandler(token string) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		if token != "" && subtle.ConstantTimeCompare([]byte(context.GetHeader("Authorization")), []byte("Bearer "+token)) != 1 {
+			context.AbortWithError(http.StatusUnauthorized, fmt.Errorf("Bad metrics token"))
+			return
+		}
+		context.Header("Content-Type", metricsContentType)
+		context.Status(http.StatusOK)
+		metrics.WriteTo(context.Writer)
+	}
+}
+
+// loadMetricsToken reads the token protecting /metrics, if any
+func loadMetricsToken() string {
+	token, err := secretEnv(metricsTokenVar)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to read metrics token : %+v", err))
+	}
+	return token
+}
+
+// upstreamFailed counts a request or CONNECT which could not be sent through the end proxy,
+// separating out those it refused to authenticate
+func (m *praxisMetrics) upstreamFailed(kind, upstream string, err error) {
+	if refused, ok := err.(*upstreamRefusedError); ok && refused.Status == http.StatusProxyAuthRequired {
+		m.upstreamAuth.add(1, kind, upstream)
+		return
+	}
+	m.upstreamDial.add(1, kind, upstream)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMetricsFormat(t *testing.T) {
+	m := &Metrics{}
+	requests := m.counter("test_requests_total", "Requests.", "session", "path")
+	latency := m.histogram("test_latency_seconds", "Latency.", []float64{0.1, 1})
+	m.gauge("test_ports", "Ports.")
+
+	requests.add(2, "3001", "/a")
+	requests.add(1, "3001", "/a")
+	requests.add(1, "3002", "/\"quoted\"\n")
+	latency.observe(0.05)
+	latency.observe(0.5)
+	latency.observe(5)
+
+	var out bytes.Buffer
+	m.WriteTo(&out)
+	expected := []string{
+		"# TYPE test_requests_total counter",
+		`test_requests_total{session="3001",path="/a"} 3`,
+		`test_requests_total{session="3002",path="/\"quoted\"\n"} 1`,
+		"# TYPE test_latency_seconds histogram",
+		`test_latency_seconds_bucket{le="0.1"} 1`,
+		`test_latency_seconds_bucket{le="1"} 2`,
+		`test_latency_seconds_bucket{le="+Inf"} 3`,
+		"test_latency_seconds_sum 5.55",
+		"test_latency_seconds_count 3",
+		"test_ports 0",
+	}
+	for _, line := range expected {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("Expected %q in metrics :\n%s", line, out.String())
+		}
+	}
+
+	requests.forget("session", "3001")
+	out.Reset()
+	m.WriteTo(&out)
+	if strings.Contains(out.String(), `session="3001"`) || !strings.Contains(out.String(), `session="3002"`) {
+		t.Fatalf("Expected only the closed sessions series to be forgotten :\n%s", out.String())
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	router := gin.New()
+	router.GET("/metrics", MetricsHandler("scrape"))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected metrics to need the token but got %d", recorder.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer scrape")
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), "# TYPE praxis_sessions_created_total counter") {
+		t.Fatalf("Expected metrics but got %d %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestProxyMetrics(t *testing.T) {
+	// The end proxy refuses every CONNECT as unauthenticated
+	endProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusProxyAuthRequired)
+	}))
+	defer endProxy.Close()
+
+	underTest := Proxy{
+		URL:        endProxy.URL,
+		upperBound: 8086,
+		lowerBound: 8086,
+		freePorts:  makeRange(8086, 8086),
+	}
+	underTest.Identify(func(req *http.Request) string { return "crawler" })
+	id, proxy, err := underTest.Create(8086)
+	if err != nil {
+		t.Fatalf("Error encountered creating proxy : %+v", err)
+	}
+	defer proxy.Close()
+
+	time.Sleep(1 * time.Second)
+
+	client := &http.Client{Transport: &http.Transport{
+		Proxy: func(req *http.Request) (*url.URL, error) {
+			return url.Parse("http://localhost:8086")
+		},
+	}}
+	if _, err := client.Get("https://praxis.invalid/test"); err == nil {
+		t.Fatalf("Expected the CONNECT to be refused")
+	}
+
+	var out bytes.Buffer
+	metrics.WriteTo(&out)
+	upstream := upstreamLabel(endProxy.URL)
+	expected := []string{
+		`praxis_proxy_requests_total{type="connect",session="` + strconv.Itoa(id) + `",key="crawler",upstream="` + upstream + `"} 1`,
+		`praxis_upstream_auth_failures_total{type="connect",upstream="` + upstream + `"} 1`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("Expected %q in metrics :\n%s", line, out.String())
+		}
+	}
+
+	metrics.sessionClosed(id)
+	out.Reset()
+	metrics.WriteTo(&out)
+	if strings.Contains(out.String(), `session="`+strconv.Itoa(id)+`"`) {
+		t.Fatalf("Expected the closed sessions series to be forgotten")
+	}
+}
@@ -1,19 +1,24 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
-	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/elazarl/goproxy"
 )
@@ -21,6 +26,13 @@ import (
 const (
 	proxyAuthHeader = "Proxy-Authorization"
 	proxyModeVar    = "PROXY_MODE"
+
+	// upstreamErrorHeader is how the end proxy explains the errors it responds with
+	upstreamErrorHeader = "X-Luminati-Error"
+
+	// Types of proxied request, as labelled in metrics
+	plainRequest   = "request"
+	connectRequest = "connect"
 )
 
 // Proxy struct contains the configuration for the Praxis service
@@ -33,8 +45,28 @@ type Proxy struct {
 
 	freePorts []int
 	handlers  []func(*http.Request) error
+	meters    []func(*http.Request) ByteCounter
+	observers []func(*http.Request, *http.Response)
+
+	// sessionIDs allocates session ids, they are picked at random when unset
+	sessionIDs func() (int, error)
+
+	// debugSessions are the sessions being traced at runtime
+	debugSessions sessionDebug
+
+	// keyID names the key an allowed request was made with for metrics, they are unlabelled when unset
+	keyID func(req *http.Request) string
+
+	// recorders are handed the access entry of every request and CONNECT once it is done
+	recorders []func(entry *accessEntry)
+
+	// trustedProxies may set X-Forwarded-For, giving the client ip of access entries
+	trustedProxies []*net.IPNet
 
 	debug bool
+
+	// upstreamMutex guards the end proxy and debug settings, which may be reconfigured for new sessions
+	upstreamMutex sync.RWMutex
 }
 
 func appendSessionIfAllowed(proxyURL, username string, sessionID int) string {
@@ -61,50 +93,269 @@ func (p *Proxy) Use(handler func(req *http.Request) error) {
 	p.handlers = append(p.handlers, handler)
 }
 
+// handle runs all registered handlers against a request, returning the first error encountered
+func (p *Proxy) handle(req *http.Request) error {
+	for _, handler := range p.handlers {
+		if err := handler(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Meter will add a function creating a ByteCounter for each proxied request or CONNECT tunnel,
+// the function may return nil if the request should not be counted
+func (p *Proxy) Meter(meter func(req *http.Request) ByteCounter) {
+	p.meters = append(p.meters, meter)
+}
+
+// Observe will add a function called with each proxied request and its response, the response
+// is nil when the request could not be sent. CONNECT tunnels have no response to observe
+func (p *Proxy) Observe(observer func(req *http.Request, resp *http.Response)) {
+	p.observers = append(p.observers, observer)
+}
+
+// proxyRequest is kept on the goproxy context so response handlers see the request as the
+// request handlers left it, along with the counters metering it
+type proxyRequest struct {
+	req       *http.Request
+	counters  byteCounters
+	delivered ByteCounter
+	access    *accessEntry
+	started   time.Time
+	traced    bool
+}
+
+// UseSessionIDs will allocate session ids using `sessionIDs`, such as from a counter shared between instances
+func (p *Proxy) UseSessionIDs(sessionIDs func() (int, error)) {
+	p.sessionIDs = sessionIDs
+}
+
+// Identify will label the metrics of each allowed request with the key returned by `keyID`
+func (p *Proxy) Identify(keyID func(req *http.Request) string) {
+	p.keyID = keyID
+}
+
+// Trust will take the client ip of access entries from X-Forwarded-For when sent by `trustedProxies`
+func (p *Proxy) Trust(trustedProxies []*net.IPNet) {
+	p.trustedProxies = trustedProxies
+}
+
+// Record will add a function handed the access entry of each proxied request or CONNECT tunnel
+// once it is done, such as to write the access log
+func (p *Proxy) Record(recorder func(entry *accessEntry)) {
+	p.recorders = append(p.recorders, recorder)
+}
+
+// finish completes an access entry and hands it to every recorder
+func (p *Proxy) finish(entry *accessEntry) {
+	entry.Time = time.Now()
+	entry.Duration = entry.Time.Sub(entry.started).Seconds()
+	for _, recorder := range p.recorders {
+		recorder(entry)
+	}
+}
+
+// recordDenied records the access entry of a request refused by a handler
+func (p *Proxy) recordDenied(req *http.Request, requestType string, session int, upstream string, status int) {
+	entry := newAccessEntry(req, requestType, session, upstream, p.trustedProxies)
+	entry.Status = status
+	entry.denied = true
+	p.finish(entry)
+}
+
+func (p *Proxy) requestKey(req *http.Request) string {
+	if p.keyID == nil {
+		return ""
+	}
+	return p.keyID(req)
+}
+
+// requestLog tags the log lines of a proxied request with its request id and key
+func (p *Proxy) requestLog(sessionLog *Logger, req *http.Request) *Logger {
+	fields := Fields{"request_id": requestIDFromRequest(req)}
+	if key := p.requestKey(req); key != "" {
+		fields["key"] = key
+	}
+	return sessionLog.With(fields)
+}
+
+// counters creates the counters for a request, always including one for the session metrics
+func (p *Proxy) counters(req *http.Request, labels ...string) byteCounters {
+	counters := byteCounters{&metricsCounter{labels: labels}}
+	for _, meter := range p.meters {
+		if counter := meter(req); counter != nil {
+			counters = append(counters, counter)
+		}
+	}
+	return counters
+}
+
+// Reconfigure changes the end proxy and debug mode used by sessions created from now on
+func (p *Proxy) Reconfigure(upstream UpstreamConfig, debug bool) {
+	p.upstreamMutex.Lock()
+	defer p.upstreamMutex.Unlock()
+
+	p.URL = upstream.URL
+	p.username = upstream.Username
+	p.password = upstream.Password
+	p.debug = debug
+}
+
+func (p *Proxy) upstream() (UpstreamConfig, bool) {
+	p.upstreamMutex.RLock()
+	defer p.upstreamMutex.RUnlock()
+
+	return UpstreamConfig{URL: p.URL, Username: p.username, Password: p.password}, p.debug
+}
+
 // Create will create a new local reverse proxy for usage by other services
 func (p *Proxy) Create(localPort int) (int, *http.Server, error) {
 	sessionIdentifier := rand.Intn(1000)
+	if p.sessionIDs != nil {
+		id, err := p.sessionIDs()
+		if err != nil {
+			return -1, nil, err
+		}
+		sessionIdentifier = id
+	}
 
+	// Sessions keep the end proxy they were created with when it is reconfigured
+	upstream, debug := p.upstream()
+
+	sessionLog := proxyLog.With(Fields{"session": sessionIdentifier})
 	middleProxy := goproxy.NewProxyHttpServer()
-	proxyMode := os.Getenv(proxyModeVar)
-	if proxyMode == "debug" {
-		log.Printf("[PROXY] Debug mode for middle proxy has been set!")
-		p.debug = true
+	// goproxy logs every request and response in verbose mode, which is kept to the debug level
+	middleProxy.Logger = log.New(sessionLog.Writer(DebugLevel), "", 0)
+	if debug {
+		sessionLog.Infof("Debug mode for middle proxy has been set!")
 		middleProxy.Verbose = true
 	} else {
 		middleProxy.Verbose = false
 	}
 
 	middleProxy.Tr.Proxy = func(req *http.Request) (*url.URL, error) {
-		log.Printf("[PROXY] Attempting to use inside TRANSPORT proxy: %s", p.URL)
-		return url.Parse(p.URL)
+		sessionLog.Debugf("Attempting to use inside TRANSPORT proxy: %s", upstream.URL)
+		return url.Parse(upstream.URL)
 	}
 
-	log.Printf("Proxy is going to use end proxy of : %s", p.URL)
+	sessionLog.Infof("Proxy is going to use end proxy of : %s", upstream.URL)
 	connectDialHandler := func(req *http.Request) {
-		for _, handler := range p.handlers {
-			err := handler(req)
-			if err != nil {
-				// TODO : It's not currently possible to do the auth over the proxy
-				//        as the request doesn't include full headers or proxy headers yet
-				log.Printf("[PROXY] Error from handler : %+v", err)
-				// if !p.debug {
-				// 	req.Body.Close()
-				// }
+		setBasicAuth(appendSessionIfAllowed(upstream.URL, upstream.Username, sessionIdentifier), upstream.Password, req)
+	}
+
+	middleProxy.ConnectDial = connectThroughUpstream(upstream.URL, connectDialHandler)
+
+	session := strconv.Itoa(sessionIdentifier)
+	upstreamHost := upstreamLabel(upstream.URL)
+
+	// Sessions created in debug mode are always traced, others only while debugged at runtime.
+	// goproxy's own verbose logging is only on for the former, as it can't be changed once serving
+	tracing := func() bool {
+		_, debugging := p.debugging(sessionIdentifier)
+		return debug || debugging
+	}
+
+	// Handlers are run against the clients own CONNECT or plain http request, as the
+	// CONNECT sent to the end proxy does not carry any of the clients headers
+	middleProxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		ctx.Req = withRequestID(withSession(ctx.Req, sessionIdentifier))
+		if err := p.handle(ctx.Req); err != nil {
+			p.requestLog(sessionLog, ctx.Req).Warnf("rejected CONNECT to %s : %+v", host, err)
+			ctx.Resp = errorResponse(ctx.Req, err)
+			p.recordDenied(ctx.Req, connectRequest, sessionIdentifier, upstreamHost, ctx.Resp.StatusCode)
+			return goproxy.RejectConnect, host
+		}
+
+		// Tunnels are dialed and copied here so the bytes can be counted
+		key := p.requestKey(ctx.Req)
+		metrics.proxyRequests.add(1, connectRequest, session, key, upstreamHost)
+		access := &accessCounter{entry: newAccessEntry(ctx.Req, connectRequest, sessionIdentifier, upstreamHost, p.trustedProxies), finish: p.finish}
+		access.entry.Key = key
+		counters := append(p.counters(ctx.Req, session, key, upstreamHost), access)
+		requestLog := p.requestLog(sessionLog, ctx.Req)
+		traced := tracing()
+		if traced {
+			requestLog.Verbose().Debugf("CONNECT %s headers %v", host, redactHeaders(ctx.Req.Header))
+		}
+
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host += ":80"
+		}
+		started := time.Now()
+		targetConn, err := middleProxy.ConnectDial("tcp", host)
+		if err != nil {
+			requestLog.Errorf("unable to CONNECT to %s : %+v", host, err)
+			metrics.upstreamFailed(connectRequest, upstreamHost, err)
+			ctx.Resp = praxisErrorResponse(ctx.Req, http.StatusBadGateway, "error connecting through end proxy")
+			access.entry.Status = ctx.Resp.StatusCode
+			access.entry.UpstreamError = err.Error()
+			if refused, ok := err.(*upstreamRefusedError); ok && refused.Reason != "" {
+				access.entry.UpstreamError = refused.Reason
 			}
+			counters.Close()
+			return goproxy.RejectConnect, host
+		}
+		metrics.upstreamDuration.observe(time.Since(started).Seconds(), connectRequest, upstreamHost)
+		access.entry.Status = http.StatusOK
+		if upstreamConn, ok := targetConn.(*upstreamConn); ok {
+			access.entry.ExitIP = upstreamConn.exitIP
 		}
-		setBasicAuth(appendSessionIfAllowed(p.URL, p.username, sessionIdentifier), p.password, req)
-	}
 
-	middleProxy.ConnectDial = middleProxy.NewConnectDialToProxyWithHandler(p.URL, connectDialHandler)
+		return &goproxy.ConnectAction{
+			Action: goproxy.ConnectHijack,
+			Hijack: func(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
+				target := &meteredConn{Conn: targetConn, counter: counters, received: access.delivered()}
+				tunnel(client, target)
+				if err := target.abortErr(); err != nil {
+					requestLog.Warnf("aborted CONNECT to %s : %+v", host, err)
+				}
+				if traced {
+					requestLog.Verbose().Debugf("closed CONNECT to %s after %s", host, time.Since(started).Round(time.Millisecond))
+				}
+			},
+		}, host
+	})
+
+	middleProxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		req = withRequestID(withSession(req, sessionIdentifier))
+		if err := p.handle(req); err != nil {
+			p.requestLog(sessionLog, req).Warnf("rejected request to %s : %+v", req.Host, err)
+			resp := errorResponse(req, err)
+			p.recordDenied(req, plainRequest, sessionIdentifier, upstreamHost, resp.StatusCode)
+			return req, resp
+		}
+
+		key := p.requestKey(req)
+		metrics.proxyRequests.add(1, plainRequest, session, key, upstreamHost)
+		access := &accessCounter{entry: newAccessEntry(req, plainRequest, sessionIdentifier, upstreamHost, p.trustedProxies), finish: p.finish}
+		access.entry.Key = key
+		counters := append(p.counters(req, session, key, upstreamHost), access)
+		if req.Body != nil {
+			req.Body = &meteredBody{ReadCloser: req.Body, counter: counters}
+		}
+		proxied := &proxyRequest{req: req, counters: counters, delivered: access.delivered(), access: access.entry, started: time.Now(), traced: tracing()}
+		ctx.UserData = proxied
+		if proxied.traced {
+			p.requestLog(sessionLog, req).Verbose().Debugf("%s %s headers %v", req.Method, req.URL, redactHeaders(req.Header))
+		}
+		req.Header.Del(authKeyHeader)
+		return req, nil
+	})
 
 	middleProxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		// The reason the end proxy gives for an error is kept before it is stripped
+		if proxied, ok := ctx.UserData.(*proxyRequest); ok && resp != nil {
+			proxied.access.UpstreamError = resp.Header.Get(upstreamErrorHeader)
+		}
+
 		// Handle 407 Proxy Authentication Required
-		if resp.StatusCode == http.StatusProxyAuthRequired {
-			errorString := resp.Header["X-Luminati-Error"]
+		if resp != nil && resp.StatusCode == http.StatusProxyAuthRequired {
+			errorString := resp.Header[upstreamErrorHeader]
 			errorString2 := resp.Header["Proxy-Authenticate"]
 
-			log.Printf("[PROXY] session %d proxy authentication failed for to auth proxy : %s : %s", sessionIdentifier, errorString, errorString2)
+			sessionLog.Errorf("proxy authentication failed for to auth proxy : %s : %s", errorString, errorString2)
+			metrics.upstreamAuth.add(1, plainRequest, upstreamHost)
 
 			resp.StatusCode = http.StatusServiceUnavailable
 			resp.Header = stripHeaders(resp.Header)
@@ -119,6 +370,42 @@ func (p *Proxy) Create(localPort int) (int, *http.Server, error) {
 		return resp
 	})
 
+	middleProxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		proxied, ok := ctx.UserData.(*proxyRequest)
+		if !ok {
+			return resp
+		}
+		for _, observer := range p.observers {
+			observer(proxied.req, resp)
+		}
+
+		if proxied.traced {
+			traceLog := p.requestLog(sessionLog, proxied.req).Verbose()
+			if resp == nil {
+				traceLog.Debugf("%s %s failed after %s : %+v", proxied.req.Method, proxied.req.URL, time.Since(proxied.started).Round(time.Millisecond), ctx.Error)
+			} else {
+				traceLog.Debugf("%s %s responded %d in %s headers %v", proxied.req.Method, proxied.req.URL, resp.StatusCode, time.Since(proxied.started).Round(time.Millisecond), redactHeaders(resp.Header))
+			}
+		}
+
+		if resp == nil {
+			metrics.upstreamDial.add(1, plainRequest, upstreamHost)
+			// goproxy answers requests which could not be sent with a 500
+			proxied.access.Status = http.StatusInternalServerError
+			if ctx.Error != nil {
+				proxied.access.UpstreamError = ctx.Error.Error()
+			}
+			proxied.counters.Close()
+		} else {
+			proxied.access.Status = resp.StatusCode
+			proxied.access.ExitIP = resp.Header.Get(exitIPHeader)
+			proxied.access.contentType = resp.Header.Get("Content-Type")
+			metrics.upstreamDuration.observe(time.Since(proxied.started).Seconds(), plainRequest, upstreamHost)
+			resp.Body = &meteredBody{ReadCloser: resp.Body, counter: byteCounters{proxied.counters, proxied.delivered}, closeCounter: true}
+		}
+		return resp
+	})
+
 	// If this is localhost, it would work outside of docker, however inside
 	// docker containers, it will not be exposed properly
 	address := fmt.Sprintf("0.0.0.0:%d", localPort)
@@ -130,30 +417,106 @@ func (p *Proxy) Create(localPort int) (int, *http.Server, error) {
 	var ret error
 	go func() {
 		if ret := proxy.ListenAndServe(); ret != http.ErrServerClosed {
-			log.Fatalf("ListenAndServe(): %v", ret)
+			sessionLog.Fatalf("ListenAndServe(): %v", ret)
 		}
 	}()
 
 	if ret != nil {
-		log.Printf("[PROXY] session %d attempted listening on %s but encountered an error : %+v", sessionIdentifier, address, ret)
+		sessionLog.Errorf("attempted listening on %s but encountered an error : %+v", address, ret)
 	} else {
-		if p.debug {
+		if debug {
 			err := getIPAddress(fmt.Sprintf("http://%s", address))
 			if err != nil {
 				proxy.Shutdown(context.TODO())
 				return -1, nil, err
 			}
 		}
-		log.Printf("[PROXY] session %d listening on %s", sessionIdentifier, address)
+		sessionLog.Infof("listening on %s", address)
 	}
 
 	return sessionIdentifier, proxy, ret
 }
 
+// upstreamRefusedError is returned when the end proxy refuses to open a CONNECT tunnel
+type upstreamRefusedError struct {
+	Status int
+	Body   string
+	// Reason is the X-Luminati-Error the end proxy refused with, if any
+	Reason string
+}
+
+func (e *upstreamRefusedError) Error() string {
+	return fmt.Sprintf("end proxy refused connection with %d : %s", e.Status, e.Body)
+}
+
+// connectThroughUpstream dials tunnels through the end proxy like goproxy's own
+// NewConnectDialToProxyWithHandler, but keeps the status the end proxy refused with
+func connectThroughUpstream(upstream string, prepare func(req *http.Request)) func(network, addr string) (net.Conn, error) {
+	return func(network, addr string) (net.Conn, error) {
+		u, err := url.Parse(upstream)
+		if err != nil {
+			return nil, err
+		}
+		host := u.Host
+		if u.Port() == "" {
+			port := "80"
+			if u.Scheme == "https" {
+				port = "443"
+			}
+			host = net.JoinHostPort(u.Hostname(), port)
+		}
+
+		conn, err := net.Dial(network, host)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme == "https" {
+			conn = tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		}
+
+		connectReq := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: make(http.Header),
+		}
+		prepare(connectReq)
+		if err := connectReq.Write(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		// The target does not speak until spoken to, so nothing is lost to the buffered reader
+		resp, err := http.ReadResponse(bufio.NewReader(conn), connectReq)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 500))
+			conn.Close()
+			return nil, &upstreamRefusedError{Status: resp.StatusCode, Body: string(body), Reason: resp.Header.Get(upstreamErrorHeader)}
+		}
+		return &upstreamConn{Conn: conn, exitIP: resp.Header.Get(exitIPHeader)}, nil
+	}
+}
+
+// upstreamConn is a tunnel opened through the end proxy, along with the exit ip it reported
+type upstreamConn struct {
+	net.Conn
+	exitIP string
+}
+
+// CloseWrite passes on the end of the clients data through the end proxy, see closeWrite
+func (c *upstreamConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
 func getIPAddress(proxy string) error {
 	request, err := http.NewRequest("GET", "https://api.ipify.org?format=json", nil)
 	if err != nil {
-		log.Fatalf("new request failed:%v", err)
+		proxyLog.Fatalf("new request failed:%v", err)
 	}
 
 	cfg := &tls.Config{
@@ -162,7 +525,7 @@ func getIPAddress(proxy string) error {
 	tr := &http.Transport{
 		TLSClientConfig: cfg,
 		Proxy: func(req *http.Request) (*url.URL, error) {
-			log.Printf("Attempting to use proxy inside transport for getipaddress: %s", proxy)
+			proxyLog.Debugf("Attempting to use proxy inside transport for getipaddress: %s", proxy)
 			return url.Parse(proxy)
 		},
 	}
@@ -171,17 +534,17 @@ func getIPAddress(proxy string) error {
 	}
 	rsp, err := client.Do(request)
 	if err != nil {
-		log.Printf("get rsp failed:%v", err)
+		proxyLog.Errorf("get rsp failed:%v", err)
 		return err
 	}
 	defer rsp.Body.Close()
 	data, _ := ioutil.ReadAll(rsp.Body)
 
 	if rsp.StatusCode != http.StatusOK {
-		log.Printf("status %d, data %s", rsp.StatusCode, data)
+		proxyLog.Warnf("status %d, data %s", rsp.StatusCode, data)
 	}
 
-	log.Printf("rsp:%s", data)
+	proxyLog.Infof("rsp:%s", data)
 	return nil
 }
 
@@ -191,7 +554,7 @@ func getIPAddress(proxy string) error {
 func stripHeaders(header http.Header) http.Header {
 	toBeStripped := []string{
 		"Proxy-Authenticate",
-		"X-Luminati-Error",
+		upstreamErrorHeader,
 	}
 
 	for _, toStrip := range toBeStripped {
@@ -200,3 +563,51 @@ func stripHeaders(header http.Header) http.Header {
 
 	return header
 }
+
+// errorResponse builds a praxis_error response for a request rejected by a handler, using the
+// status and retry information from an authError when available
+func errorResponse(req *http.Request, err error) *http.Response {
+	authErr, isAuthErr := err.(*authError)
+	if !isAuthErr {
+		return praxisErrorResponse(req, http.StatusForbidden, err.Error())
+	}
+
+	resp := praxisErrorResponse(req, authErr.Status, authErr.Message)
+	if authErr.RetryAfter > 0 {
+		resp.Header.Set(retryAfterHeader, authErr.retryAfterSeconds())
+	}
+	return resp
+}
+
+func praxisErrorResponse(req *http.Request, status int, message string) *http.Response {
+	jsonMap := map[string]string{"praxis_error": message}
+	respByte, _ := json.Marshal(jsonMap)
+	resp := goproxy.NewResponse(req, "application/json", status, string(respByte))
+	// Rejected CONNECTs are written directly to the client connection, so needs a protocol
+	resp.ProtoMajor, resp.ProtoMinor = 1, 1
+	return resp
+}
+
+// tunnel copies between the client and target until both sides are done. Each side is half
+// closed once the other has nothing more to send, so EOFs are passed on, while an error in
+// either direction, such as the target being aborted by its counter, closes both
+func tunnel(client net.Conn, target *meteredConn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	pipe := func(dst, src net.Conn) {
+		defer wg.Done()
+		if _, err := io.Copy(dst, src); err != nil {
+			client.Close()
+			target.Close()
+			return
+		}
+		closeWrite(dst)
+	}
+	go pipe(target, client)
+	go pipe(client, target)
+	wg.Wait()
+
+	client.Close()
+	target.Close()
+	target.counter.Close()
+}
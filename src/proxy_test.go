@@ -1,10 +1,13 @@
 package main
 
 import (
+	"bufio"
 	"crypto/tls"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
@@ -87,3 +90,167 @@ func TestCreate(t *testing.T) {
 		t.Fatalf("Expected to get %s but got %s", magicString, data)
 	}
 }
+
+func TestCreateRejectedByHandler(t *testing.T) {
+	underTest := Proxy{
+		URL:        "http://localhost:8082",
+		upperBound: 8085,
+		lowerBound: 8085,
+		freePorts:  makeRange(8085, 8085),
+	}
+	underTest.Use(func(req *http.Request) error {
+		return &authError{Status: http.StatusTooManyRequests, RetryAfter: 1500 * time.Millisecond, Message: "Rate limit exceeded"}
+	})
+
+	_, proxy, err := underTest.Create(8085)
+	if err != nil {
+		t.Fatalf("Error encountered creating proxy : %+v", err)
+	}
+	defer proxy.Close()
+
+	time.Sleep(1 * time.Second)
+
+	// Plain http requests should get the handlers error directly
+	tr := &http.Transport{
+		Proxy: func(req *http.Request) (*url.URL, error) {
+			return url.Parse("http://localhost:8085")
+		},
+	}
+	client := &http.Client{Transport: tr}
+	rsp, err := client.Get("http://praxis.invalid/test")
+	if err != nil {
+		t.Fatalf("get rsp failed:%v", err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Expected status %d but got %d", http.StatusTooManyRequests, rsp.StatusCode)
+	}
+	if rsp.Header.Get(retryAfterHeader) != "2" {
+		t.Fatalf("Expected Retry-After of 2 but got %s", rsp.Header.Get(retryAfterHeader))
+	}
+
+	// CONNECT requests should be rejected before ever reaching the end proxy
+	conn, err := net.Dial("tcp", "localhost:8085")
+	if err != nil {
+		t.Fatalf("Unable to dial proxy : %+v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT praxis.invalid:443 HTTP/1.1\r\nHost: praxis.invalid:443\r\n\r\n")
+	connectRsp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("Unable to read CONNECT response : %+v", err)
+	}
+	if connectRsp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Expected CONNECT status %d but got %d", http.StatusTooManyRequests, connectRsp.StatusCode)
+	}
+}
+
+// connectEndProxy accepts CONNECTs, then echoes how much a tunnel to echo.invalid was sent
+// once the client is done, or sends a tunnel to download.invalid `download` bytes
+func connectEndProxy(t *testing.T, download int) net.Listener {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Unable to listen : %+v", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				req, err := http.ReadRequest(reader)
+				if err != nil {
+					return
+				}
+				fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\n\r\n")
+				if req.Host == "download.invalid:443" {
+					conn.Write(make([]byte, download))
+					return
+				}
+				sent, _ := io.Copy(ioutil.Discard, reader)
+				fmt.Fprintf(conn, "read %d bytes", sent)
+			}(conn)
+		}
+	}()
+	return listener
+}
+
+func TestConnectTunnelBandwidth(t *testing.T) {
+	endProxy := connectEndProxy(t, 4*bandwidthFlushBytes)
+	defer endProxy.Close()
+
+	store, _ := NewMemoryStore("")
+	keyHash, _ := hashAuthKeySecret("supersecret")
+	config := AuthConfig{ServiceName: "praxis", AuthKeys: []AuthWithLimit{{ID: "crawler", KeyHash: keyHash, DailyBytes: 64 * 1024}}}
+	underTest := Proxy{
+		URL:        "http://" + endProxy.Addr().String(),
+		upperBound: 8090,
+		lowerBound: 8090,
+		freePorts:  makeRange(8090, 8090),
+	}
+	underTest.Meter(BandwidthLimit(config, store))
+	logged := make(chan *accessEntry, 2)
+	underTest.Record(func(entry *accessEntry) { logged <- entry })
+	_, proxy, err := underTest.Create(8090)
+	if err != nil {
+		t.Fatalf("Error encountered creating proxy : %+v", err)
+	}
+	defer proxy.Close()
+
+	time.Sleep(1 * time.Second)
+
+	connect := func(host string) (*net.TCPConn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", "localhost:8090")
+		if err != nil {
+			t.Fatalf("Unable to dial proxy : %+v", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n%s: crawler.supersecret\r\n\r\n", host, host, authKeyHeader)
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected the CONNECT to be accepted but got %+v : %+v", resp, err)
+		}
+		return conn.(*net.TCPConn), reader
+	}
+	counted := func() int64 {
+		counts, _ := store.GetCounters(config.bytesKey("crawler", DailyWindow.current(time.Now(), time.UTC)))
+		return counts[0]
+	}
+
+	// Both ends see the others EOF while still able to send
+	conn, reader := connect("echo.invalid:443")
+	conn.Write([]byte("ping"))
+	conn.CloseWrite()
+	echoed, err := ioutil.ReadAll(reader)
+	conn.Close()
+	if err != nil || string(echoed) != "read 4 bytes" {
+		t.Fatalf("Expected the tunnel to be half closed both ways but got %q : %+v", echoed, err)
+	}
+	for i := 0; i < 10 && counted() == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if counted() != int64(len("ping")+len(echoed)) {
+		t.Fatalf("Expected %d bytes counted but got %d", len("ping")+len(echoed), counted())
+	}
+	if entry := <-logged; entry.Bytes != int64(len(echoed)) {
+		t.Fatalf("Expected only the %d bytes delivered to the client logged but got %d", len(echoed), entry.Bytes)
+	}
+
+	// The tunnel is cut once the quota is exceeded rather than left hanging
+	conn, reader = connect("download.invalid:443")
+	defer conn.Close()
+	downloaded, err := io.Copy(ioutil.Discard, reader)
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		t.Fatalf("Expected the tunnel to be closed once over quota but it hung")
+	}
+	if downloaded >= 4*bandwidthFlushBytes {
+		t.Fatalf("Expected the tunnel to be aborted but got all %d bytes", downloaded)
+	}
+	if counted() < bandwidthFlushBytes {
+		t.Fatalf("Expected the aborted tunnel to be counted but got %d bytes", counted())
+	}
+}
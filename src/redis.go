@@ -2,67 +2,56 @@ package main
 
 import (
 	"fmt"
-	"os"
-	"os/signal"
-	"syscall"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
 )
 
-const (
-	keyTimeToLive = 604800 // 7 days worth of seconds
-)
-
 var (
 	pool *redis.Pool
 )
 
-// Redis Struct for simplistic usage as an object
+// Redis Struct for simplistic usage as an object, implementing Store
 type Redis struct{}
 
-// Init will initialize a redis host connection
-func (r *Redis) Init() {
-	redisHost := os.Getenv("REDIS_HOST")
-	if redisHost == "" {
-		redisHost = ":6379"
-	}
-	pool = r.NewPool(redisHost)
-	cleanupHook()
+// Init will initialize a redis connection pool using `config`
+func (r *Redis) Init(config RedisConfig) {
+	pool = r.NewPool(config)
 }
 
-// NewPool will connect to a new server as specified by the 'server' parameter
-func (r *Redis) NewPool(server string) *redis.Pool {
+// NewPool will connect to a new server as specified by the 'config' parameter
+func (r *Redis) NewPool(config RedisConfig) *redis.Pool {
 	return &redis.Pool{
 
-		MaxIdle:     3,
-		IdleTimeout: 240 * time.Second,
+		MaxIdle:     config.MaxIdle,
+		MaxActive:   config.MaxActive,
+		IdleTimeout: config.IdleTimeout,
+		// Wait for a connection rather than failing once MaxActive are in use
+		Wait: config.MaxActive > 0,
 
+		// Connections are timed for the store latency metrics
 		Dial: func() (redis.Conn, error) {
-			c, err := redis.Dial("tcp", server)
+			conn, err := config.dial()
 			if err != nil {
 				return nil, err
 			}
-			return c, err
+			return timedConn{conn}, nil
 		},
 
 		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			// Connections may have been made to a master which has since been failed over
+			if len(config.Sentinels) > 0 {
+				return checkMaster(c)
+			}
 			_, err := c.Do("PING")
 			return err
 		},
 	}
 }
 
-func cleanupHook() {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	signal.Notify(c, syscall.SIGTERM)
-	signal.Notify(c, syscall.SIGKILL)
-	go func() {
-		<-c
-		pool.Close()
-		os.Exit(0)
-	}()
+// Close the connection pool
+func (r *Redis) Close() error {
+	return pool.Close()
 }
 
 // Ping redis to ensure this is a connection
@@ -84,6 +73,9 @@ func (r *Redis) Get(key string) ([]byte, error) {
 
 	var data []byte
 	data, err := redis.Bytes(conn.Do("GET", key))
+	if err == redis.ErrNil {
+		return nil, &notFoundError{key: key}
+	}
 	if err != nil {
 		return data, fmt.Errorf("error getting key %s: %v", key, err)
 	}
@@ -106,6 +98,18 @@ func (r *Redis) Set(key string, value []byte) error {
 	return err
 }
 
+// SetEx sets `key` to `value`, expiring it after `ttl` seconds
+func (r *Redis) SetEx(key string, value []byte, ttl int) error {
+	conn := pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("SETEX", key, ttl, value)
+	if err != nil {
+		return fmt.Errorf("error setting key %s: %v", key, err)
+	}
+	return nil
+}
+
 // Exists returns if `key` exists in redis db
 func (r *Redis) Exists(key string) (bool, error) {
 	conn := pool.Get()
@@ -152,15 +156,73 @@ func (r *Redis) GetKeys(pattern string) ([]string, error) {
 	return keys, nil
 }
 
-// Incr will increment a counter based on `counterKey` with a default expiration of 7 days
-func (r *Redis) Incr(counterKey string) (int, error) {
+// tokenBucketScript refills the bucket stored at KEYS[1] by ARGV[1] tokens per second, capped
+// at ARGV[2], then attempts to take a single token. The redis clock is used so all instances
+// sharing the bucket agree on the refill rate. Returns {allowed, milliseconds until next token}
+var tokenBucketScript = redis.NewScript(1, `
+redis.replicate_commands()
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call("TIME")
+local now = tonumber(time[1]) + tonumber(time[2]) / 1000000
+
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(bucket[1]) or burst
+local ts = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) / rate * 1000)
+end
+
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "ts", tostring(now))
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {allowed, wait}
+`)
+
+// TakeToken attempts to take a token from the bucket at `key` which refills at `rate` per second
+// up to `burst` tokens, returning if it was allowed and otherwise how long until a token is available
+func (r *Redis) TakeToken(key string, rate float64, burst int64) (bool, time.Duration, error) {
 	conn := pool.Get()
 	defer conn.Close()
 
-	i, err := conn.Do("INCR", counterKey)
+	result, err := redis.Int64s(tokenBucketScript.Do(conn, key, rate, burst))
+	if err != nil || len(result) != 2 {
+		return false, 0, fmt.Errorf("error taking token from %s: %v", key, err)
+	}
+	return result[0] == 1, time.Duration(result[1]) * time.Millisecond, nil
+}
+
+// IncrBy will increment a counter based on `counterKey` by `amount`, expiring it after `ttl` seconds
+func (r *Redis) IncrBy(counterKey string, amount int64, ttl int) (int64, error) {
+	conn := pool.Get()
+	defer conn.Close()
+
+	i, err := redis.Int64(conn.Do("INCRBY", counterKey, amount))
+	if err != nil || ttl <= 0 {
+		return i, err
+	}
+	_, err = conn.Do("EXPIRE", counterKey, ttl)
+	return i, err
+}
+
+// GetCounters returns the values of all counters in `keys`, with missing counters as zero
+func (r *Redis) GetCounters(keys ...string) ([]int64, error) {
+	conn := pool.Get()
+	defer conn.Close()
+
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		args[i] = key
+	}
+	counters, err := redis.Int64s(conn.Do("MGET", args...))
 	if err != nil {
-		return redis.Int(i, err)
+		return counters, fmt.Errorf("error getting counters %v: %v", keys, err)
 	}
-	_, err = conn.Do("EXPIRE", counterKey, keyTimeToLive)
-	return redis.Int(i, err)
+	return counters, nil
 }
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Scope grants a key access to a set of api routes
+type Scope string
+
+const (
+	// ScopeSessionsCreate allows creating sessions, and reading or closing the sessions it created
+	ScopeSessionsCreate Scope = "sessions:create"
+	// ScopeSessionsReadAll allows reading sessions created by any key
+	ScopeSessionsReadAll Scope = "sessions:read-all"
+	// ScopeSessionsAdmin allows closing sessions created by any key
+	ScopeSessionsAdmin Scope = "sessions:admin"
+	// ScopeUsageRead allows a key to read its own usage
+	ScopeUsageRead Scope = "usage:read"
+	// ScopeUsageReadAll allows reading the usage of every key
+	ScopeUsageReadAll Scope = "usage:read-all"
+	// ScopeKeysAdmin allows creating, listing and revoking keys
+	ScopeKeysAdmin Scope = "keys:admin"
+)
+
+// Role is a preset group of scopes which can be given to a key
+type Role string
+
+const (
+	RoleClient   Role = "client"
+	RoleOperator Role = "operator"
+	RoleAdmin    Role = "admin"
+)
+
+var roleScopes = map[Role][]Scope{
+	RoleClient: []Scope{
+		ScopeSessionsCreate,
+		ScopeUsageRead,
+	},
+	RoleOperator: []Scope{
+		ScopeSessionsCreate,
+		ScopeSessionsReadAll,
+		ScopeSessionsAdmin,
+		ScopeUsageRead,
+		ScopeUsageReadAll,
+	},
+	RoleAdmin: []Scope{
+		ScopeSessionsCreate,
+		ScopeSessionsReadAll,
+		ScopeSessionsAdmin,
+		ScopeUsageRead,
+		ScopeUsageReadAll,
+		ScopeKeysAdmin,
+	},
+}
+
+func (s Scope) valid() bool {
+	for _, scope := range roleScopes[RoleAdmin] {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (r Role) valid() bool {
+	if r == "" {
+		return true
+	}
+	_, ok := roleScopes[r]
+	return ok
+}
+
+// role returns the keys role, keys without a role or scopes of their own are clients
+func (k *AuthWithLimit) role() Role {
+	if k.Role == "" && len(k.Scopes) == 0 {
+		return RoleClient
+	}
+	return k.Role
+}
+
+// hasScope checks both the scopes granted by the keys role and those given to it directly
+func (k *AuthWithLimit) hasScope(scope Scope) bool {
+	for _, granted := range roleScopes[k.role()] {
+		if granted == scope {
+			return true
+		}
+	}
+	for _, granted := range k.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// validateAccess ensures the keys role and scopes are all known
+func (k *AuthWithLimit) validateAccess() error {
+	if !k.Role.valid() {
+		return fmt.Errorf("Unknown role %s", k.Role)
+	}
+	for _, scope := range k.Scopes {
+		if !scope.valid() {
+			return fmt.Errorf("Unknown scope %s", scope)
+		}
+	}
+	return nil
+}
+
+// RequireScope is a middleware which only allows through keys granted `scope`, it must be
+// used after the AuthLimit middleware
+func RequireScope(scope Scope) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		keyConfig := authorizedKey(context)
+		if keyConfig == nil || !keyConfig.hasScope(scope) {
+			context.AbortWithError(http.StatusForbidden, fmt.Errorf("Key is missing the %s scope", scope))
+			return
+		}
+	}
+}
+
+// RequireAnyScope is a middleware which only allows through keys granted at least one of `scopes`,
+// such as routes open to a sessions owner as well as to those who can see every session
+func RequireAnyScope(scopes ...Scope) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		keyConfig := authorizedKey(context)
+		if keyConfig != nil {
+			for _, scope := range scopes {
+				if keyConfig.hasScope(scope) {
+					return
+				}
+			}
+		}
+		context.AbortWithError(http.StatusForbidden, fmt.Errorf("Key is missing one of the %v scopes", scopes))
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestHasScope(t *testing.T) {
+	client := AuthWithLimit{ID: "crawler"}
+	if !client.hasScope(ScopeSessionsCreate) || !client.hasScope(ScopeUsageRead) {
+		t.Fatalf("Expected keys without a role to be clients")
+	}
+	if client.hasScope(ScopeKeysAdmin) || client.hasScope(ScopeUsageReadAll) {
+		t.Fatalf("Expected clients not to manage keys or read all usage")
+	}
+
+	scoped := AuthWithLimit{ID: "reporting", Scopes: []Scope{ScopeUsageReadAll}}
+	if !scoped.hasScope(ScopeUsageReadAll) {
+		t.Fatalf("Expected directly granted scope to be allowed")
+	}
+	if scoped.hasScope(ScopeSessionsCreate) {
+		t.Fatalf("Expected keys with only scopes not to get the client role")
+	}
+
+	admin := AuthWithLimit{ID: "admin", Role: RoleAdmin}
+	if !admin.hasScope(ScopeKeysAdmin) {
+		t.Fatalf("Expected admins to manage keys")
+	}
+}
+
+func TestValidateAccess(t *testing.T) {
+	if err := (&AuthWithLimit{Role: "superuser"}).validateAccess(); err == nil {
+		t.Fatalf("Expected unknown role to be invalid")
+	}
+	if err := (&AuthWithLimit{Scopes: []Scope{"sessions:destroy"}}).validateAccess(); err == nil {
+		t.Fatalf("Expected unknown scope to be invalid")
+	}
+	if err := (&AuthWithLimit{Role: RoleOperator, Scopes: []Scope{ScopeKeysAdmin}}).validateAccess(); err != nil {
+		t.Fatalf("Unexpected error validating access : %+v", err)
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	context, _ := gin.CreateTestContext(recorder)
+	context.Set(authKeyContext, &AuthWithLimit{ID: "crawler"})
+
+	RequireScope(ScopeKeysAdmin)(context)
+	if !context.IsAborted() || recorder.Code != http.StatusForbidden {
+		t.Fatalf("Expected missing scope to be forbidden but got %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	context, _ = gin.CreateTestContext(recorder)
+	context.Set(authKeyContext, &AuthWithLimit{ID: "crawler"})
+
+	RequireScope(ScopeSessionsCreate)(context)
+	if context.IsAborted() {
+		t.Fatalf("Expected granted scope to be allowed through")
+	}
+}
+
+func TestRequireAnyScope(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	context, _ := gin.CreateTestContext(recorder)
+	context.Set(authKeyContext, &AuthWithLimit{ID: "reader", Scopes: []Scope{ScopeUsageRead}})
+
+	RequireAnyScope(ScopeSessionsCreate, ScopeSessionsReadAll)(context)
+	if !context.IsAborted() || recorder.Code != http.StatusForbidden {
+		t.Fatalf("Expected a key with neither scope to be forbidden but got %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	context, _ = gin.CreateTestContext(recorder)
+	context.Set(authKeyContext, &AuthWithLimit{ID: "auditor", Scopes: []Scope{ScopeSessionsReadAll}})
+
+	RequireAnyScope(ScopeSessionsCreate, ScopeSessionsReadAll)(context)
+	if context.IsAborted() {
+		t.Fatalf("Expected a key with either scope to be allowed through")
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRollupInterval  = time.Hour
+	defaultRollupRetention = 24 // months
+)
+
+// UsageMonth is the long term summary of a keys usage over a month, kept well after the
+// daily counters have expired. Days are kept so repeated rollups never count twice
+type UsageMonth struct {
+	Key      string              `json:"key"`
+	Month    string              `json:"month"`
+	Requests int64               `json:"requests"`
+	Bytes    int64               `json:"bytes"`
+	Denied   int64               `json:"denied"`
+	Days     map[string]UsageDay `json:"days,omitempty"`
+	Updated  time.Time           `json:"updated"`
+}
+
+// merge adds the days to the summary, counters only grow so the largest count seen for a
+// day is kept, as its counters may have expired by the time of a later rollup
+func (m *UsageMonth) merge(days []UsageDay) {
+	for _, day := range days {
+		existing := m.Days[day.Date]
+		if day.Requests < existing.Requests {
+			day.Requests = existing.Requests
+		}
+		if day.Bytes < existing.Bytes {
+			day.Bytes = existing.Bytes
+		}
+		if day.Denied < existing.Denied {
+			day.Denied = existing.Denied
+		}
+		m.Days[day.Date] = day
+	}
+
+	m.Requests, m.Bytes, m.Denied = 0, 0, 0
+	for _, day := range m.Days {
+		m.Requests += day.Requests
+		m.Bytes += day.Bytes
+		m.Denied += day.Denied
+	}
+}
+
+// archivedDay is a single line of a usage archive
+type archivedDay struct {
+	Key string `json:"key"`
+	UsageDay
+}
+
+// Rollup periodically summarises usage into months, optionally archiving each closed day
+type Rollup struct {
+	config *AuthConfig
+	store  Store
+
+	interval   time.Duration
+	retention  int
+	archiveDir string
+}
+
+// parseRollupEnv reads how often to roll up usage and how many months of it to keep
+func parseRollupEnv() (time.Duration, int, error) {
+	interval, err := envDuration("ROLLUP_INTERVAL", defaultRollupInterval)
+	if err != nil {
+		return 0, 0, err
+	}
+	if interval <= 0 {
+		return 0, 0, fmt.Errorf("ROLLUP_INTERVAL must be positive, got %s", interval)
+	}
+	retention, err := envInt("ROLLUP_RETENTION_MONTHS", defaultRollupRetention)
+	if err != nil {
+		return 0, 0, err
+	}
+	if retention < 0 {
+		return 0, 0, fmt.Errorf("ROLLUP_RETENTION_MONTHS can't be negative, got %d", retention)
+	}
+	return interval, retention, nil
+}
+
+// loadRollup reads the rollup configuration from the environment
+func loadRollup(config *AuthConfig, store Store) *Rollup {
+	interval, retention, err := parseRollupEnv()
+	if err != nil {
+		panic(fmt.Sprintf("Failed to parse rollup configuration : %+v", err))
+	}
+
+	return &Rollup{
+		config:     config,
+		store:      store,
+		interval:   interval,
+		retention:  retention,
+		archiveDir: os.Getenv("USAGE_ARCHIVE_DIR"),
+	}
+}
+
+func (c *AuthConfig) rollupKey(key, month string) string {
+	return fmt.Sprintf("rollup:%s:%s:%s", c.ServiceName, key, month)
+}
+
+// start runs the rollup now and then every interval
+func (r *Rollup) start() {
+	go func() {
+		for {
+			if err := r.run(time.Now()); err != nil {
+				rollupLog.Errorf("Error occured rolling up usage : %+v", err)
+			}
+			time.Sleep(r.interval)
+		}
+	}()
+}
+
+// run merges the daily history of every key with usage into its monthly summaries, then
+// archives the days which have closed everywhere
+func (r *Rollup) run(now time.Time) error {
+	histories, err := r.config.usageHistories(r.store)
+	if err != nil {
+		return err
+	}
+
+	summaries := []*UsageMonth{}
+	for key, history := range histories {
+		months := make(map[string][]UsageDay)
+		for _, day := range history {
+			months[day.Date[:7]] = append(months[day.Date[:7]], day)
+		}
+		for month, days := range months {
+			summary, err := r.update(key, month, days, now)
+			if err != nil {
+				return err
+			}
+			summaries = append(summaries, summary)
+		}
+	}
+
+	if r.archiveDir != "" {
+		return r.archive(summaries, now)
+	}
+	return nil
+}
+
+func (r *Rollup) update(key, month string, days []UsageDay, now time.Time) (*UsageMonth, error) {
+	summary := &UsageMonth{Key: key, Month: month, Days: make(map[string]UsageDay)}
+	if data, err := r.store.Get(r.config.rollupKey(key, month)); err == nil {
+		if err := json.Unmarshal(data, summary); err != nil {
+			rollupLog.Warnf("Replacing unparsable summary for %s in %s : %+v", key, month, err)
+			summary = &UsageMonth{Key: key, Month: month}
+		}
+	}
+	if summary.Days == nil {
+		summary.Days = make(map[string]UsageDay)
+	}
+	summary.merge(days)
+	summary.Updated = now
+
+	// Summaries are kept for the retention period after their month ends
+	start, err := time.Parse("2006-01", month)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse month %s : %+v", month, err)
+	}
+	ttl := int(start.AddDate(0, r.retention+1, 0).Sub(now).Seconds())
+	if ttl <= 0 {
+		return summary, nil
+	}
+
+	data, _ := json.Marshal(summary)
+	if err := r.store.SetEx(r.config.rollupKey(key, month), data, ttl); err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// archive writes each day which has closed in every time zone to its own JSONL file, once
+func (r *Rollup) archive(summaries []*UsageMonth, now time.Time) error {
+	closedBefore := now.UTC().AddDate(0, 0, -1).Format("2006-01-02")
+	dates := make(map[string][]archivedDay)
+	for _, summary := range summaries {
+		for date, day := range summary.Days {
+			if date < closedBefore {
+				dates[date] = append(dates[date], archivedDay{Key: summary.Key, UsageDay: day})
+			}
+		}
+	}
+
+	for date, days := range dates {
+		path := filepath.Join(r.archiveDir, fmt.Sprintf("usage-%s.jsonl", date))
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+		sort.Slice(days, func(i, j int) bool {
+			return days[i].Key < days[j].Key
+		})
+		if err := writeArchive(path, days); err != nil {
+			return fmt.Errorf("Unable to archive %s : %+v", date, err)
+		}
+		rollupLog.Infof("Archived usage of %d keys for %s", len(days), date)
+	}
+	return nil
+}
+
+// writeArchive writes to a temporary file first, so a partial archive is never left behind
+func writeArchive(path string, days []archivedDay) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	for _, day := range days {
+		if err := encoder.Encode(day); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// usageHistories reads the daily history of every key with counters in the store, including
+// keys which have since been revoked
+func (c *AuthConfig) usageHistories(store Store) (map[string][]UsageDay, error) {
+	prefix := fmt.Sprintf("usage:%s:", c.ServiceName)
+	keys, err := store.GetKeys(escapePattern(prefix) + "*")
+	if err != nil {
+		return nil, err
+	}
+
+	byKey := make(map[string][]string)
+	for _, key := range keys {
+		id := strings.SplitN(strings.TrimPrefix(key, prefix), ":", 2)[0]
+		byKey[id] = append(byKey[id], key)
+	}
+
+	histories := make(map[string][]UsageDay)
+	for id, keys := range byKey {
+		counts, err := store.GetCounters(keys...)
+		if err != nil {
+			return nil, err
+		}
+		histories[id] = usageHistory(c.statKey(id, usageWindow{}), keys, counts)
+	}
+	return histories, nil
+}
+
+// usageMonths returns the monthly summaries kept for a key, oldest first
+func (c *AuthConfig) usageMonths(store Store, key string) ([]UsageMonth, error) {
+	keys, err := store.GetKeys(escapePattern(c.rollupKey(key, "")) + "*")
+	if err != nil {
+		return nil, err
+	}
+
+	months := []UsageMonth{}
+	for _, rollupKey := range keys {
+		data, err := store.Get(rollupKey)
+		if err != nil {
+			continue
+		}
+		month := UsageMonth{}
+		if err := json.Unmarshal(data, &month); err != nil {
+			continue
+		}
+		months = append(months, month)
+	}
+	sort.Slice(months, func(i, j int) bool {
+		return months[i].Month < months[j].Month
+	})
+	return months, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRollup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "praxis-archive")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir : %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, _ := NewMemoryStore("")
+	config := &AuthConfig{ServiceName: "praxis"}
+	rollup := &Rollup{config: config, store: store, retention: 1, archiveDir: dir}
+	now := time.Date(2020, 4, 5, 12, 0, 0, 0, time.UTC)
+
+	day := usageWindow{Label: "2020-04-01"}
+	store.IncrBy(config.statKey("testing", day), 5, 3600)
+	store.IncrBy(config.statKey("testing", usageWindow{Label: "2020-04-01T10"}), 2, 3600)
+	store.IncrBy(config.bytesKey("testing", usageWindow{Label: "2020-04-01"}), 1024, 3600)
+	store.IncrBy(config.statKey("testing", usageWindow{Label: "2020-03-31"}), 7, 3600)
+	store.IncrBy(config.statKey("other", usageWindow{Label: "2020-04-05"}), 1, 3600)
+
+	if err := rollup.run(now); err != nil {
+		t.Fatalf("Unexpected error rolling up : %+v", err)
+	}
+	// Running again after the daily counter expired must neither lose nor double count it
+	store.Delete(config.statKey("testing", day))
+	if err := rollup.run(now); err != nil {
+		t.Fatalf("Unexpected error rolling up : %+v", err)
+	}
+
+	months, err := config.usageMonths(store, "testing")
+	if err != nil || len(months) != 2 {
+		t.Fatalf("Expected %d months of summaries but got %+v : %+v", 2, months, err)
+	}
+	if months[0].Month != "2020-03" || months[0].Requests != 7 {
+		t.Fatalf("Unexpected summary for March : %+v", months[0])
+	}
+	if months[1].Month != "2020-04" || months[1].Requests != 5 || months[1].Bytes != 1024 {
+		t.Fatalf("Unexpected summary for April : %+v", months[1])
+	}
+
+	// Only days closed everywhere are archived
+	archived, _ := ioutil.ReadFile(filepath.Join(dir, "usage-2020-04-01.jsonl"))
+	expected := `{"key":"testing","date":"2020-04-01","requests":5,"bytes":1024,"denied":0}` + "\n"
+	if string(archived) != expected {
+		t.Fatalf("Expected archive of %q but got %q", expected, archived)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "usage-2020-04-05.jsonl")); err == nil {
+		t.Fatalf("Expected the current day not to be archived")
+	}
+}
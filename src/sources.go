@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	trustedProxiesVar  = "TRUSTED_PROXIES"
+	forwardedForHeader = "X-Forwarded-For"
+)
+
+// parseCIDR accepts either a CIDR or a single address, treated as a network of its own
+func parseCIDR(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("Unable to parse address %s", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse CIDR %s", s)
+	}
+	return network, nil
+}
+
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, value := range values {
+		network, err := parseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies reads the comma separated reverse proxies allowed to set X-Forwarded-For
+func parseTrustedProxies() ([]*net.IPNet, error) {
+	value := os.Getenv(trustedProxiesVar)
+	if value == "" {
+		return nil, nil
+	}
+	networks, err := parseCIDRs(strings.Split(value, ","))
+	if err != nil {
+		return nil, fmt.Errorf("%s : %s", trustedProxiesVar, err)
+	}
+	return networks, nil
+}
+
+func loadTrustedProxies() []*net.IPNet {
+	networks, err := parseTrustedProxies()
+	if err != nil {
+		panic(fmt.Sprintf("Failed to parse trusted proxies : %+v", err))
+	}
+	return networks
+}
+
+// clientIP finds the address a request came from. X-Forwarded-For is only honored when the
+// request arrived from a trusted proxy, walking back through it until an untrusted hop is found
+func clientIP(req *http.Request, trustedProxies []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !containsIP(trustedProxies, ip) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(req.Header[forwardedForHeader], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !containsIP(trustedProxies, hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// checkSource ensures the request came from one of the keys allowed networks, if it has any
+func (c *AuthConfig) checkSource(keyConfig *AuthWithLimit, req *http.Request) error {
+	if len(keyConfig.AllowedCIDRs) == 0 {
+		return nil
+	}
+
+	allowed, err := parseCIDRs(keyConfig.AllowedCIDRs)
+	if err != nil {
+		return &authError{Status: http.StatusInternalServerError, Message: "Error occured parsing key allowed networks"}
+	}
+	ip := clientIP(req, c.TrustedProxies)
+	if ip == nil || !containsIP(allowed, ip) {
+		return &authError{Status: http.StatusForbidden, Message: fmt.Sprintf("Key is not allowed from %s", ip)}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseCIDRs([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatalf("Unexpected error parsing trusted proxies : %+v", err)
+	}
+
+	tests := []struct {
+		remoteAddr   string
+		forwardedFor []string
+		expected     string
+	}{
+		// Untrusted peers can't claim to be someone else
+		{"203.0.113.5:4000", []string{"198.51.100.1"}, "203.0.113.5"},
+		{"192.168.1.2:4000", []string{"198.51.100.1"}, "192.168.1.2"},
+		// Trusted proxies are walked back to the first untrusted hop
+		{"10.1.2.3:4000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"192.168.1.1:4000", []string{"198.51.100.9, 198.51.100.1, 10.0.0.7"}, "198.51.100.1"},
+		{"10.1.2.3:4000", []string{"198.51.100.9", "10.0.0.7"}, "198.51.100.9"},
+		// A forged address before the hop our proxy saw is ignored
+		{"10.1.2.3:4000", []string{"not an ip, 198.51.100.1"}, "198.51.100.1"},
+		{"10.1.2.3:4000", nil, "10.1.2.3"},
+	}
+
+	for _, test := range tests {
+		req := &http.Request{RemoteAddr: test.remoteAddr, Header: http.Header{}}
+		for _, value := range test.forwardedFor {
+			req.Header.Add(forwardedForHeader, value)
+		}
+		ip := clientIP(req, trusted)
+		if ip.String() != test.expected {
+			t.Fatalf("Expected %s from %s via %v but got %s", test.expected, test.remoteAddr, test.forwardedFor, ip)
+		}
+	}
+}
+
+func TestCheckSource(t *testing.T) {
+	config := AuthConfig{}
+	keyConfig := &AuthWithLimit{ID: "testing", AllowedCIDRs: []string{"198.51.100.0/24", "2001:db8::1"}}
+
+	allowed := []string{"198.51.100.7:4000", "[2001:db8::1]:4000"}
+	for _, remoteAddr := range allowed {
+		if err := config.checkSource(keyConfig, &http.Request{RemoteAddr: remoteAddr}); err != nil {
+			t.Fatalf("Expected %s to be allowed but got %+v", remoteAddr, err)
+		}
+	}
+
+	refused := []string{"198.51.101.7:4000", "[2001:db8::2]:4000", "garbage"}
+	for _, remoteAddr := range refused {
+		err := config.checkSource(keyConfig, &http.Request{RemoteAddr: remoteAddr})
+		authErr, ok := err.(*authError)
+		if !ok || authErr.Status != http.StatusForbidden {
+			t.Fatalf("Expected %s to be refused but got %+v", remoteAddr, err)
+		}
+	}
+
+	if err := config.checkSource(&AuthWithLimit{ID: "open"}, &http.Request{RemoteAddr: "203.0.113.5:4000"}); err != nil {
+		t.Fatalf("Expected keys without allowed networks to be usable anywhere but got %+v", err)
+	}
+
+	if _, err := parseCIDRs([]string{"198.51.100.0/33"}); err == nil {
+		t.Fatalf("Expected invalid CIDR to fail parsing")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const (
+	storeVar     = "STORE"
+	storePathVar = "STORE_PATH"
+
+	redisStore  = "redis"
+	memoryStore = "memory"
+)
+
+// Store holds the keys, counters and rate limit buckets used for auth and usage reporting
+type Store interface {
+	// Get returns the value of `key`, or a *notFoundError if it doesn't exist
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte) error
+	// SetEx sets `key` to `value`, expiring it after `ttl` seconds
+	SetEx(key string, value []byte, ttl int) error
+	Exists(key string) (bool, error)
+	Delete(key string) error
+	// GetKeys returns all keys matching the redis style glob `pattern`
+	GetKeys(pattern string) ([]string, error)
+
+	// IncrBy increments the counter at `key` by `amount`, expiring it after `ttl` seconds or
+	// never when `ttl` is 0
+	IncrBy(key string, amount int64, ttl int) (int64, error)
+	// GetCounters returns the values of all counters in `keys`, with missing counters as zero
+	GetCounters(keys ...string) ([]int64, error)
+	// TakeToken attempts to take a token from the bucket at `key` which refills at `rate` per
+	// second up to `burst` tokens, otherwise returning how long until a token is available
+	TakeToken(key string, rate float64, burst int64) (bool, time.Duration, error)
+
+	Ping() error
+	Close() error
+}
+
+// notFoundError is returned by Get for a key which doesn't exist, telling it apart from the store failing
+type notFoundError struct {
+	key string
+}
+
+func (e *notFoundError) Error() string {
+	return fmt.Sprintf("error getting key %s: not found", e.key)
+}
+
+func isNotFound(err error) bool {
+	_, ok := err.(*notFoundError)
+	return ok
+}
+
+// newStore creates the store named by `kind`, defaulting to redis. Only the memory store
+// uses `path`, saving its contents there so they survive a restart, while redis may take
+// its passwords from `credentials`
+func newStore(kind, path string, credentials *Credentials) (Store, error) {
+	switch kind {
+	case "", redisStore:
+		config, err := loadRedisConfig(credentials)
+		if err != nil {
+			return nil, err
+		}
+		redisServer := &Redis{}
+		redisServer.Init(config)
+		return newFailoverStore(redisServer, loadStoreFailurePolicy()), nil
+	case memoryStore:
+		return NewMemoryStore(path)
+	default:
+		return nil, fmt.Errorf("Unknown store %s, expected %s or %s", kind, redisStore, memoryStore)
+	}
+}
+
+// checkStoreEnv returns what is wrong with the store configured in the environment, without
+// connecting to it
+func checkStoreEnv(credentials *Credentials) []string {
+	problems := []string{}
+	switch kind := os.Getenv(storeVar); kind {
+	case "", redisStore:
+		if _, err := loadRedisConfig(credentials); err != nil {
+			problems = append(problems, err.Error())
+		}
+		if _, err := parseStoreFailurePolicy(); err != nil {
+			problems = append(problems, err.Error())
+		}
+	case memoryStore:
+	default:
+		problems = append(problems, fmt.Sprintf("%s must be %s or %s, got %q", storeVar, redisStore, memoryStore, kind))
+	}
+	return problems
+}
+
+// loadStore creates the store configured in the environment
+func loadStore(credentials *Credentials) Store {
+	store, err := newStore(os.Getenv(storeVar), os.Getenv(storePathVar), credentials)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create store : %+v", err))
+	}
+	cleanupHook(store)
+	return store
+}
+
+func cleanupHook(store Store) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, syscall.SIGTERM)
+	signal.Notify(c, syscall.SIGKILL)
+	go func() {
+		<-c
+		if err := store.Close(); err != nil {
+			storeLog.Errorf("Error occured closing store : %+v", err)
+		}
+		os.Exit(0)
+	}()
+}
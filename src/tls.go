@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	clientKeysVar = "API_TLS_CLIENT_KEYS"
+)
+
+// APITLSConfig describes how the management api is served over tls, optionally verifying
+// client certificates against a CA
+type APITLSConfig struct {
+	CertFile string `yaml:"cert"`
+	KeyFile  string `yaml:"key"`
+
+	ClientCAFile      string `yaml:"client_ca"`
+	RequireClientCert bool   `yaml:"client_required"`
+}
+
+func (c *APITLSConfig) enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+func (c *APITLSConfig) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if c.ClientCAFile == "" {
+		if c.RequireClientCert {
+			return nil, fmt.Errorf("Requiring client certificates needs a client CA")
+		}
+		return config, nil
+	}
+
+	caData, err := ioutil.ReadFile(c.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read client CA : %+v", err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caData) {
+		return nil, fmt.Errorf("No certificates found in client CA %s", c.ClientCAFile)
+	}
+	config.ClientCAs = clientCAs
+
+	// Unless required, clients can still fall back to the Auth-Key header
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	if c.RequireClientCert {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// serveAPI serves the management api on `address`, over tls when configured
+func serveAPI(handler http.Handler, address string, tlsConfig APITLSConfig) error {
+	if !tlsConfig.enabled() {
+		return http.ListenAndServe(address, handler)
+	}
+
+	config, err := tlsConfig.tlsConfig()
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Addr:      address,
+		Handler:   handler,
+		TLSConfig: config,
+	}
+	return server.ListenAndServeTLS(tlsConfig.CertFile, tlsConfig.KeyFile)
+}
+
+// loadClientCertificateKeys reads the client certificate to key id mapping from the environment
+func loadClientCertificateKeys() map[string]string {
+	keys, err := parseClientCertificateKeys(os.Getenv(clientKeysVar))
+	if err != nil {
+		panic(fmt.Sprintf("Failed to parse client certificate keys variable %s : %+v", clientKeysVar, err))
+	}
+	return keys
+}
+
+// parseClientCertificateKeys parses "<subject>=<key id>" pairs separated by semicolons, as
+// subjects themselves contain commas and equals signs the key id is taken after the last one
+func parseClientCertificateKeys(value string) (map[string]string, error) {
+	keys := make(map[string]string)
+	for _, pair := range strings.Split(value, ";") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		split := strings.LastIndex(pair, "=")
+		if split <= 0 || split == len(pair)-1 {
+			return nil, fmt.Errorf("Unable to parse client certificate mapping %s", pair)
+		}
+		keys[pair[:split]] = pair[split+1:]
+	}
+	return keys, nil
+}
+
+// certificateKeyID finds the key mapped to a verified client certificate, matching either
+// its full subject (e.g. "CN=crawler,O=Praxis") or just its common name
+func (c *AuthConfig) certificateKeyID(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+
+	subject := state.VerifiedChains[0][0].Subject
+	if id, ok := c.ClientCertificates[subject.String()]; ok {
+		return id
+	}
+	return c.ClientCertificates[subject.CommonName]
+}
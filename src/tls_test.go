@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// generateCertificate creates a certificate for `subject`, self signed when `parent` is nil
+func generateCertificate(t *testing.T, subject pkix.Name, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate key : %+v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               subject,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("Unable to create certificate : %+v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestClientCertificateAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "praxis-tls")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir : %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey, caPEM := generateCertificate(t, pkix.Name{CommonName: "Praxis Test CA"}, true, nil, nil)
+	caFile := filepath.Join(dir, "ca.crt")
+	ioutil.WriteFile(caFile, caPEM, 0600)
+
+	underTest := APITLSConfig{ClientCAFile: caFile, RequireClientCert: true}
+	config, err := underTest.tlsConfig()
+	if err != nil {
+		t.Fatalf("Unexpected error building tls config : %+v", err)
+	}
+	if config.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Fatalf("Expected client certificates to be required")
+	}
+
+	authConfig := AuthConfig{ClientCertificates: map[string]string{"crawler": "testing"}}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(authConfig.certificateKeyID(r.TLS)))
+	}))
+	serverCert, serverKey, _ := generateCertificate(t, pkix.Name{CommonName: "127.0.0.1"}, false, ca, caKey)
+	config.Certificates = []tls.Certificate{tls.Certificate{Certificate: [][]byte{serverCert.Raw}, PrivateKey: serverKey}}
+	server.TLS = config
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	clientCert, clientKey, _ := generateCertificate(t, pkix.Name{CommonName: "crawler", Organization: []string{"Praxis"}}, false, ca, caKey)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{tls.Certificate{Certificate: [][]byte{clientCert.Raw}, PrivateKey: clientKey}},
+	}}}
+
+	rsp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("get rsp failed:%v", err)
+	}
+	defer rsp.Body.Close()
+	data, _ := ioutil.ReadAll(rsp.Body)
+	if string(data) != "testing" {
+		t.Fatalf("Expected client certificate to map to key %s but got %q", "testing", data)
+	}
+
+	// Without a client certificate the handshake should fail
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	if _, err := anonymous.Get(server.URL); err == nil {
+		t.Fatalf("Expected request without a client certificate to fail")
+	}
+}
+
+func TestParseClientCertificateKeys(t *testing.T) {
+	keys, err := parseClientCertificateKeys("CN=crawler,O=Praxis=testing; reporting=reports")
+	if err != nil {
+		t.Fatalf("Unexpected error parsing : %+v", err)
+	}
+	if keys["CN=crawler,O=Praxis"] != "testing" || keys["reporting"] != "reports" {
+		t.Fatalf("Unexpected client certificate keys : %+v", keys)
+	}
+
+	if _, err := parseClientCertificateKeys("crawler"); err == nil {
+		t.Fatalf("Expected mapping without a key id to fail")
+	}
+}
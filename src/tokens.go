@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	tokenSecretVar  = "PRAXIS_TOKEN_SECRET"
+	defaultTokenTTL = time.Hour
+	maxTokenTTL     = 24 * time.Hour
+)
+
+type sessionContextKey struct{}
+
+// sessionToken is the payload of a signed token allowing a single session to be used by
+// its owner, without handing the owners key to everything talking to the proxy
+type sessionToken struct {
+	Session int    `json:"sid"`
+	KeyID   string `json:"kid"`
+	Expires int64  `json:"exp"`
+}
+
+// loadTokenSecret uses the configured token secret, falling back to a random one which
+// means tokens will not survive a restart or be accepted by other instances
+func loadTokenSecret() []byte {
+	secret, err := secretEnv(tokenSecretVar)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to read token secret : %+v", err))
+	}
+	if secret != "" {
+		return []byte(secret)
+	}
+
+	authLog.Warnf("No %s found, generating a random token secret...", tokenSecretVar)
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		panic(fmt.Sprintf("Failed to generate token secret : %+v", err))
+	}
+	return random
+}
+
+// withSession records which session a proxied request arrived on
+func withSession(req *http.Request, sessionID int) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), sessionContextKey{}, sessionID))
+}
+
+func sessionFromRequest(req *http.Request) (int, bool) {
+	sessionID, ok := req.Context().Value(sessionContextKey{}).(int)
+	return sessionID, ok
+}
+
+func (c *AuthConfig) sign(payload string) string {
+	mac := hmac.New(sha256.New, c.TokenSecret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signToken encodes a token as "<payload>.<signature>", both base64url encoded
+func (c *AuthConfig) signToken(token sessionToken) (string, error) {
+	if len(c.TokenSecret) == 0 {
+		return "", fmt.Errorf("No token secret configured")
+	}
+
+	data, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + c.sign(payload), nil
+}
+
+// verifyToken checks the tokens signature and expiry, and that it was issued for `sessionID`
+func (c *AuthConfig) verifyToken(signed string, sessionID int, now time.Time) (*sessionToken, error) {
+	parts := strings.SplitN(signed, ".", 2)
+	if len(parts) != 2 || len(c.TokenSecret) == 0 {
+		return nil, fmt.Errorf("Malformed session token")
+	}
+	if !hmac.Equal([]byte(c.sign(parts[0])), []byte(parts[1])) {
+		return nil, fmt.Errorf("Bad session token signature")
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("Malformed session token")
+	}
+	token := &sessionToken{}
+	if err := json.Unmarshal(data, token); err != nil {
+		return nil, fmt.Errorf("Malformed session token")
+	}
+
+	if now.Unix() >= token.Expires {
+		return nil, fmt.Errorf("Session token expired")
+	}
+	if token.Session != sessionID {
+		return nil, fmt.Errorf("Session token is for another session")
+	}
+	return token, nil
+}
+
+// ownsSession checks the tokens key still owns its session, as session ids are reused once closed
+func (c *AuthConfig) ownsSession(token *sessionToken) bool {
+	if c.SessionOwner == nil {
+		return true
+	}
+	owner, ok := c.SessionOwner(token.Session)
+	return ok && owner == token.KeyID
+}
+
+// proxyToken returns a session token from the Proxy-Authorization header, either as a bearer
+// token or as the password of basic auth so it can be given in a proxy url
+func proxyToken(req *http.Request) string {
+	value := req.Header.Get(proxyAuthHeader)
+	if strings.HasPrefix(value, "Bearer ") {
+		return strings.TrimPrefix(value, "Bearer ")
+	}
+
+	if strings.HasPrefix(value, "Basic ") {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, "Basic "))
+		if err != nil {
+			return ""
+		}
+		credentials := strings.SplitN(string(decoded), ":", 2)
+		if len(credentials) == 2 {
+			return credentials[1]
+		}
+	}
+	return ""
+}
+
+// tokenTTL parses the requested lifetime of a token, capped to maxTokenTTL
+func tokenTTL(requested string) (time.Duration, error) {
+	if requested == "" {
+		return defaultTokenTTL, nil
+	}
+	ttl, err := time.ParseDuration(requested)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("Invalid token ttl %s", requested)
+	}
+	if ttl > maxTokenTTL {
+		return maxTokenTTL, nil
+	}
+	return ttl, nil
+}
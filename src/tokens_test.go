@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSessionToken(t *testing.T) {
+	config := AuthConfig{TokenSecret: []byte("not a real secret")}
+	now := time.Now()
+
+	signed, err := config.signToken(sessionToken{Session: 595, KeyID: "testing", Expires: now.Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatalf("Unexpected error signing token : %+v", err)
+	}
+
+	token, err := config.verifyToken(signed, 595, now)
+	if err != nil {
+		t.Fatalf("Unexpected error verifying token : %+v", err)
+	}
+	if token.KeyID != "testing" {
+		t.Fatalf("Expected token for key %s but got %s", "testing", token.KeyID)
+	}
+
+	if _, err := config.verifyToken(signed, 596, now); err == nil {
+		t.Fatalf("Expected token to be rejected on another session")
+	}
+	if _, err := config.verifyToken(signed, 595, now.Add(2*time.Minute)); err == nil {
+		t.Fatalf("Expected expired token to be rejected")
+	}
+	if _, err := config.verifyToken(signed+"x", 595, now); err == nil {
+		t.Fatalf("Expected tampered token to be rejected")
+	}
+
+	other := AuthConfig{TokenSecret: []byte("another secret")}
+	if _, err := other.verifyToken(signed, 595, now); err == nil {
+		t.Fatalf("Expected token signed with another secret to be rejected")
+	}
+}
+
+func TestProxyToken(t *testing.T) {
+	req, _ := http.NewRequest("CONNECT", "http://praxis.invalid:443", nil)
+	req.Header.Set(proxyAuthHeader, "Bearer abc.def")
+	if proxyToken(req) != "abc.def" {
+		t.Fatalf("Expected bearer token but got %s", proxyToken(req))
+	}
+
+	setBasicAuth("token", "abc.def", req)
+	if proxyToken(req) != "abc.def" {
+		t.Fatalf("Expected basic auth password as token but got %s", proxyToken(req))
+	}
+
+	req.Header.Del(proxyAuthHeader)
+	if proxyToken(req) != "" {
+		t.Fatalf("Expected no token but got %s", proxyToken(req))
+	}
+}
+
+func TestProxyKeyConfigFromToken(t *testing.T) {
+	config := AuthConfig{
+		TokenSecret: []byte("not a real secret"),
+		AuthKeys:    []AuthWithLimit{AuthWithLimit{ID: "testing"}},
+	}
+	signed, _ := config.signToken(sessionToken{Session: 595, KeyID: "testing", Expires: time.Now().Add(time.Minute).Unix()})
+
+	req, _ := http.NewRequest("CONNECT", "http://praxis.invalid:443", nil)
+	req.Header.Set(proxyAuthHeader, fmt.Sprintf("Bearer %s", signed))
+	if _, err := config.proxyKeyConfig(nil, req); err == nil {
+		t.Fatalf("Expected token to be rejected outside of a session")
+	}
+
+	keyConfig, err := config.proxyKeyConfig(nil, withSession(req, 595))
+	if err != nil {
+		t.Fatalf("Unexpected error authorizing token : %+v", err)
+	}
+	if keyConfig.ID != "testing" {
+		t.Fatalf("Expected key %s but got %s", "testing", keyConfig.ID)
+	}
+
+	// Once the session is closed its id may be handed to another key
+	owners := map[int]string{595: "testing"}
+	config.SessionOwner = func(sessionID int) (string, bool) {
+		owner, ok := owners[sessionID]
+		return owner, ok
+	}
+	if _, err := config.proxyKeyConfig(nil, withSession(req, 595)); err != nil {
+		t.Fatalf("Unexpected error authorizing token on its own session : %+v", err)
+	}
+	owners[595] = "other"
+	if _, err := config.proxyKeyConfig(nil, withSession(req, 595)); err == nil {
+		t.Fatalf("Expected token to be rejected on a reused session id")
+	}
+	if config.proxyKeyID(withSession(req, 595)) != "" {
+		t.Fatalf("Expected no key for a token on a reused session id")
+	}
+	delete(owners, 595)
+	if _, err := config.proxyKeyConfig(nil, withSession(req, 595)); err == nil {
+		t.Fatalf("Expected token to be rejected once its session is closed")
+	}
+}
+
+func TestTokenTTL(t *testing.T) {
+	if ttl, _ := tokenTTL(""); ttl != defaultTokenTTL {
+		t.Fatalf("Expected default ttl but got %s", ttl)
+	}
+	if ttl, _ := tokenTTL("72h"); ttl != maxTokenTTL {
+		t.Fatalf("Expected ttl capped to %s but got %s", maxTokenTTL, ttl)
+	}
+	if _, err := tokenTTL("-5m"); err == nil {
+		t.Fatalf("Expected negative ttl to be invalid")
+	}
+}
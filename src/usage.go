@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// UsageReport summarises a keys usage in its current windows along with its daily history
+type UsageReport struct {
+	Key          string       `json:"key"`
+	Requests     UsageCurrent `json:"requests"`
+	DailyBytes   UsageCurrent `json:"daily_bytes"`
+	MonthlyBytes UsageCurrent `json:"monthly_bytes"`
+	History      []UsageDay   `json:"history"`
+	Months       []UsageMonth `json:"months"`
+}
+
+// UsageCurrent is the usage counted so far in a window, remaining is left out when unlimited
+type UsageCurrent struct {
+	Window    QuotaWindow `json:"window"`
+	Period    string      `json:"period"`
+	Used      int64       `json:"used"`
+	Limit     int64       `json:"limit"`
+	Remaining *int64      `json:"remaining,omitempty"`
+	ResetsAt  time.Time   `json:"resets_at"`
+}
+
+// UsageDay is the requests, bytes and denied destinations counted for a key on a single day
+type UsageDay struct {
+	Date     string `json:"date"`
+	Requests int64  `json:"requests"`
+	Bytes    int64  `json:"bytes"`
+	Denied   int64  `json:"denied"`
+}
+
+func newUsageCurrent(window QuotaWindow, bucket usageWindow, used, limit int64, resetsAt time.Time) UsageCurrent {
+	current := UsageCurrent{
+		Window:   window,
+		Period:   bucket.Label,
+		Used:     used,
+		Limit:    limit,
+		ResetsAt: resetsAt,
+	}
+	if limit > 0 {
+		remaining := limit - used
+		if remaining < 0 {
+			remaining = 0
+		}
+		current.Remaining = &remaining
+	}
+	return current
+}
+
+// escapePattern escapes any glob characters so `s` is matched literally by SCAN
+func escapePattern(s string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+	return replacer.Replace(s)
+}
+
+// usageReport reads the current counters and history for a key from the store
+func (c *AuthConfig) usageReport(store Store, keyConfig *AuthWithLimit, now time.Time) (*UsageReport, error) {
+	loc, err := keyConfig.location()
+	if err != nil {
+		return nil, err
+	}
+
+	window := keyConfig.window()
+	buckets := window.buckets(now, loc)
+	keys := make([]string, len(buckets))
+	for i, bucket := range buckets {
+		keys[i] = c.statKey(keyConfig.ID, bucket)
+	}
+	counts, err := store.GetCounters(keys...)
+	if err != nil {
+		return nil, err
+	}
+	used, resetIn := window.usage(buckets, counts, now)
+
+	day := DailyWindow.current(now, loc)
+	month := MonthlyWindow.current(now, loc)
+	bytes, err := store.GetCounters(c.bytesKey(keyConfig.ID, day), c.bytesKey(keyConfig.ID, month))
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := c.statKey(keyConfig.ID, usageWindow{})
+	historyKeys, err := store.GetKeys(escapePattern(prefix) + "*")
+	if err != nil {
+		return nil, err
+	}
+	historyCounts := []int64{}
+	if len(historyKeys) > 0 {
+		historyCounts, err = store.GetCounters(historyKeys...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	months, err := c.usageMonths(store, keyConfig.ID)
+	if err != nil {
+		return nil, err
+	}
+	// The days making up each month are already in the history, or long gone
+	for i := range months {
+		months[i].Days = nil
+	}
+
+	return &UsageReport{
+		Key:          keyConfig.ID,
+		Requests:     newUsageCurrent(window, buckets[0], used, keyConfig.Limit, now.Add(resetIn)),
+		DailyBytes:   newUsageCurrent(DailyWindow, day, bytes[0], keyConfig.DailyBytes, day.End),
+		MonthlyBytes: newUsageCurrent(MonthlyWindow, month, bytes[1], keyConfig.MonthlyBytes, month.End),
+		History:      usageHistory(prefix, historyKeys, historyCounts),
+		Months:       months,
+	}, nil
+}
+
+// usageHistory rolls the counters under `prefix` up into days. Hourly, weekly and monthly buckets
+// are skipped, as those windows also count per day
+func usageHistory(prefix string, keys []string, counts []int64) []UsageDay {
+	days := make(map[string]*UsageDay)
+	for i, key := range keys {
+		label := strings.TrimPrefix(key, prefix)
+		isBytes := strings.HasSuffix(label, ":bytes")
+		isDenied := strings.HasSuffix(label, ":denied")
+		label = strings.TrimSuffix(strings.TrimSuffix(label, ":bytes"), ":denied")
+
+		t, err := time.Parse("2006-01-02", label)
+		if err != nil {
+			continue
+		}
+		date := t.Format("2006-01-02")
+
+		if _, ok := days[date]; !ok {
+			days[date] = &UsageDay{Date: date}
+		}
+		if isBytes {
+			days[date].Bytes += counts[i]
+		} else if isDenied {
+			days[date].Denied += counts[i]
+		} else {
+			days[date].Requests += counts[i]
+		}
+	}
+
+	history := make([]UsageDay, 0, len(days))
+	for _, day := range days {
+		history = append(history, *day)
+	}
+	sort.Slice(history, func(i, j int) bool {
+		return history[i].Date < history[j].Date
+	})
+	return history
+}
+
+// writeUsageCSV exports the daily history of each report, one row per key per day
+func writeUsageCSV(w io.Writer, reports []*UsageReport) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"key", "date", "requests", "bytes", "denied"})
+	for _, report := range reports {
+		for _, day := range report.History {
+			writer.Write([]string{
+				report.Key,
+				day.Date,
+				strconv.FormatInt(day.Requests, 10),
+				strconv.FormatInt(day.Bytes, 10),
+				strconv.FormatInt(day.Denied, 10),
+			})
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func respondWithUsage(context *gin.Context, reports []*UsageReport) {
+	switch context.DefaultQuery("format", "json") {
+	case "csv":
+		context.Header("Content-Type", "text/csv")
+		context.Header("Content-Disposition", "attachment; filename=usage.csv")
+		context.Status(http.StatusOK)
+		if err := writeUsageCSV(context.Writer, reports); err != nil {
+			context.Error(err)
+		}
+	case "json":
+		context.JSON(http.StatusOK, reports)
+	default:
+		context.AbortWithError(http.StatusBadRequest, fmt.Errorf("Unknown usage format, expected json or csv"))
+	}
+}
+
+// UsageHandlers provides handlers reporting on the requesting keys own usage, and on the usage of
+// all keys which should be restricted to admins
+func UsageHandlers(config AuthConfig, store Store) (gin.HandlerFunc, gin.HandlerFunc) {
+	return func(context *gin.Context) {
+			keyConfig := authorizedKey(context)
+			if keyConfig == nil {
+				context.AbortWithError(http.StatusForbidden, fmt.Errorf("Bad Authentication Key"))
+				return
+			}
+
+			report, err := config.usageReport(store, keyConfig, time.Now())
+			if err != nil {
+				context.AbortWithError(http.StatusInternalServerError, fmt.Errorf("Unable to get usage : %+v", err))
+				return
+			}
+			respondWithUsage(context, []*UsageReport{report})
+		}, func(context *gin.Context) {
+			keys, err := config.allKeys(store)
+			if err != nil {
+				context.AbortWithError(http.StatusInternalServerError, fmt.Errorf("Unable to get usage : %+v", err))
+				return
+			}
+
+			reports := []*UsageReport{}
+			now := time.Now()
+			for _, keyConfig := range keys {
+				report, err := config.usageReport(store, keyConfig, now)
+				if err != nil {
+					context.AbortWithError(http.StatusInternalServerError, fmt.Errorf("Unable to get usage : %+v", err))
+					return
+				}
+				reports = append(reports, report)
+			}
+			respondWithUsage(context, reports)
+		}
+}
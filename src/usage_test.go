@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestUsageHistory(t *testing.T) {
+	prefix := "usage:praxis:testingapikey:"
+	keys := []string{
+		prefix + "2020-04-01T10",
+		prefix + "2020-04-01",
+		prefix + "2020-04-01:bytes",
+		prefix + "2020-03-31",
+		prefix + "2020-W14",
+		prefix + "2020-04:bytes",
+		prefix + "2020-04-01:denied",
+	}
+	counts := []int64{2, 5, 1024, 7, 100, 4096, 4}
+
+	history := usageHistory(prefix, keys, counts)
+	if len(history) != 2 {
+		t.Fatalf("Expected %d days of history but got %d : %+v", 2, len(history), history)
+	}
+
+	if history[0].Date != "2020-03-31" || history[0].Requests != 7 || history[0].Bytes != 0 {
+		t.Fatalf("Unexpected history for first day : %+v", history[0])
+	}
+	if history[1].Date != "2020-04-01" || history[1].Requests != 5 || history[1].Bytes != 1024 || history[1].Denied != 4 {
+		t.Fatalf("Unexpected history for second day : %+v", history[1])
+	}
+}
+
+func TestWriteUsageCSV(t *testing.T) {
+	reports := []*UsageReport{
+		&UsageReport{
+			Key:     "testingapikey",
+			History: []UsageDay{UsageDay{Date: "2020-04-01", Requests: 5, Bytes: 1024, Denied: 2}},
+		},
+	}
+
+	var buffer bytes.Buffer
+	if err := writeUsageCSV(&buffer, reports); err != nil {
+		t.Fatalf("Unexpected error writing csv : %+v", err)
+	}
+
+	expected := "key,date,requests,bytes,denied\ntestingapikey,2020-04-01,5,1024,2\n"
+	if buffer.String() != expected {
+		t.Fatalf("Expected csv of %q but got %q", expected, buffer.String())
+	}
+}
+
+func TestEscapePattern(t *testing.T) {
+	if escapePattern("usage:a*b?[c]") != `usage:a\*b\?\[c\]` {
+		t.Fatalf("Unexpected escaped pattern : %s", escapePattern("usage:a*b?[c]"))
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	webhookSignatureHeader = "Praxis-Signature"
+	webhookEventHeader     = "Praxis-Event"
+
+	webhookQueueSize = 1000
+	webhookRetries   = 3
+	webhookWorkers   = 4
+	webhookTimeout   = 5 * time.Second
+
+	// WebhookThreshold is sent when a key crosses a percentage of one of its quotas
+	WebhookThreshold = "quota.threshold"
+	// WebhookRateLimited is sent when a key is rejected for rate limiting, at most once a minute
+	WebhookRateLimited = "rate_limited"
+	// WebhookWindowReset is sent when a key first uses a new window of one of its quotas
+	WebhookWindowReset = "window.reset"
+)
+
+var defaultWebhookThresholds = []int{50, 80, 100}
+
+// internalNetworks are the private ranges a keys webhook can't be sent to, along with loopback,
+// link-local and unspecified addresses
+var internalNetworks, _ = parseCIDRs([]string{"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"})
+
+func internalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() ||
+		ip.IsMulticast() || containsIP(internalNetworks, ip)
+}
+
+// WebhookEvent is the JSON body posted to webhooks
+type WebhookEvent struct {
+	Event      string      `json:"event"`
+	Key        string      `json:"key"`
+	Quota      string      `json:"quota,omitempty"`
+	Window     QuotaWindow `json:"window,omitempty"`
+	Period     string      `json:"period,omitempty"`
+	Threshold  int         `json:"threshold,omitempty"`
+	Used       int64       `json:"used,omitempty"`
+	Limit      int64       `json:"limit,omitempty"`
+	RetryAfter string      `json:"retry_after,omitempty"`
+
+	// Session, Action, Reason and Until describe what was done about a runaway session
+	Session int           `json:"session,omitempty"`
+	Action  AnomalyAction `json:"action,omitempty"`
+	Reason  string        `json:"reason,omitempty"`
+	Until   string        `json:"until,omitempty"`
+
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type webhookDelivery struct {
+	url   string
+	event WebhookEvent
+	// keyURL is set for the keys own url, which can't reach internal addresses
+	keyURL bool
+}
+
+// Webhooks posts events signed with an HMAC of the body to the global url and any url given to the key
+type Webhooks struct {
+	URL        string
+	Secret     []byte
+	Thresholds []int
+
+	deliveries chan webhookDelivery
+	client     *http.Client
+	keyClient  *http.Client
+}
+
+// NewWebhooks starts delivering events in the background, with a few workers so a slow url
+// doesn't hold up every other keys events
+func NewWebhooks(target string, secret []byte, thresholds []int) *Webhooks {
+	w := &Webhooks{
+		URL:        target,
+		Secret:     secret,
+		Thresholds: thresholds,
+		deliveries: make(chan webhookDelivery, webhookQueueSize),
+		client:     &http.Client{Timeout: webhookTimeout},
+		keyClient:  newKeyWebhookClient(),
+	}
+	for i := 0; i < webhookWorkers; i++ {
+		go w.deliver()
+	}
+	return w
+}
+
+// newKeyWebhookClient refuses to connect to internal addresses. They are checked once the host
+// is resolved, so a name pointing at one can't be used instead
+func newKeyWebhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: webhookTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || internalIP(ip) {
+				return fmt.Errorf("webhook address %s is internal", host)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: webhookTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: webhookTimeout,
+		},
+	}
+}
+
+// parseWebhookEnv reads the webhook secret and thresholds from the environment
+func parseWebhookEnv() (string, []int, error) {
+	secret, err := secretEnv("WEBHOOK_SECRET")
+	if err != nil {
+		return "", nil, err
+	}
+
+	thresholds := defaultWebhookThresholds
+	if value := os.Getenv("WEBHOOK_THRESHOLDS"); value != "" {
+		thresholds = []int{}
+		for _, threshold := range strings.Split(value, ",") {
+			percent, err := strconv.Atoi(strings.TrimSpace(threshold))
+			if err != nil || percent <= 0 || percent > 100 {
+				return "", nil, fmt.Errorf("WEBHOOK_THRESHOLDS must be percentages between 1 and 100, got %q", threshold)
+			}
+			thresholds = append(thresholds, percent)
+		}
+	}
+	return secret, thresholds, nil
+}
+
+// loadWebhooks reads the webhook configuration from the environment, webhooks are disabled
+// unless WEBHOOK_SECRET is set as every event must be signed
+func loadWebhooks() *Webhooks {
+	secret, thresholds, err := parseWebhookEnv()
+	if err != nil {
+		panic(fmt.Sprintf("Failed to read webhook configuration : %+v", err))
+	}
+	if secret == "" {
+		return nil
+	}
+	return NewWebhooks(os.Getenv("WEBHOOK_URL"), []byte(secret), thresholds)
+}
+
+// validateWebhookURL ensures a keys webhook is an absolute http or https url which isn't for an
+// internal address, empty is allowed
+func validateWebhookURL(rawURL string) error {
+	if rawURL == "" {
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Invalid webhook url %s, expected an http or https url", rawURL)
+	}
+	host := strings.ToLower(u.Hostname())
+	ip := net.ParseIP(host)
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") || (ip != nil && internalIP(ip)) {
+		return fmt.Errorf("Invalid webhook url %s, it can't be for an internal address", rawURL)
+	}
+	return nil
+}
+
+// crossed returns the thresholds usage went past going from `before` to `after`
+func (w *Webhooks) crossed(before, after, limit int64) []int {
+	crossed := []int{}
+	for _, threshold := range w.Thresholds {
+		level := int64(math.Ceil(float64(limit) * float64(threshold) / 100))
+		if before < level && after >= level {
+			crossed = append(crossed, threshold)
+		}
+	}
+	return crossed
+}
+
+func (w *Webhooks) sign(body []byte) string {
+	mac := hmac.New(sha256.New, w.Secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// send queues an event for the global url and the keys own, dropping it if the queue is full
+func (w *Webhooks) send(keyConfig *AuthWithLimit, event WebhookEvent) {
+	event.Key = keyConfig.ID
+	event.Timestamp = time.Now().UTC()
+	deliveries := []webhookDelivery{
+		{url: w.URL, event: event},
+		{url: keyConfig.WebhookURL, event: event, keyURL: true},
+	}
+	for _, delivery := range deliveries {
+		if delivery.url == "" {
+			continue
+		}
+		select {
+		case w.deliveries <- delivery:
+		default:
+			webhookLog.With(Fields{"key": event.Key}).Warnf("Queue full, dropping %s event", event.Event)
+		}
+	}
+}
+
+func (w *Webhooks) deliver() {
+	for delivery := range w.deliveries {
+		body, _ := json.Marshal(delivery.event)
+		for attempt := 0; attempt < webhookRetries; attempt++ {
+			if attempt > 0 {
+				time.Sleep(time.Duration(attempt) * time.Second)
+			}
+			client := w.client
+			if delivery.keyURL {
+				client = w.keyClient
+			}
+			if err := w.post(client, delivery.url, delivery.event.Event, body); err != nil {
+				webhookLog.With(Fields{"key": delivery.event.Key}).Errorf("Error occured sending %s event (attempt %d) : %+v", delivery.event.Event, attempt+1, err)
+				continue
+			}
+			break
+		}
+	}
+}
+
+func (w *Webhooks) post(client *http.Client, target, event string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, event)
+	req.Header.Set(webhookSignatureHeader, w.sign(body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (c *AuthConfig) webhookKey(key, name string) string {
+	return fmt.Sprintf("webhooks:%s:%s:%s", c.ServiceName, key, name)
+}
+
+// once ensures an event is only sent by the first instance to see it, remembering it for `ttl` seconds
+func (c *AuthConfig) once(store Store, key, name string, ttl int) bool {
+	sent, err := store.IncrBy(c.webhookKey(key, name), 1, ttl)
+	return err == nil && sent == 1
+}
+
+// notifyUsage sends events for the thresholds of a quota crossed by usage going from `before`
+// to `after`, along with a reset event when this is the first usage in a new window
+func (c *AuthConfig) notifyUsage(store Store, keyConfig *AuthWithLimit, quota string, window QuotaWindow, bucket usageWindow, before, after, limit int64) {
+	if c.Webhooks == nil || limit <= 0 {
+		return
+	}
+	ttl := window.ttl(bucket, time.Now())
+
+	if before == 0 && after > 0 && window != Rolling24hWindow {
+		if c.once(store, keyConfig.ID, fmt.Sprintf("%s:%s:reset", quota, bucket.Label), ttl) {
+			c.Webhooks.send(keyConfig, WebhookEvent{Event: WebhookWindowReset, Quota: quota, Window: window, Period: bucket.Label, Limit: limit})
+		}
+	}
+
+	for _, threshold := range c.Webhooks.crossed(before, after, limit) {
+		if c.once(store, keyConfig.ID, fmt.Sprintf("%s:%s:%d", quota, bucket.Label, threshold), ttl) {
+			c.Webhooks.send(keyConfig, WebhookEvent{
+				Event:     WebhookThreshold,
+				Quota:     quota,
+				Window:    window,
+				Period:    bucket.Label,
+				Threshold: threshold,
+				Used:      after,
+				Limit:     limit,
+			})
+		}
+	}
+}
+
+// notifyRateLimited sends an event for a key being rate limited, at most once a minute
+func (c *AuthConfig) notifyRateLimited(store Store, keyConfig *AuthWithLimit, retryAfter time.Duration) {
+	if c.Webhooks == nil {
+		return
+	}
+	minute := time.Now().UTC().Format("2006-01-02T15:04")
+	if c.once(store, keyConfig.ID, "rate_limited:"+minute, 60) {
+		c.Webhooks.send(keyConfig, WebhookEvent{Event: WebhookRateLimited, RetryAfter: retryAfter.String()})
+	}
+}
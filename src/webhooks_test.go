@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhooksCrossed(t *testing.T) {
+	webhooks := &Webhooks{Thresholds: defaultWebhookThresholds}
+	tests := []struct {
+		before, after, limit int64
+		expected             []int
+	}{
+		{0, 1, 10, []int{}},
+		{4, 5, 10, []int{50}},
+		{5, 6, 10, []int{}},
+		{7, 8, 10, []int{80}},
+		{9, 10, 10, []int{100}},
+		{0, 1, 1, []int{50, 80, 100}},
+		{0, 900, 1000, []int{50, 80}},
+	}
+	for _, test := range tests {
+		if crossed := webhooks.crossed(test.before, test.after, test.limit); !reflect.DeepEqual(crossed, test.expected) {
+			t.Errorf("Expected %d to %d of %d to cross %v but got %v", test.before, test.after, test.limit, test.expected, crossed)
+		}
+	}
+}
+
+func TestValidateWebhookURL(t *testing.T) {
+	for _, valid := range []string{"", "https://hooks.example.com/praxis", "http://203.0.113.7:8080"} {
+		if err := validateWebhookURL(valid); err != nil {
+			t.Errorf("Expected %s to be valid but got %+v", valid, err)
+		}
+	}
+	internal := []string{"http://localhost:8080", "http://redis.localhost", "http://127.0.0.1:6379", "http://10.1.2.3",
+		"http://169.254.169.254/latest/meta-data", "http://[::1]:8080", "http://[::ffff:192.168.1.1]", "http://0.0.0.0"}
+	for _, invalid := range append([]string{"hooks.example.com", "ftp://hooks.example.com", "https://"}, internal...) {
+		if err := validateWebhookURL(invalid); err == nil {
+			t.Errorf("Expected %s to be invalid", invalid)
+		}
+	}
+}
+
+func TestWebhooksNotify(t *testing.T) {
+	events := make(chan WebhookEvent, 10)
+	webhooks := NewWebhooks("", []byte("not a real secret"), defaultWebhookThresholds)
+	// The test server is on loopback, which keys are otherwise refused
+	webhooks.keyClient = webhooks.client
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if req.Header.Get(webhookSignatureHeader) != webhooks.sign(body) {
+			t.Errorf("Expected a valid signature but got %s", req.Header.Get(webhookSignatureHeader))
+		}
+		event := WebhookEvent{}
+		json.Unmarshal(body, &event)
+		events <- event
+	}))
+	defer server.Close()
+
+	store, _ := NewMemoryStore("")
+	config := AuthConfig{ServiceName: "praxis", Webhooks: webhooks}
+	keyConfig := &AuthWithLimit{ID: "limited", Limit: 2, RateLimit: 0.5, Burst: 2, WebhookURL: server.URL}
+
+	expected := []WebhookEvent{
+		{Event: WebhookWindowReset, Quota: "requests", Limit: 2},
+		{Event: WebhookThreshold, Quota: "requests", Threshold: 50, Used: 1, Limit: 2},
+		{Event: WebhookThreshold, Quota: "requests", Threshold: 80, Used: 2, Limit: 2},
+		{Event: WebhookThreshold, Quota: "requests", Threshold: 100, Used: 2, Limit: 2},
+	}
+	for i := 0; i < 2; i++ {
+		if err := config.checkLimits(store, keyConfig); err != nil {
+			t.Fatalf("Unexpected error on request %d : %+v", i, err)
+		}
+	}
+	// Events are delivered by several workers, so they can arrive in any order
+	for range expected {
+		select {
+		case event := <-events:
+			found := false
+			for i, want := range expected {
+				if event.Event == want.Event && event.Key == "limited" && event.Quota == want.Quota &&
+					event.Threshold == want.Threshold && event.Used == want.Used && event.Limit == want.Limit {
+					expected = append(expected[:i], expected[i+1:]...)
+					found = true
+					break
+				}
+			}
+			if !found {
+				t.Fatalf("Unexpected event %+v, still expecting %+v", event, expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %+v", expected)
+		}
+	}
+
+	// Rate limiting is reported once, however often it happens
+	keyConfig = &AuthWithLimit{ID: "rated", RateLimit: 0.5, Burst: 1, WebhookURL: server.URL}
+	for i := 0; i < 3; i++ {
+		config.checkLimits(store, keyConfig)
+	}
+	select {
+	case event := <-events:
+		if event.Event != WebhookRateLimited || event.Key != "rated" || event.RetryAfter == "" {
+			t.Fatalf("Expected rate limited event but got %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for rate limited event")
+	}
+	select {
+	case event := <-events:
+		t.Fatalf("Expected a single rate limited event but also got %+v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhooksKeyURLInternal(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Errorf("Expected the internal webhook not to be sent")
+	}))
+	defer server.Close()
+
+	// A name resolving to an internal address is refused once dialed
+	webhooks := &Webhooks{Secret: []byte("not a real secret")}
+	target := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	if err := webhooks.post(newKeyWebhookClient(), target, WebhookThreshold, []byte("{}")); err == nil || !strings.Contains(err.Error(), "internal") {
+		t.Fatalf("Expected the internal address to be refused but got %+v", err)
+	}
+}
+
+func TestWebhooksSlowKeyURL(t *testing.T) {
+	events := make(chan string, 10)
+	global := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		events <- req.Header.Get(webhookEventHeader)
+	}))
+	defer global.Close()
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	webhooks := NewWebhooks(global.URL, []byte("not a real secret"), defaultWebhookThresholds)
+	webhooks.keyClient = webhooks.client
+	keyConfig := &AuthWithLimit{ID: "slow", WebhookURL: slow.URL}
+	for i := 0; i < 3; i++ {
+		webhooks.send(keyConfig, WebhookEvent{Event: WebhookRateLimited})
+	}
+
+	// Another url being slow doesn't hold up the global events
+	for i := 0; i < 3; i++ {
+		select {
+		case <-events:
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for global event %d behind a slow key url", i+1)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// QuotaWindow is the period over which a keys usage is counted before it resets
+type QuotaWindow string
+
+const (
+	HourlyWindow     QuotaWindow = "hourly"
+	DailyWindow      QuotaWindow = "daily"
+	WeeklyWindow     QuotaWindow = "weekly"
+	MonthlyWindow    QuotaWindow = "monthly"
+	Rolling24hWindow QuotaWindow = "rolling24h"
+
+	// windowHistory is how many windows worth of counters are kept past the current one
+	windowHistory = 7
+)
+
+var (
+	locations      = make(map[string]*time.Location)
+	locationsMutex sync.Mutex
+)
+
+// usageWindow is a single bucket of usage, identified in redis keys by its label
+type usageWindow struct {
+	Label string
+	Start time.Time
+	End   time.Time
+}
+
+// loadLocation caches time zones as they are looked up for every request
+func loadLocation(name string) (*time.Location, error) {
+	locationsMutex.Lock()
+	defer locationsMutex.Unlock()
+
+	if loc, ok := locations[name]; ok {
+		return loc, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load time zone %s : %+v", name, err)
+	}
+	locations[name] = loc
+	return loc, nil
+}
+
+func (w QuotaWindow) valid() bool {
+	switch w {
+	case "", HourlyWindow, DailyWindow, WeeklyWindow, MonthlyWindow, Rolling24hWindow:
+		return true
+	}
+	return false
+}
+
+// current returns the bucket `t` falls into, evaluated in the time zone `loc`
+func (w QuotaWindow) current(t time.Time, loc *time.Location) usageWindow {
+	t = t.In(loc)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+
+	switch w {
+	case HourlyWindow, Rolling24hWindow:
+		// The hour repeated when clocks go back is told apart by its offset, and its start is
+		// found from `t` itself as time.Date could pick either of the two
+		start := t.Add(-time.Duration(t.Minute())*time.Minute - time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond()))
+		return usageWindow{Label: start.Format("2006-01-02T15-0700"), Start: start, End: start.Add(time.Hour)}
+	case WeeklyWindow:
+		// Weeks start on Monday to line up with ISO week numbering
+		start := day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+		year, week := start.ISOWeek()
+		return usageWindow{Label: fmt.Sprintf("%04d-W%02d", year, week), Start: start, End: start.AddDate(0, 0, 7)}
+	case MonthlyWindow:
+		start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+		return usageWindow{Label: start.Format("2006-01"), Start: start, End: start.AddDate(0, 1, 0)}
+	default:
+		return usageWindow{Label: day.Format("2006-01-02"), Start: day, End: day.AddDate(0, 0, 1)}
+	}
+}
+
+// buckets returns every bucket counted towards the window at `t`, newest first. Fixed
+// windows are a single bucket, while the rolling window is the past 24 hourly buckets
+func (w QuotaWindow) buckets(t time.Time, loc *time.Location) []usageWindow {
+	if w != Rolling24hWindow {
+		return []usageWindow{w.current(t, loc)}
+	}
+
+	// Zones shifting by less than an hour can land in the same bucket twice, which is only counted once
+	buckets := make([]usageWindow, 0, 24)
+	seen := make(map[string]bool)
+	for i := 0; i < 24; i++ {
+		bucket := w.current(t.Add(-time.Duration(i)*time.Hour), loc)
+		if !seen[bucket.Label] {
+			seen[bucket.Label] = true
+			buckets = append(buckets, bucket)
+		}
+	}
+	return buckets
+}
+
+// ttl is how many seconds a counter for `bucket` should live in redis, outlasting
+// the window it counts for and keeping a few windows of history behind it
+func (w QuotaWindow) ttl(bucket usageWindow, now time.Time) int {
+	length := bucket.End.Sub(bucket.Start)
+	if w == Rolling24hWindow {
+		length = 24 * time.Hour
+	}
+	return int((bucket.End.Sub(now) + windowHistory*length).Seconds())
+}
+
+// usage sums the counts for `buckets` (as returned by buckets), returning the total and how
+// long until it will next drop, either the window ending or the oldest rolling bucket aging out
+func (w QuotaWindow) usage(buckets []usageWindow, counts []int64, now time.Time) (int64, time.Duration) {
+	total := int64(0)
+	for _, count := range counts {
+		total += count
+	}
+
+	resetIn := buckets[0].End.Sub(now)
+	if w == Rolling24hWindow {
+		for i := len(counts) - 1; i >= 0; i-- {
+			if counts[i] > 0 {
+				resetIn = buckets[i].Start.Add(24 * time.Hour).Sub(now)
+				break
+			}
+		}
+	}
+	return total, resetIn
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindowCurrent(t *testing.T) {
+	loc, err := loadLocation("America/New_York")
+	if err != nil {
+		t.Fatalf("Unable to load time zone : %+v", err)
+	}
+
+	// 2020-04-02 03:30 UTC is still the 1st in New York
+	now := time.Date(2020, 4, 2, 3, 30, 0, 0, time.UTC)
+	expected := map[QuotaWindow]string{
+		HourlyWindow:     "2020-04-01T23-0400",
+		DailyWindow:      "2020-04-01",
+		WeeklyWindow:     "2020-W14",
+		MonthlyWindow:    "2020-04",
+		Rolling24hWindow: "2020-04-01T23-0400",
+		"":               "2020-04-01",
+	}
+	for window, label := range expected {
+		bucket := window.current(now, loc)
+		if bucket.Label != label {
+			t.Fatalf("Expected %s window label %s but got %s", window, label, bucket.Label)
+		}
+		if now.Before(bucket.Start) || !now.Before(bucket.End) {
+			t.Fatalf("Expected %s window %+v to contain %s", window, bucket, now)
+		}
+	}
+
+	week := WeeklyWindow.current(now, loc)
+	if week.Start.Weekday() != time.Monday {
+		t.Fatalf("Expected weekly window to start on Monday but got %s", week.Start.Weekday())
+	}
+}
+
+func TestHourlyWindowDST(t *testing.T) {
+	loc, err := loadLocation("America/New_York")
+	if err != nil {
+		t.Fatalf("Unable to load time zone : %+v", err)
+	}
+
+	// Clocks went back at 06:00 UTC on 2020-11-01, repeating 01:00 to 02:00 in New York
+	first := HourlyWindow.current(time.Date(2020, 11, 1, 5, 30, 0, 0, time.UTC), loc)
+	second := HourlyWindow.current(time.Date(2020, 11, 1, 6, 30, 0, 0, time.UTC), loc)
+	if first.Label == second.Label || first.Label != "2020-11-01T01-0400" || second.Label != "2020-11-01T01-0500" {
+		t.Fatalf("Expected the repeated hour to have its own label but got %s and %s", first.Label, second.Label)
+	}
+	if !second.Start.Equal(time.Date(2020, 11, 1, 6, 0, 0, 0, time.UTC)) || second.End.Sub(second.Start) != time.Hour {
+		t.Fatalf("Expected the repeated hour to start at 06:00 UTC but got %+v", second)
+	}
+
+	// Lord Howe Island only moves its clocks by half an hour
+	lordHowe, err := loadLocation("Australia/Lord_Howe")
+	if err != nil {
+		t.Fatalf("Unable to load time zone : %+v", err)
+	}
+	buckets := Rolling24hWindow.buckets(time.Date(2020, 4, 5, 12, 0, 0, 0, time.UTC), lordHowe)
+	seen := make(map[string]bool)
+	for _, bucket := range buckets {
+		if seen[bucket.Label] {
+			t.Fatalf("Expected rolling buckets to be counted once but got %s twice", bucket.Label)
+		}
+		seen[bucket.Label] = true
+	}
+	if len(buckets) != 23 {
+		t.Fatalf("Expected the bucket repeated by the half hour shift to be dropped but got %d", len(buckets))
+	}
+}
+
+func TestWindowTTL(t *testing.T) {
+	now := time.Date(2020, 4, 1, 12, 0, 0, 0, time.UTC)
+	bucket := DailyWindow.current(now, time.UTC)
+
+	expected := int((12*time.Hour + windowHistory*24*time.Hour).Seconds())
+	if DailyWindow.ttl(bucket, now) != expected {
+		t.Fatalf("Expected ttl of %d but got %d", expected, DailyWindow.ttl(bucket, now))
+	}
+}
+
+func TestRollingWindowUsage(t *testing.T) {
+	now := time.Date(2020, 4, 1, 12, 30, 0, 0, time.UTC)
+	buckets := Rolling24hWindow.buckets(now, time.UTC)
+	if len(buckets) != 24 {
+		t.Fatalf("Expected %d buckets but got %d", 24, len(buckets))
+	}
+
+	counts := make([]int64, 24)
+	counts[0] = 5
+	counts[20] = 3
+	usage, resetIn := Rolling24hWindow.usage(buckets, counts, now)
+	if usage != 8 {
+		t.Fatalf("Expected usage of %d but got %d", 8, usage)
+	}
+
+	// The bucket from 20 hours ago (16:00 yesterday) ages out at 16:00 today
+	if resetIn != 3*time.Hour+30*time.Minute {
+		t.Fatalf("Expected reset in %s but got %s", 3*time.Hour+30*time.Minute, resetIn)
+	}
+
+	usage, resetIn = DailyWindow.usage(DailyWindow.buckets(now, time.UTC), []int64{2}, now)
+	if usage != 2 || resetIn != 11*time.Hour+30*time.Minute {
+		t.Fatalf("Unexpected daily usage %d and reset %s", usage, resetIn)
+	}
+}